@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/max4t/ip8s"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func main() {
+	configPath := flag.String("config", "ip8s.yaml", "path to the configuration file (YAML or JSON)")
+	dryRun := flag.Bool("dry-run", false, "log what the broadcasters would do instead of doing it")
+	listenAddress := flag.String("listen-address", "", "host:port serving /metrics, /healthz, /readyz and /state (overrides listenAddress)")
+	metricsAddress := flag.String("metrics-address", "", "deprecated, use -listen-address")
+	flag.Parse()
+
+	config, err := ip8s.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	config.DryRun = config.DryRun || *dryRun
+	if *listenAddress == "" && *metricsAddress != "" {
+		log.Print("-metrics-address is deprecated, use -listen-address")
+		listenAddress = metricsAddress
+	}
+	if *listenAddress != "" {
+		config.ListenAddress = *listenAddress
+	}
+	status := ip8s.NewStatus()
+	mux := http.NewServeMux()
+	if config.ListenAddress != "" {
+		metrics, err := ip8s.NewMetrics(prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalf("failed to create the metrics: %v", err)
+		}
+		config.Instrument(metrics)
+		config.Track(status)
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/", status.Handler())
+	}
+	set, err := config.NotifierSet()
+	if err != nil {
+		log.Fatalf("failed to create the notifiers: %v", err)
+	}
+	status.Notifier(set)
+	rules, err := config.Mapping(set)
+	if err != nil {
+		log.Fatalf("failed to create the rules: %v", err)
+	}
+	elector, err := config.LeaderElector()
+	if err != nil {
+		log.Fatalf("failed to create the leader election: %v", err)
+	}
+	if elector != nil {
+		for i := range rules {
+			rules[i].Broadcaster = elector.Broadcaster(rules[i].Broadcaster)
+		}
+	}
+	controller, err := config.PublicationController(set, elector)
+	if err != nil {
+		log.Fatalf("failed to create the publication controller: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		log.Printf("received %s, shutting down", sig)
+		cancel()
+	}()
+
+	if config.ListenAddress != "" {
+		go serve(ctx, config.ListenAddress, mux)
+	}
+	elected := make(chan struct{})
+	if elector == nil {
+		close(elected)
+	} else {
+		go func() {
+			defer close(elected)
+			elector.Run(ctx)
+		}()
+	}
+	// the informer of the nodes runs as long as the process
+	set.Start(ctx.Done())
+	w := sync.WaitGroup{}
+	if controller != nil {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			controller.Run(ctx)
+		}()
+	}
+	w.Add(len(rules))
+	for _, rule := range rules {
+		go func(rule ip8s.Rule) {
+			defer w.Done()
+			run(ctx, rule, status)
+		}(rule)
+	}
+	w.Wait()
+	// waits for the lease to be released
+	<-elected
+	log.Print("stopped")
+}
+
+// serve runs the HTTP server until ctx is done.
+func serve(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+	log.Printf("listening on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("http server failed: %v", err)
+	}
+}
+
+func run(ctx context.Context, rule ip8s.Rule, status *ip8s.Status) {
+	prefix := ""
+	if rule.Name != "" {
+		prefix = rule.Name + ": "
+	}
+	ip8s.DeliverEvents(ctx, rule.Broadcaster, rule.Notifier.NotifyWithErrors(ctx),
+		ip8s.DeliveryEventHandler(func(event ip8s.Event) {
+			status.RuleEvent(rule.Name, event)
+			switch {
+			case event.Err != nil:
+				log.Printf("%sfailed to list the node IPs: %v", prefix, event.Err)
+			case event.Recovered:
+				log.Printf("%slisted the node IPs again, %d unchanged IPs", prefix, len(event.IPs))
+			default:
+				log.Printf("%sbroadcasting %d IPs: %v (added %v, removed %v)", prefix, len(event.IPs), event.IPs, event.Added, event.Removed)
+			}
+		}),
+		ip8s.DeliveryReportHandler(func(change ip8s.Change, report ip8s.DeliveryReport, retry time.Duration) {
+			if retry != 0 {
+				log.Printf("%sbroadcast failed, retrying in %s: %v", prefix, retry, report.Err())
+			}
+		}),
+	)
+}
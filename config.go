@@ -0,0 +1,1334 @@
+package ip8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/pkg/errors"
+	api "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+// Duration is a time.Duration read from its string form ("30s", "5m") in
+// configuration files.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrap(err, "duration must be a string")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrapf(err, "invalid duration %q", s)
+	}
+	d.Duration = v
+	return nil
+}
+
+// Config describes an ip8s process: where to find the cluster, which nodes
+// to watch and where to publish their IPs. It can be written in YAML or
+// JSON; environment variables (${VAR}) are expanded in its strings.
+type Config struct {
+	// Kubeconfig is the path to a kubeconfig file. The in-cluster
+	// configuration is used when empty.
+	Kubeconfig   string   `json:"kubeconfig,omitempty"`
+	Resync       Duration `json:"resync,omitempty"`
+	NodeSelector string   `json:"nodeSelector,omitempty"`
+	// AddressTypes are the node address types to publish by order of
+	// preference (ExternalIP, InternalIP, Hostname, ExternalDNS, InternalDNS).
+	AddressTypes []string `json:"addressTypes,omitempty"`
+	// AddressPolicy is one of "all" (default), "first" or "fallback".
+	AddressPolicy string `json:"addressPolicy,omitempty"`
+	// AddressFamily restricts the published IPs to "ipv4" or "ipv6".
+	AddressFamily string `json:"addressFamily,omitempty"`
+	// Debounce waits for the nodes to settle before publishing their IPs.
+	Debounce *DebounceConfig `json:"debounce,omitempty"`
+	// DryRun logs what the broadcasters would do instead of doing it.
+	DryRun bool `json:"dryRun,omitempty"`
+	// ListenAddress is the host:port serving the prometheus metrics on
+	// /metrics and the health endpoints (/healthz, /readyz and /state),
+	// disabled when empty.
+	ListenAddress string `json:"listenAddress,omitempty"`
+	// MetricsAddress is the former name of ListenAddress.
+	//
+	// Deprecated: use ListenAddress.
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+	// LeaderElection lets a single replica broadcast when set.
+	LeaderElection *LeaderElectionConfig `json:"leaderElection,omitempty"`
+	// State persists the IPs last broadcast by each broadcaster when set.
+	State        *StateConfig        `json:"state,omitempty"`
+	Broadcasters []BroadcasterConfig `json:"broadcasters,omitempty"`
+	// Rules publish several node pools instead of NodeSelector and
+	// Broadcasters, sharing the same node informer.
+	Rules []RuleConfig `json:"rules,omitempty"`
+	// Publications reconciles the NodeIPPublication custom resources when
+	// set, along with the rules.
+	Publications *PublicationsConfig `json:"publications,omitempty"`
+
+	metrics *Metrics
+	status  *Status
+	// store is shared by the rules and the publications, the file store
+	// serializes its saves
+	store StateStore
+}
+
+// DebounceConfig publishes the IPs once no node changed for QuietPeriod,
+// or at the latest MaxWait after the first change.
+type DebounceConfig struct {
+	QuietPeriod Duration `json:"quietPeriod"`
+	MaxWait     Duration `json:"maxWait,omitempty"`
+}
+
+// LeaderElectionConfig describes the Lease of the election, the unset
+// durations keep the defaults of LeaderElectionTiming.
+type LeaderElectionConfig struct {
+	// Namespace defaults to the namespace of the pod.
+	Namespace string `json:"namespace,omitempty"`
+	// Name defaults to ip8s.
+	Name string `json:"name,omitempty"`
+	// Identity defaults to the hostname (the pod name).
+	Identity      string   `json:"identity,omitempty"`
+	LeaseDuration Duration `json:"leaseDuration,omitempty"`
+	RenewDeadline Duration `json:"renewDeadline,omitempty"`
+	RetryPeriod   Duration `json:"retryPeriod,omitempty"`
+}
+
+// podNamespaceFile holds the namespace of the pod in the cluster.
+var podNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// podNamespace returns namespace, the namespace of the pod when empty.
+func podNamespace(namespace string) (string, error) {
+	if namespace != "" {
+		return namespace, nil
+	}
+	pod, err := ioutil.ReadFile(podNamespaceFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the namespace of the pod")
+	}
+	return strings.TrimSpace(string(pod)), nil
+}
+
+func (c LeaderElectionConfig) Validate() error {
+	_, err := c.LeaderElector(&kubernetes.Clientset{})
+	return err
+}
+
+func (c LeaderElectionConfig) LeaderElector(client kubernetes.Interface) (*LeaderElector, error) {
+	namespace, err := podNamespace(c.Namespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "missing leader election namespace")
+	}
+	name := c.Name
+	if name == "" {
+		name = "ip8s"
+	}
+	leaseDuration, renewDeadline, retryPeriod := 15*time.Second, 10*time.Second, 2*time.Second
+	if c.LeaseDuration.Duration != 0 {
+		leaseDuration = c.LeaseDuration.Duration
+	}
+	if c.RenewDeadline.Duration != 0 {
+		renewDeadline = c.RenewDeadline.Duration
+	}
+	if c.RetryPeriod.Duration != 0 {
+		retryPeriod = c.RetryPeriod.Duration
+	}
+	opts := []LeaderElectionOption{LeaderElectionTiming(leaseDuration, renewDeadline, retryPeriod)}
+	if c.Identity != "" {
+		opts = append(opts, LeaderElectionIdentity(c.Identity))
+	}
+	return NewLeaderElector(client, namespace, name, opts...)
+}
+
+// RuleConfig publishes the IPs of the nodes matching NodeSelector with its
+// own broadcasters.
+type RuleConfig struct {
+	// Name prefixes the names of the broadcasters of the rule (e.g.
+	// "ingress/slack#0").
+	Name         string `json:"name"`
+	NodeSelector string `json:"nodeSelector,omitempty"`
+	// DNSNames creates each broadcaster once per DNS name, overriding their
+	// dnsName.
+	DNSNames     []string            `json:"dnsNames,omitempty"`
+	Broadcasters []BroadcasterConfig `json:"broadcasters"`
+}
+
+type namedBroadcasterConfig struct {
+	name string
+	BroadcasterConfig
+}
+
+// perURL splits the webhook broadcasters and the slack incoming webhooks
+// with several URLs into a broadcaster per URL, named after its index (e.g.
+// "webhook#0/url#1"), so that a failed URL is redelivered alone.
+func (c namedBroadcasterConfig) perURL() []namedBroadcasterConfig {
+	var urls []string
+	switch {
+	case c.Type == "webhook" && c.Webhook != nil:
+		urls = c.Webhook.URLs
+	case c.Type == "slack" && c.Slack != nil:
+		urls = c.Slack.WebhookURLs
+	}
+	if len(urls) < 2 {
+		return []namedBroadcasterConfig{c}
+	}
+	confs := make([]namedBroadcasterConfig, len(urls))
+	for i, u := range urls {
+		conf := c.BroadcasterConfig
+		if c.Type == "webhook" {
+			webhook := *conf.Webhook
+			webhook.URLs = []string{u}
+			conf.Webhook = &webhook
+		} else {
+			slack := *conf.Slack
+			slack.WebhookURLs = []string{u}
+			conf.Slack = &slack
+		}
+		confs[i] = namedBroadcasterConfig{fmt.Sprintf("%s/url#%d", c.name, i), conf}
+	}
+	return confs
+}
+
+// broadcasters returns the broadcasters of the rule, named after its name,
+// their type and index, and their DNS name when DNSNames is set.
+func (r RuleConfig) broadcasters() []namedBroadcasterConfig {
+	prefix := ""
+	if r.Name != "" {
+		prefix = r.Name + "/"
+	}
+	confs := make([]namedBroadcasterConfig, 0, len(r.Broadcasters)*(len(r.DNSNames)+1))
+	for i, conf := range r.Broadcasters {
+		name := fmt.Sprintf("%s%s#%d", prefix, conf.Type, i)
+		if len(r.DNSNames) == 0 {
+			confs = append(confs, namedBroadcasterConfig{name, conf}.perURL()...)
+			continue
+		}
+		for _, dnsName := range r.DNSNames {
+			confs = append(confs, namedBroadcasterConfig{name + "/" + dnsName, conf.withDNSName(dnsName)}.perURL()...)
+		}
+	}
+	return confs
+}
+
+func (r RuleConfig) Validate() error {
+	if r.Name == "" || strings.Contains(r.Name, "/") {
+		return errors.Errorf("invalid rule name %q", r.Name)
+	}
+	if _, err := parseSelector(r.NodeSelector); err != nil {
+		return err
+	}
+	if len(r.Broadcasters) == 0 {
+		return errors.New("no broadcaster configured")
+	}
+	for _, conf := range r.broadcasters() {
+		if err := conf.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid broadcaster %s", conf.name)
+		}
+	}
+	return nil
+}
+
+// PublicationsConfig watches the NodeIPPublications, their notifiers get
+// the debounce of the configuration but their own address settings.
+type PublicationsConfig struct {
+	// Namespace restricts the watched publications, all the namespaces
+	// when empty.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// StateConfig persists the IPs last broadcast by each broadcaster, in a
+// configMap, a file or in memory, so that a restart does not broadcast them
+// again.
+type StateConfig struct {
+	Type      string                `json:"type"`
+	ConfigMap *ConfigMapStateConfig `json:"configMap,omitempty"`
+	File      *FileStateConfig      `json:"file,omitempty"`
+}
+
+type ConfigMapStateConfig struct {
+	// Namespace defaults to the namespace of the pod.
+	Namespace string `json:"namespace,omitempty"`
+	// Name defaults to ip8s-state.
+	Name string `json:"name,omitempty"`
+}
+
+type FileStateConfig struct {
+	Path string `json:"path"`
+}
+
+func (c StateConfig) Validate() error {
+	switch c.Type {
+	case "configMap":
+		_, err := c.configMap().StateStore(&kubernetes.Clientset{})
+		return err
+	case "file":
+		if c.File == nil {
+			return errors.New("missing file section")
+		}
+		_, err := NewFileStateStore(c.File.Path)
+		return err
+	case "memory":
+		return nil
+	default:
+		return errors.Errorf("unknown state type %q", c.Type)
+	}
+}
+
+// configMap returns the configMap section, the defaults when omitted.
+func (c StateConfig) configMap() ConfigMapStateConfig {
+	if c.ConfigMap == nil {
+		return ConfigMapStateConfig{}
+	}
+	return *c.ConfigMap
+}
+
+// StateStore only connects to the cluster, with restConfig, for the
+// configMap type.
+func (c StateConfig) StateStore(restConfig func() (*rest.Config, error)) (StateStore, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	switch c.Type {
+	case "configMap":
+		config, err := restConfig()
+		if err != nil {
+			return nil, err
+		}
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create the kubernetes client")
+		}
+		return c.configMap().StateStore(client)
+	case "file":
+		return NewFileStateStore(c.File.Path)
+	default:
+		return NewMemoryStateStore(), nil
+	}
+}
+
+func (c ConfigMapStateConfig) StateStore(client kubernetes.Interface) (StateStore, error) {
+	namespace, err := podNamespace(c.Namespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "missing state namespace")
+	}
+	name := c.Name
+	if name == "" {
+		name = "ip8s-state"
+	}
+	return NewConfigMapStateStore(client, namespace, name)
+}
+
+type BroadcasterConfig struct {
+	Type       string            `json:"type"`
+	Retry      *RetryConfig      `json:"retry,omitempty"`
+	Slack      *SlackConfig      `json:"slack,omitempty"`
+	Cloudflare *CloudflareConfig `json:"cloudflare,omitempty"`
+	Email      *EmailConfig      `json:"email,omitempty"`
+	Webhook    *WebhookConfig    `json:"webhook,omitempty"`
+	Route53    *Route53Config    `json:"route53,omitempty"`
+	RFC2136    *RFC2136Config    `json:"rfc2136,omitempty"`
+}
+
+// RetryConfig retries the failed broadcasts with an exponential backoff,
+// unset fields keep the defaults of NewRetryBroadcaster.
+type RetryConfig struct {
+	MaxAttempts    int      `json:"maxAttempts,omitempty"`
+	InitialBackoff Duration `json:"initialBackoff,omitempty"`
+	MaxBackoff     Duration `json:"maxBackoff,omitempty"`
+}
+
+// SlackConfig posts with the API when Token and Channel are set, to the
+// incoming WebhookURLs otherwise.
+type SlackConfig struct {
+	Token       string   `json:"token,omitempty"`
+	Channel     string   `json:"channel,omitempty"`
+	WebhookURLs []string `json:"webhookURLs,omitempty"`
+	DNSName     string   `json:"dnsName"`
+	// Cluster names the cluster in the messages.
+	Cluster string `json:"cluster,omitempty"`
+	// Template is the text/template of the messages, see SlackTemplate.
+	Template string `json:"template,omitempty"`
+	// Thread posts the updates as replies to the first message (API only).
+	Thread bool `json:"thread,omitempty"`
+}
+
+// CloudflareConfig authenticates either with an API token or with the
+// legacy API key and email pair.
+type CloudflareConfig struct {
+	APIToken string `json:"apiToken,omitempty"`
+	APIKey   string `json:"apiKey,omitempty"`
+	Email    string `json:"email,omitempty"`
+	DNSName  string `json:"dnsName"`
+	// AddressFamily selects the records: "ipv4" (A, the default), "ipv6" (AAAA)
+	// or "all" (both).
+	AddressFamily string `json:"addressFamily,omitempty"`
+	// ZoneID or ZoneName pin the zone owning DNSName, otherwise it is
+	// looked up from the longest matching suffix.
+	ZoneID   string `json:"zoneID,omitempty"`
+	ZoneName string `json:"zoneName,omitempty"`
+	// TTL, Proxied, Comment and Tags are only enforced when set, manual
+	// changes of the other attributes are kept. An empty list of Tags
+	// clears them.
+	TTL     int      `json:"ttl,omitempty"`
+	Proxied *bool    `json:"proxied,omitempty"`
+	Comment string   `json:"comment,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	// Rollback deletes the records created by a broadcast that could not
+	// reach the desired state.
+	Rollback bool `json:"rollback,omitempty"`
+}
+
+// EmailConfig sends the IPs through an SMTP server (host:port).
+type EmailConfig struct {
+	Server string `json:"server"`
+	// Security is one of "starttls" (default), "tls" or "none".
+	Security string `json:"security,omitempty"`
+	// Auth is "plain" or "login", the server is not authenticated against
+	// when empty.
+	Auth     string   `json:"auth,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	DNSName  string   `json:"dnsName"`
+	// Subject, Text and HTML replace the default templates.
+	Subject string `json:"subject,omitempty"`
+	Text    string `json:"text,omitempty"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// WebhookConfig posts the IPs as JSON to each URL.
+type WebhookConfig struct {
+	URLs    []string          `json:"urls"`
+	DNSName string            `json:"dnsName"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Secret signs the payloads with HMAC-SHA256 in SignatureHeader
+	// (default: X-Ip8s-Signature).
+	Secret          string   `json:"secret,omitempty"`
+	SignatureHeader string   `json:"signatureHeader,omitempty"`
+	Timeout         Duration `json:"timeout,omitempty"`
+	// ExpectedStatus lists the accepted statuses, any 2xx when empty.
+	ExpectedStatus []int `json:"expectedStatus,omitempty"`
+}
+
+// Route53Config uses the default AWS credentials chain (environment,
+// shared files, instance role, ...) unless AccessKeyID is set.
+type Route53Config struct {
+	Region          string `json:"region,omitempty"`
+	AccessKeyID     string `json:"accessKeyID,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	// Endpoint overrides the Route53 API URL.
+	Endpoint string `json:"endpoint,omitempty"`
+	DNSName  string `json:"dnsName"`
+	// AddressFamily selects the record sets: "ipv4" (A, the default), "ipv6"
+	// (AAAA) or "all" (both).
+	AddressFamily string `json:"addressFamily,omitempty"`
+	ZoneID        string `json:"zoneID,omitempty"`
+	ZoneName      string `json:"zoneName,omitempty"`
+	TTL           int64  `json:"ttl,omitempty"`
+	// Routing is "simple" (default), "weighted" or "multivalue", the
+	// latter two own the record sets of SetIdentifier only.
+	Routing       string `json:"routing,omitempty"`
+	SetIdentifier string `json:"setIdentifier,omitempty"`
+	Weight        int64  `json:"weight,omitempty"`
+	WaitForSync   bool   `json:"waitForSync,omitempty"`
+}
+
+// RFC2136Config sends DNS UPDATE messages to the primary server of the
+// zone (host:port).
+type RFC2136Config struct {
+	Server  string `json:"server"`
+	Zone    string `json:"zone"`
+	DNSName string `json:"dnsName"`
+	// AddressFamily selects the records: "ipv4" (A, the default), "ipv6" (AAAA)
+	// or "all" (both).
+	AddressFamily string `json:"addressFamily,omitempty"`
+	TTL           uint32 `json:"ttl,omitempty"`
+	// Mode is "replace" (default) to replace the whole RRsets or "minimal"
+	// to only add and delete the records that changed.
+	Mode          string `json:"mode,omitempty"`
+	Prerequisites bool   `json:"prerequisites,omitempty"`
+	// TSIGKey and TSIGSecret (base64) sign the updates with hmac-sha256.
+	TSIGKey    string   `json:"tsigKey,omitempty"`
+	TSIGSecret string   `json:"tsigSecret,omitempty"`
+	TCP        bool     `json:"tcp,omitempty"`
+	Timeout    Duration `json:"timeout,omitempty"`
+}
+
+const defaultResync = 30 * time.Second
+
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the config file")
+	}
+	return ParseConfig(content)
+}
+
+// envVariable matches the ${VAR} references, the bare $ are left as is for
+// the templates and the secrets.
+var envVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${VAR} references of s with the environment
+// variables, which must be defined.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envVariable.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envVariable.FindStringSubmatch(ref)[1]
+		value, exists := os.LookupEnv(name)
+		if !exists && err == nil {
+			err = errors.Errorf("undefined environment variable %s", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// expandStrings applies expand to the strings of the decoded JSON value.
+func expandStrings(value interface{}, expand func(string) (string, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return expand(v)
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if expanded[i], err = expandStrings(item, expand); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			var err error
+			if expanded[key], err = expandStrings(item, expand); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	default:
+		return v, nil
+	}
+}
+
+// ParseConfig expands the environment variables in the parsed strings, so
+// that their values cannot change the structure of the configuration.
+func ParseConfig(content []byte) (*Config, error) {
+	content, err := yaml.YAMLToJSONStrict(content)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the config")
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the config")
+	}
+	if doc, err = expandStrings(doc, expandEnv); err != nil {
+		return nil, err
+	}
+	if content, err = json.Marshal(doc); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the config")
+	}
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the config")
+	}
+	if c.Resync.Duration == 0 {
+		c.Resync.Duration = defaultResync
+	}
+	if c.MetricsAddress != "" {
+		if c.ListenAddress != "" {
+			return nil, errors.New("metricsAddress is replaced by listenAddress, set only the latter")
+		}
+		c.ListenAddress, c.MetricsAddress = c.MetricsAddress, ""
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) Validate() error {
+	if c.Resync.Duration < 0 {
+		return errors.Errorf("invalid resync duration %s", c.Resync.Duration)
+	}
+	if _, err := parseSelector(c.NodeSelector); err != nil {
+		return err
+	}
+	if _, err := c.notifierOptions(); err != nil {
+		return err
+	}
+	if c.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+			return errors.Wrapf(err, "invalid listen address %q", c.ListenAddress)
+		}
+	}
+	if c.LeaderElection != nil {
+		if err := c.LeaderElection.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.State != nil {
+		if err := c.State.Validate(); err != nil {
+			return errors.Wrap(err, "invalid state")
+		}
+	}
+	if len(c.Rules) == 0 {
+		if len(c.Broadcasters) == 0 && c.Publications == nil {
+			return errors.New("no broadcaster configured")
+		}
+		for i, b := range c.Broadcasters {
+			if err := b.Validate(); err != nil {
+				return errors.Wrapf(err, "invalid broadcaster #%d", i)
+			}
+		}
+		return nil
+	}
+	if c.NodeSelector != "" || len(c.Broadcasters) != 0 {
+		return errors.New("nodeSelector and broadcasters are configured by rule")
+	}
+	names := map[string]bool{}
+	for i, rule := range c.Rules {
+		if names[rule.Name] {
+			return errors.Errorf("duplicate rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rule.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid rule #%d", i)
+		}
+	}
+	return nil
+}
+
+func parseAddressFamily(family string) (AddressFamily, error) {
+	switch family {
+	case "", "all":
+		return AllFamilies, nil
+	case "ipv4":
+		return IPv4, nil
+	case "ipv6":
+		return IPv6, nil
+	default:
+		return AllFamilies, errors.Errorf("unknown address family %q", family)
+	}
+}
+
+// parseRecordFamily returns the family of the DNS records a broadcaster
+// reconciles, only the A records by default so that the AAAA records
+// managed by hand are kept.
+func parseRecordFamily(family string) (AddressFamily, error) {
+	if family == "" {
+		return IPv4, nil
+	}
+	return parseAddressFamily(family)
+}
+
+func (c *Config) notifierOptions() ([]NotifierOption, error) {
+	opts, err := addressOptions(c.AddressTypes, c.AddressPolicy, c.AddressFamily)
+	if err != nil {
+		return nil, err
+	}
+	if c.Debounce != nil {
+		opts = append(opts, WithDebounce(c.Debounce.QuietPeriod.Duration, c.Debounce.MaxWait.Duration))
+	}
+	_, err = newNotifierSettings(opts)
+	return opts, err
+}
+
+// addressOptions returns the options of the addressTypes, addressPolicy and
+// addressFamily settings.
+func addressOptions(addressTypes []string, addressPolicy, addressFamily string) ([]NotifierOption, error) {
+	family, err := parseAddressFamily(addressFamily)
+	if err != nil {
+		return nil, err
+	}
+	var policy AddressPolicy
+	switch addressPolicy {
+	case "", "all":
+		policy = AllAddresses
+	case "first":
+		policy = FirstAddress
+	case "fallback":
+		policy = FallbackAddresses
+	default:
+		return nil, errors.Errorf("unknown address policy %q", addressPolicy)
+	}
+	types := []api.NodeAddressType{api.NodeExternalIP}
+	if len(addressTypes) != 0 {
+		types = make([]api.NodeAddressType, len(addressTypes))
+		for i, typ := range addressTypes {
+			types[i] = api.NodeAddressType(typ)
+		}
+	}
+	return []NotifierOption{WithAddressTypes(policy, types...), WithAddressFamily(family)}, nil
+}
+
+// Instrument records the metrics of the notifier and broadcasters created
+// afterwards.
+func (c *Config) Instrument(m *Metrics) {
+	c.metrics = m
+}
+
+// Track records the outcome of the broadcasts of the broadcasters created
+// afterwards, named after their type and index (e.g. "slack#0").
+func (c *Config) Track(s *Status) {
+	c.status = s
+}
+
+// Notifier notifies the IPs of the nodes matching NodeSelector, use Mapping
+// when rules are configured.
+func (c *Config) Notifier() (Notifier, error) {
+	if len(c.Rules) != 0 {
+		return nil, errors.New("rules configured")
+	}
+	opts, err := c.allNotifierOptions()
+	if err != nil {
+		return nil, err
+	}
+	config, err := c.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewNotifier(config, c.Resync.Duration, c.NodeSelector, append(opts, WithMetricsName(""))...)
+}
+
+// allNotifierOptions adds the metrics to the notifier options.
+func (c *Config) allNotifierOptions() ([]NotifierOption, error) {
+	opts, err := c.notifierOptions()
+	if err != nil {
+		return nil, err
+	}
+	if c.metrics != nil {
+		opts = append(opts, WithMetrics(c.metrics))
+	}
+	return opts, nil
+}
+
+// Rule is the notifier of a rule and the broadcaster of its IPs.
+type Rule struct {
+	Name        string
+	Notifier    Notifier
+	Broadcaster Broadcaster
+}
+
+// NotifierSet creates the node informer shared by the rules and the
+// publications.
+func (c *Config) NotifierSet() (*NotifierSet, error) {
+	config, err := c.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewNotifierSet(config, c.Resync.Duration)
+}
+
+// Mapping returns the configured rules, or the default one (named "") made
+// of NodeSelector and Broadcasters, with their notifiers created by set.
+// It is empty when only publications are configured.
+func (c *Config) Mapping(set *NotifierSet) ([]Rule, error) {
+	opts, err := c.allNotifierOptions()
+	if err != nil {
+		return nil, err
+	}
+	store, err := c.stateStore()
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]Rule, 0, len(c.Rules))
+	for _, conf := range c.rules() {
+		notifier, err := set.Notifier(conf.NodeSelector, append(append([]NotifierOption{}, opts...), WithMetricsName(conf.Name))...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create the notifier of rule %q", conf.Name)
+		}
+		targets, err := c.targets(conf, store)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, Rule{Name: conf.Name, Notifier: notifier, Broadcaster: c.multiBroadcaster(targets)})
+	}
+	return rules, nil
+}
+
+// rules returns the configured rules, the default one when none is.
+func (c *Config) rules() []RuleConfig {
+	if len(c.Rules) != 0 {
+		return c.Rules
+	}
+	if len(c.Broadcasters) == 0 {
+		return nil
+	}
+	return []RuleConfig{{NodeSelector: c.NodeSelector, Broadcasters: c.Broadcasters}}
+}
+
+// PublicationController returns nil when the publications are disabled.
+// The elector may be nil.
+func (c *Config) PublicationController(set *NotifierSet, elector *LeaderElector) (*PublicationController, error) {
+	if c.Publications == nil {
+		return nil, nil
+	}
+	config, err := c.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the kubernetes client")
+	}
+	return c.publicationController(client, set, elector)
+}
+
+func (c *Config) publicationController(client dynamic.Interface, set *NotifierSet, elector *LeaderElector) (*PublicationController, error) {
+	store, err := c.stateStore()
+	if err != nil {
+		return nil, err
+	}
+	opts := []PublicationOption{
+		PublicationNamespace(c.Publications.Namespace),
+		PublicationResync(c.Resync.Duration),
+		PublicationMetrics(c.metrics),
+		PublicationStateStore(store),
+		PublicationStatus(c.status),
+		PublicationLeaderElector(elector),
+	}
+	if c.DryRun {
+		opts = append(opts, PublicationDryRun())
+	}
+	if c.Debounce != nil {
+		opts = append(opts, PublicationNotifierOptions(WithDebounce(c.Debounce.QuietPeriod.Duration, c.Debounce.MaxWait.Duration)))
+	}
+	return NewPublicationController(client, set, opts...)
+}
+
+// restConfig loads the kubeconfig, the in-cluster configuration when
+// unset.
+func (c *Config) restConfig() (*rest.Config, error) {
+	if c.Kubeconfig == "" {
+		config, err := rest.InClusterConfig()
+		return config, errors.Wrap(err, "failed to read cluster config")
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", c.Kubeconfig)
+	return config, errors.Wrapf(err, "failed to load kubeconfig %s", c.Kubeconfig)
+}
+
+// LeaderElector returns nil when the leader election is disabled.
+func (c *Config) LeaderElector() (*LeaderElector, error) {
+	if c.LeaderElection == nil {
+		return nil, nil
+	}
+	config, err := c.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the kubernetes client")
+	}
+	return c.LeaderElection.LeaderElector(client)
+}
+
+// Broadcaster broadcasts to Broadcasters, use Mapping when rules are
+// configured.
+func (c *Config) Broadcaster() (Broadcaster, error) {
+	if len(c.Rules) != 0 {
+		return nil, errors.New("rules configured")
+	}
+	targets, err := c.Targets()
+	if err != nil {
+		return nil, err
+	}
+	return c.multiBroadcaster(targets), nil
+}
+
+func (c *Config) multiBroadcaster(targets []NamedBroadcaster) Broadcaster {
+	if c.DryRun {
+		return NewDryRunBroadcaster(NewNamedMultiBroadcaster(targets...), nil)
+	}
+	return NewNamedMultiBroadcaster(targets...)
+}
+
+// Targets returns the broadcasters of all the rules, named after their
+// rule, type and index (e.g. "ingress/slack#0", or "slack#0" without rules),
+// as in the delivery reports and the /state endpoint.
+func (c *Config) Targets() ([]NamedBroadcaster, error) {
+	store, err := c.stateStore()
+	if err != nil {
+		return nil, err
+	}
+	var targets []NamedBroadcaster
+	for _, rule := range c.rules() {
+		ruleTargets, err := c.targets(rule, store)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, ruleTargets...)
+	}
+	return targets, nil
+}
+
+// stateStore returns nil when no state is configured, the same store
+// otherwise.
+func (c *Config) stateStore() (StateStore, error) {
+	if c.State == nil || c.store != nil {
+		return c.store, nil
+	}
+	store, err := c.State.StateStore(c.restConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the state store")
+	}
+	c.store = store
+	return store, nil
+}
+
+func (c *Config) targets(rule RuleConfig, store StateStore) ([]NamedBroadcaster, error) {
+	confs := rule.broadcasters()
+	targets := make([]NamedBroadcaster, 0, len(confs))
+	for _, conf := range confs {
+		broadcaster, err := conf.broadcaster(conf.name, c.metrics)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to build broadcaster %s", conf.name)
+		}
+		if store != nil {
+			broadcaster = NewStatefulBroadcaster(broadcaster, conf.name, store)
+		}
+		if c.status != nil {
+			broadcaster = NewStatusBroadcaster(broadcaster, conf.name, c.status)
+		}
+		// without the saved IPs to skip the unchanged ones, the
+		// notifications would be sent again on every new leader
+		noCatchUp := store == nil && conf.notification()
+		targets = append(targets, NamedBroadcaster{Name: conf.name, Broadcaster: broadcaster, NoCatchUp: noCatchUp})
+	}
+	return targets, nil
+}
+
+func (c BroadcasterConfig) Validate() error {
+	if c.Retry != nil {
+		if _, err := NewRetryBroadcaster(NewMultiBroadcaster(), c.Retry.options()...); err != nil {
+			return err
+		}
+	}
+	switch c.Type {
+	case "slack":
+		if c.Slack == nil {
+			return errors.New("missing slack section")
+		}
+		return c.Slack.Validate()
+	case "cloudflare":
+		if c.Cloudflare == nil {
+			return errors.New("missing cloudflare section")
+		}
+		return c.Cloudflare.Validate()
+	case "email":
+		if c.Email == nil {
+			return errors.New("missing email section")
+		}
+		return c.Email.Validate()
+	case "webhook":
+		if c.Webhook == nil {
+			return errors.New("missing webhook section")
+		}
+		return c.Webhook.Validate()
+	case "route53":
+		if c.Route53 == nil {
+			return errors.New("missing route53 section")
+		}
+		return c.Route53.Validate()
+	case "rfc2136":
+		if c.RFC2136 == nil {
+			return errors.New("missing rfc2136 section")
+		}
+		return c.RFC2136.Validate()
+	case "":
+		return errors.New("missing broadcaster type")
+	default:
+		return errors.Errorf("unknown broadcaster type %q", c.Type)
+	}
+}
+
+func (c BroadcasterConfig) Broadcaster() (Broadcaster, error) {
+	return c.broadcaster("", nil)
+}
+
+// withDNSName returns a copy of c publishing dnsName.
+func (c BroadcasterConfig) withDNSName(dnsName string) BroadcasterConfig {
+	switch c.Type {
+	case "slack":
+		if c.Slack != nil {
+			conf := *c.Slack
+			conf.DNSName = dnsName
+			c.Slack = &conf
+		}
+	case "cloudflare":
+		if c.Cloudflare != nil {
+			conf := *c.Cloudflare
+			conf.DNSName = dnsName
+			c.Cloudflare = &conf
+		}
+	case "email":
+		if c.Email != nil {
+			conf := *c.Email
+			conf.DNSName = dnsName
+			c.Email = &conf
+		}
+	case "webhook":
+		if c.Webhook != nil {
+			conf := *c.Webhook
+			conf.DNSName = dnsName
+			c.Webhook = &conf
+		}
+	case "route53":
+		if c.Route53 != nil {
+			conf := *c.Route53
+			conf.DNSName = dnsName
+			c.Route53 = &conf
+		}
+	case "rfc2136":
+		if c.RFC2136 != nil {
+			conf := *c.RFC2136
+			conf.DNSName = dnsName
+			c.RFC2136 = &conf
+		}
+	}
+	return c
+}
+
+// notification tells whether the broadcaster notifies people or systems,
+// unlike the DNS ones for which a broadcast of the same IPs is harmless.
+func (c BroadcasterConfig) notification() bool {
+	switch c.Type {
+	case "slack", "email", "webhook":
+		return true
+	}
+	return false
+}
+
+// credential is a field of the configuration of a broadcaster holding a
+// secret.
+type credential struct {
+	field string
+	value string
+}
+
+// credentials returns the credentials of the broadcaster, set or not.
+func (c BroadcasterConfig) credentials() []credential {
+	switch {
+	case c.Type == "slack" && c.Slack != nil:
+		return []credential{{"slack.token", c.Slack.Token}}
+	case c.Type == "cloudflare" && c.Cloudflare != nil:
+		return []credential{{"cloudflare.apiToken", c.Cloudflare.APIToken}, {"cloudflare.apiKey", c.Cloudflare.APIKey}}
+	case c.Type == "email" && c.Email != nil:
+		return []credential{{"email.password", c.Email.Password}}
+	case c.Type == "webhook" && c.Webhook != nil:
+		return []credential{{"webhook.secret", c.Webhook.Secret}}
+	case c.Type == "route53" && c.Route53 != nil:
+		return []credential{{"route53.accessKeyID", c.Route53.AccessKeyID}, {"route53.secretAccessKey", c.Route53.SecretAccessKey}}
+	case c.Type == "rfc2136" && c.RFC2136 != nil:
+		return []credential{{"rfc2136.tsigSecret", c.RFC2136.TSIGSecret}}
+	}
+	return nil
+}
+
+// broadcaster instruments the broadcaster under its name when m is set,
+// below the retries to record each attempt.
+func (c BroadcasterConfig) broadcaster(name string, m *Metrics) (Broadcaster, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var b Broadcaster
+	var err error
+	switch c.Type {
+	case "slack":
+		b, err = c.Slack.Broadcaster()
+	case "email":
+		b, err = c.Email.Broadcaster()
+	case "webhook":
+		b, err = c.Webhook.Broadcaster()
+	case "route53":
+		b, err = c.Route53.Broadcaster()
+	case "rfc2136":
+		b, err = c.RFC2136.Broadcaster()
+	default:
+		b, err = c.Cloudflare.Broadcaster()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		b = NewInstrumentedBroadcaster(b, name, c.Type, m)
+	}
+	if c.Retry == nil {
+		return b, nil
+	}
+	return NewRetryBroadcaster(b, c.Retry.options()...)
+}
+
+func (c RetryConfig) options() []RetryOption {
+	var opts []RetryOption
+	if c.MaxAttempts != 0 {
+		opts = append(opts, RetryMaxAttempts(c.MaxAttempts))
+	}
+	if c.InitialBackoff.Duration != 0 || c.MaxBackoff.Duration != 0 {
+		initial, max := c.InitialBackoff.Duration, c.MaxBackoff.Duration
+		if initial == 0 {
+			initial = time.Second
+		}
+		if max == 0 {
+			max = 30 * time.Second
+			if initial > max {
+				max = initial
+			}
+		}
+		opts = append(opts, RetryBackoff(initial, max))
+	}
+	return opts
+}
+
+func (c SlackConfig) Validate() error {
+	_, err := c.Broadcaster()
+	return err
+}
+
+func (c SlackConfig) Broadcaster() (Broadcaster, error) {
+	opts := []SlackOption{SlackCluster(c.Cluster), SlackTemplate(c.Template)}
+	if c.Thread {
+		opts = append(opts, SlackThread())
+	}
+	if len(c.WebhookURLs) == 0 {
+		return NewSlackBroadcaster(c.Token, c.Channel, c.DNSName, opts...)
+	}
+	if c.Token != "" || c.Channel != "" {
+		return nil, errors.New("slack token and channel cannot be used with webhook urls")
+	}
+	return NewSlackWebhookBroadcaster(c.WebhookURLs, c.DNSName, opts...)
+}
+
+func (c CloudflareConfig) Validate() error {
+	if c.APIToken == "" && (c.APIKey == "" || c.Email == "") {
+		return errors.New("either an api token or an api key and an email are required")
+	}
+	if _, err := parseRecordFamily(c.AddressFamily); err != nil {
+		return err
+	}
+	return validateDNSName(c.DNSName)
+}
+
+func (c CloudflareConfig) Broadcaster() (Broadcaster, error) {
+	var api *cloudflare.API
+	var err error
+	if c.APIToken != "" {
+		api, err = cloudflare.NewWithAPIToken(c.APIToken)
+	} else {
+		api, err = cloudflare.New(c.APIKey, c.Email)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the cloudflare client")
+	}
+	family, err := parseRecordFamily(c.AddressFamily)
+	if err != nil {
+		return nil, err
+	}
+	opts := []CloudflareOption{CloudflareAddressFamily(family)}
+	if c.ZoneID != "" {
+		opts = append(opts, CloudflareZoneID(c.ZoneID))
+	}
+	if c.ZoneName != "" {
+		opts = append(opts, CloudflareZoneName(c.ZoneName))
+	}
+	if c.TTL != 0 {
+		opts = append(opts, CloudflareTTL(c.TTL))
+	}
+	if c.Proxied != nil {
+		opts = append(opts, CloudflareProxied(*c.Proxied))
+	}
+	if c.Comment != "" {
+		opts = append(opts, CloudflareComment(c.Comment))
+	}
+	if c.Tags != nil {
+		opts = append(opts, CloudflareTags(c.Tags...))
+	}
+	if c.Rollback {
+		opts = append(opts, CloudflareRollback())
+	}
+	return NewCloudflareDNSBroadcaster(api, c.DNSName, opts...)
+}
+
+func (c EmailConfig) Validate() error {
+	_, err := c.Broadcaster()
+	return err
+}
+
+func (c EmailConfig) Broadcaster() (Broadcaster, error) {
+	var opts []EmailOption
+	switch c.Security {
+	case "", "starttls":
+		opts = append(opts, EmailSecurity(StartTLS))
+	case "tls":
+		opts = append(opts, EmailSecurity(ImplicitTLS))
+	case "none":
+		opts = append(opts, EmailSecurity(NoTLS))
+	default:
+		return nil, errors.Errorf("unknown smtp security %q", c.Security)
+	}
+	switch c.Auth {
+	case "":
+	case "plain":
+		opts = append(opts, EmailAuth(PlainAuth, c.Username, c.Password))
+	case "login":
+		opts = append(opts, EmailAuth(LoginAuth, c.Username, c.Password))
+	default:
+		return nil, errors.Errorf("unknown smtp auth %q", c.Auth)
+	}
+	opts = append(opts, EmailTemplates(c.Subject, c.Text, c.HTML))
+	return NewEmailBroadcaster(c.Server, c.From, c.To, c.DNSName, opts...)
+}
+
+func (c WebhookConfig) Validate() error {
+	_, err := c.Broadcaster()
+	return err
+}
+
+func (c WebhookConfig) Broadcaster() (Broadcaster, error) {
+	var opts []WebhookOption
+	for name, value := range c.Headers {
+		opts = append(opts, WebhookHeader(name, value))
+	}
+	if c.Secret != "" {
+		opts = append(opts, WebhookSecret(c.Secret))
+	}
+	if c.SignatureHeader != "" {
+		opts = append(opts, WebhookSignatureHeader(c.SignatureHeader))
+	}
+	if c.Timeout.Duration != 0 {
+		opts = append(opts, WebhookTimeout(c.Timeout.Duration))
+	}
+	if len(c.ExpectedStatus) != 0 {
+		opts = append(opts, WebhookExpectedStatus(c.ExpectedStatus...))
+	}
+	return NewWebhookBroadcaster(c.URLs, c.DNSName, opts...)
+}
+
+func (c Route53Config) options() ([]Route53Option, error) {
+	family, err := parseRecordFamily(c.AddressFamily)
+	if err != nil {
+		return nil, err
+	}
+	if c.AccessKeyID != "" && c.SecretAccessKey == "" {
+		return nil, errors.New("missing aws secret access key")
+	}
+	opts := []Route53Option{Route53AddressFamily(family)}
+	switch c.Routing {
+	case "", "simple":
+	case "weighted":
+		opts = append(opts, Route53Weighted(c.SetIdentifier, c.Weight))
+	case "multivalue":
+		opts = append(opts, Route53MultiValue(c.SetIdentifier))
+	default:
+		return nil, errors.Errorf("unknown routing policy %q", c.Routing)
+	}
+	if c.ZoneID != "" {
+		opts = append(opts, Route53ZoneID(c.ZoneID))
+	}
+	if c.ZoneName != "" {
+		opts = append(opts, Route53ZoneName(c.ZoneName))
+	}
+	if c.TTL != 0 {
+		opts = append(opts, Route53TTL(c.TTL))
+	}
+	if c.WaitForSync {
+		opts = append(opts, Route53WaitForSync())
+	}
+	return opts, nil
+}
+
+func (c Route53Config) Validate() error {
+	opts, err := c.options()
+	if err != nil {
+		return err
+	}
+	_, err = NewRoute53Broadcaster(&route53.Route53{}, c.DNSName, opts...)
+	return err
+}
+
+func (c Route53Config) Broadcaster() (Broadcaster, error) {
+	opts, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+	config := &aws.Config{}
+	if c.Region != "" {
+		config.Region = aws.String(c.Region)
+	}
+	if c.Endpoint != "" {
+		config.Endpoint = aws.String(c.Endpoint)
+	}
+	if c.AccessKeyID != "" {
+		config.Credentials = credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, "")
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the aws session")
+	}
+	return NewRoute53Broadcaster(route53.New(sess), c.DNSName, opts...)
+}
+
+func (c RFC2136Config) Validate() error {
+	_, err := c.Broadcaster()
+	return err
+}
+
+func (c RFC2136Config) Broadcaster() (Broadcaster, error) {
+	family, err := parseRecordFamily(c.AddressFamily)
+	if err != nil {
+		return nil, err
+	}
+	opts := []RFC2136Option{RFC2136AddressFamily(family)}
+	switch c.Mode {
+	case "", "replace":
+	case "minimal":
+		opts = append(opts, RFC2136Mode(MinimalUpdate))
+	default:
+		return nil, errors.Errorf("unknown update mode %q", c.Mode)
+	}
+	if c.TTL != 0 {
+		opts = append(opts, RFC2136TTL(c.TTL))
+	}
+	if c.Prerequisites {
+		opts = append(opts, RFC2136Prerequisites())
+	}
+	if c.TSIGKey != "" || c.TSIGSecret != "" {
+		if c.TSIGKey == "" {
+			return nil, errors.New("missing tsig key name")
+		}
+		opts = append(opts, RFC2136TSIG(c.TSIGKey, c.TSIGSecret))
+	}
+	if c.TCP {
+		opts = append(opts, RFC2136TCP())
+	}
+	if c.Timeout.Duration != 0 {
+		opts = append(opts, RFC2136Timeout(c.Timeout.Duration))
+	}
+	return NewRFC2136Broadcaster(c.Server, c.Zone, c.DNSName, opts...)
+}
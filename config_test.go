@@ -0,0 +1,712 @@
+package ip8s
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+type parseConfigTestCase struct {
+	content string
+	valid   bool
+}
+
+func TestParseConfig(t *testing.T) {
+	testCases := map[string]parseConfigTestCase{
+		"Empty": {
+			content: ``,
+			valid:   false,
+		},
+		"Slack": {
+			content: `
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: true,
+		},
+		"SlackTemplate": {
+			content: `
+broadcasters:
+- type: slack
+  slack:
+    token: xoxb
+    channel: C123
+    dnsName: example.com
+    cluster: prod
+    template: '{{ .Cluster }}: {{ join ", " .Added }}'
+`,
+			valid: true,
+		},
+		"SlackWebhook": {
+			content: `
+broadcasters:
+- type: slack
+  slack: {webhookURLs: ["https://hooks.slack.com/services/T000/B000/XXX"], dnsName: example.com}
+`,
+			valid: true,
+		},
+		"SlackWebhookWithToken": {
+			content: `
+broadcasters:
+- type: slack
+  slack: {token: xoxb, webhookURLs: ["https://hooks.slack.com/services/T000/B000/XXX"], dnsName: example.com}
+`,
+			valid: false,
+		},
+		"SlackWebhookThread": {
+			content: `
+broadcasters:
+- type: slack
+  slack: {webhookURLs: ["https://hooks.slack.com/services/T000/B000/XXX"], dnsName: example.com, thread: true}
+`,
+			valid: false,
+		},
+		"SlackInvalidTemplate": {
+			content: `
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com, template: '{{ .IPs '}
+`,
+			valid: false,
+		},
+		"CloudflareToken": {
+			content: `{"broadcasters": [{"type": "cloudflare", "cloudflare": {"apiToken": "abc", "dnsName": "example.com"}}]}`,
+			valid:   true,
+		},
+		"CloudflareMissingEmail": {
+			content: `
+broadcasters:
+- type: cloudflare
+  cloudflare: {apiKey: abc, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"MissingSection": {
+			content: `
+broadcasters:
+- type: slack
+`,
+			valid: false,
+		},
+		"UnknownType": {
+			content: `
+broadcasters:
+- type: carrier-pigeon
+`,
+			valid: false,
+		},
+		"UnknownField": {
+			content: `
+selector: role=ingress
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"ListenAddress": {
+			content: `
+listenAddress: :9090
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: true,
+		},
+		"InvalidListenAddress": {
+			content: `
+listenAddress: localhost
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"MetricsAddress": {
+			content: `
+metricsAddress: :9090
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: true,
+		},
+		"MetricsAndListenAddress": {
+			content: `
+metricsAddress: :9090
+listenAddress: :9091
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"InvalidMetricsAddress": {
+			content: `
+metricsAddress: localhost
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"LeaderElection": {
+			content: `
+leaderElection: {namespace: ip8s, leaseDuration: 30s, renewDeadline: 20s}
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: true,
+		},
+		"LeaderElectionInvalidTiming": {
+			content: `
+leaderElection: {namespace: ip8s, leaseDuration: 5s}
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"StateConfigMap": {
+			content: `
+state: {type: configMap, configMap: {namespace: ip8s}}
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: true,
+		},
+		"StateFile": {
+			content: `
+state: {type: file, file: {path: /var/lib/ip8s/state.json}}
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: true,
+		},
+		"StateFileWithoutPath": {
+			content: `
+state: {type: file}
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"StateUnknownType": {
+			content: `
+state: {type: redis}
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"Rules": {
+			content: `
+rules:
+- name: ingress
+  nodeSelector: role=ingress
+  dnsNames: [app.example.com, www.example.com]
+  broadcasters:
+  - type: cloudflare
+    cloudflare: {apiToken: token}
+- name: workers
+  nodeSelector: role=worker
+  broadcasters:
+  - type: slack
+    slack: {token: xoxb, channel: C123, dnsName: workers.example.com}
+`,
+			valid: true,
+		},
+		"RuleWithoutDNSName": {
+			content: `
+rules:
+- name: ingress
+  broadcasters:
+  - type: cloudflare
+    cloudflare: {apiToken: token}
+`,
+			valid: false,
+		},
+		"RuleWithoutName": {
+			content: `
+rules:
+- nodeSelector: role=ingress
+  broadcasters:
+  - type: slack
+    slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"DuplicateRules": {
+			content: `
+rules:
+- name: ingress
+  broadcasters:
+  - type: slack
+    slack: {token: xoxb, channel: C123, dnsName: example.com}
+- name: ingress
+  broadcasters:
+  - type: slack
+    slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"RulesWithBroadcasters": {
+			content: `
+rules:
+- name: ingress
+  broadcasters:
+  - type: slack
+    slack: {token: xoxb, channel: C123, dnsName: example.com}
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"Publications": {
+			content: `
+publications:
+  namespace: ip8s
+`,
+			valid: true,
+		},
+		"NoBroadcasters": {
+			content: `
+nodeSelector: role=ingress
+`,
+			valid: false,
+		},
+		"AddressTypes": {
+			content: `
+addressTypes: [InternalIP, ExternalIP]
+addressPolicy: fallback
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: true,
+		},
+		"UnknownAddressType": {
+			content: `
+addressTypes: [PublicIP]
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"UnknownAddressPolicy": {
+			content: `
+addressPolicy: random
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"AddressFamily": {
+			content: `
+addressFamily: ipv6
+broadcasters:
+- type: cloudflare
+  cloudflare: {apiToken: abc, dnsName: example.com, addressFamily: ipv6}
+`,
+			valid: true,
+		},
+		"UnknownAddressFamily": {
+			content: `
+broadcasters:
+- type: cloudflare
+  cloudflare: {apiToken: abc, dnsName: example.com, addressFamily: ipx}
+`,
+			valid: false,
+		},
+		"Email": {
+			content: `
+broadcasters:
+- type: email
+  email:
+    server: smtp.example.com:465
+    security: tls
+    auth: login
+    username: ip8s
+    password: secret
+    from: ip8s@example.com
+    to: [ops@example.com]
+    dnsName: example.com
+`,
+			valid: true,
+		},
+		"EmailUnknownSecurity": {
+			content: `
+broadcasters:
+- type: email
+  email: {server: "smtp.example.com:25", security: ssl, from: ip8s@example.com, to: [ops@example.com], dnsName: example.com}
+`,
+			valid: false,
+		},
+		"Webhook": {
+			content: `
+broadcasters:
+- type: webhook
+  webhook:
+    urls: [https://allowlist.example.com/hook]
+    dnsName: example.com
+    headers: {Authorization: Bearer token}
+    secret: s3cr3t
+    timeout: 5s
+    expectedStatus: [200, 202]
+`,
+			valid: true,
+		},
+		"WebhookInvalidURL": {
+			content: `
+broadcasters:
+- type: webhook
+  webhook: {urls: [allowlist], dnsName: example.com}
+`,
+			valid: false,
+		},
+		"Route53": {
+			content: `
+broadcasters:
+- type: route53
+  route53:
+    region: eu-west-1
+    dnsName: app.example.com
+    routing: weighted
+    setIdentifier: eu-west
+    weight: 10
+    waitForSync: true
+`,
+			valid: true,
+		},
+		"Route53MissingSetIdentifier": {
+			content: `
+broadcasters:
+- type: route53
+  route53: {dnsName: app.example.com, routing: multivalue}
+`,
+			valid: false,
+		},
+		"RFC2136": {
+			content: `
+broadcasters:
+- type: rfc2136
+  rfc2136:
+    server: ns1.example.com:53
+    zone: example.com
+    dnsName: app.example.com
+    mode: minimal
+    prerequisites: true
+    tsigKey: ip8s
+    tsigSecret: c2VjcmV0
+`,
+			valid: true,
+		},
+		"RFC2136MissingKeyName": {
+			content: `
+broadcasters:
+- type: rfc2136
+  rfc2136: {server: "ns1.example.com:53", zone: example.com, dnsName: app.example.com, tsigSecret: c2VjcmV0}
+`,
+			valid: false,
+		},
+		"Retry": {
+			content: `
+broadcasters:
+- type: slack
+  retry: {maxAttempts: 3, initialBackoff: 2s}
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: true,
+		},
+		"InvalidRetry": {
+			content: `
+broadcasters:
+- type: slack
+  retry: {initialBackoff: 1m, maxBackoff: 10s}
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"InvalidSelector": {
+			content: `
+nodeSelector: "role in (ingress"
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+		"InvalidResync": {
+			content: `
+resync: soon
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`,
+			valid: false,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(testCase.content))
+			if testCase.valid && err != nil {
+				t.Errorf("config rejected: expected <nil> but got %v", err)
+			} else if !testCase.valid && err == nil {
+				t.Error("config accepted: expected an error but got <nil>")
+			}
+		})
+	}
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	os.Setenv("IP8S_TEST_SLACK_TOKEN", "xoxb-from-env")
+	defer os.Unsetenv("IP8S_TEST_SLACK_TOKEN")
+	c, err := ParseConfig([]byte(`
+nodeSelector: role=ingress
+broadcasters:
+- type: slack
+  slack: {token: "${IP8S_TEST_SLACK_TOKEN}", channel: C123, dnsName: example.com}
+`))
+	if err != nil {
+		t.Fatalf("config rejected: expected <nil> but got %v", err)
+	}
+	if c.Resync.Duration != 30*time.Second {
+		t.Errorf("invalid default resync: expected 30s but got %s", c.Resync.Duration)
+	}
+	if c.NodeSelector != "role=ingress" {
+		t.Errorf("invalid selector: expected 'role=ingress' but got '%s'", c.NodeSelector)
+	}
+	if token := c.Broadcasters[0].Slack.Token; token != "xoxb-from-env" {
+		t.Errorf("environment not expanded: expected 'xoxb-from-env' but got '%s'", token)
+	}
+}
+
+func TestParseConfigMetricsAddress(t *testing.T) {
+	c, err := ParseConfig([]byte(`
+metricsAddress: :9090
+broadcasters:
+- type: slack
+  slack: {token: xoxb, channel: C123, dnsName: example.com}
+`))
+	if err != nil {
+		t.Fatalf("config rejected: expected <nil> but got %v", err)
+	}
+	if c.ListenAddress != ":9090" {
+		t.Errorf("invalid listen address: expected ':9090' but got '%s'", c.ListenAddress)
+	}
+}
+
+func TestParseConfigCloudflareTags(t *testing.T) {
+	c, err := ParseConfig([]byte(`
+broadcasters:
+- type: cloudflare
+  cloudflare: {apiToken: abc, dnsName: example.com, tags: []}
+`))
+	if err != nil {
+		t.Fatalf("config rejected: expected <nil> but got %v", err)
+	}
+	if tags := c.Broadcasters[0].Cloudflare.Tags; tags == nil || len(tags) != 0 {
+		t.Errorf("invalid tags: expected an empty list but got %#v", tags)
+	}
+}
+
+func TestParseConfigEnv(t *testing.T) {
+	os.Setenv("IP8S_TEST_SLACK_TOKEN", "xoxb-$from-env")
+	defer os.Unsetenv("IP8S_TEST_SLACK_TOKEN")
+	c, err := ParseConfig([]byte(`
+broadcasters:
+- type: slack
+  slack:
+    token: "${IP8S_TEST_SLACK_TOKEN}"
+    channel: C123
+    dnsName: example.com
+    template: "{{ range $ip := .IPs }}{{ $ip }} {{ end }}$HOME"
+`))
+	if err != nil {
+		t.Fatalf("config rejected: expected <nil> but got %v", err)
+	}
+	if token := c.Broadcasters[0].Slack.Token; token != "xoxb-$from-env" {
+		t.Errorf("invalid token: expected 'xoxb-$from-env' but got '%s'", token)
+	}
+	if template := c.Broadcasters[0].Slack.Template; template != "{{ range $ip := .IPs }}{{ $ip }} {{ end }}$HOME" {
+		t.Errorf("template expanded: expected the bare $ to be kept but got '%s'", template)
+	}
+
+	_, err = ParseConfig([]byte(`
+broadcasters:
+- type: slack
+  slack: {token: "${IP8S_TEST_UNDEFINED}", channel: C123, dnsName: example.com}
+`))
+	if err == nil {
+		t.Error("undefined variable accepted: expected an error but got <nil>")
+	}
+}
+
+func TestParseConfigEnvStructure(t *testing.T) {
+	// a value breaking out of its string would add a dryRun key
+	value := "x\" #\n  channel: C999\ndryRun: true\n'"
+	os.Setenv("IP8S_TEST_SLACK_TOKEN", value)
+	defer os.Unsetenv("IP8S_TEST_SLACK_TOKEN")
+	for _, content := range []string{
+		`{"broadcasters": [{"type": "slack", "slack": {"token": "${IP8S_TEST_SLACK_TOKEN}", "channel": "C123", "dnsName": "example.com"}}]}`,
+		`
+broadcasters:
+- type: slack
+  slack:
+    token: ${IP8S_TEST_SLACK_TOKEN}
+    channel: C123
+    dnsName: example.com
+`,
+	} {
+		c, err := ParseConfig([]byte(content))
+		if err != nil {
+			t.Fatalf("config rejected: expected <nil> but got %v", err)
+		}
+		if slack := c.Broadcasters[0].Slack; slack.Token != value || slack.Channel != "C123" || c.DryRun {
+			t.Errorf("config changed by the value: expected the token %q but got %+v, dry-run %v", value, slack, c.DryRun)
+		}
+	}
+}
+
+func TestConfigMapping(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	ingress := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	worker := buildNode().
+		Label("role", "worker").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.5")
+	client := fakekube.NewSimpleClientset(ingress.Build("node1"), worker.Build("node2"))
+	s := NewStatus()
+	config := &Config{Rules: []RuleConfig{
+		{
+			Name:         "ingress",
+			NodeSelector: "role=ingress",
+			DNSNames:     []string{"app.example.com", "www.example.com"},
+			Broadcasters: []BroadcasterConfig{{Type: "slack", Slack: &SlackConfig{WebhookURLs: []string{server.WebhookURL("ops")}}}},
+		},
+		{
+			Name:         "workers",
+			NodeSelector: "role=worker",
+			Broadcasters: []BroadcasterConfig{{Type: "slack", Slack: &SlackConfig{WebhookURLs: []string{server.WebhookURL("dev")}, DNSName: "workers.example.com"}}},
+		},
+	}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.Track(s)
+	rules, err := config.Mapping(newNotifierSetFromClient(client, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, rule := range rules {
+		event := <-rule.Notifier.NotifyWithErrors(ctx)
+		if err := BroadcastChange(ctx, rule.Broadcaster, event.Change); err != nil {
+			t.Fatalf("broadcast of %s failed: expected <nil> but got %v", rule.Name, err)
+		}
+	}
+	if messages := server.Messages(); len(messages) != 3 {
+		t.Errorf("invalid messages: expected one per DNS name but got %+v", messages)
+	}
+	broadcasters := s.Snapshot().Broadcasters
+	for _, name := range []string{"ingress/slack#0/app.example.com", "ingress/slack#0/www.example.com", "workers/slack#0"} {
+		if status, exists := broadcasters[name]; !exists || status.LastSuccess == nil {
+			t.Errorf("broadcast of %s not tracked: expected a success but got %+v", name, broadcasters)
+		}
+	}
+}
+
+func TestConfigSharedState(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	config := &Config{
+		State:        &StateConfig{Type: "memory"},
+		Publications: &PublicationsConfig{},
+		Broadcasters: []BroadcasterConfig{
+			{Type: "slack", Slack: &SlackConfig{WebhookURLs: []string{server.WebhookURL("ops")}, DNSName: "example.com"}},
+		},
+	}
+	set := newNotifierSetFromClient(fakekube.NewSimpleClientset(), time.Second)
+	rules, err := config.Mapping(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller, err := config.publicationController(fakedynamic.NewSimpleDynamicClient(runtime.NewScheme()), set, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rules[0].Broadcaster.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if _, saved, err := controller.store.Load(context.Background(), "slack#0"); err != nil || !saved {
+		t.Errorf("store not shared: expected the IPs of slack#0 saved but got %v, %v", saved, err)
+	}
+}
+
+func TestConfigCatchUp(t *testing.T) {
+	for _, state := range []*StateConfig{nil, {Type: "memory"}} {
+		config := &Config{
+			State: state,
+			Broadcasters: []BroadcasterConfig{
+				{Type: "slack", Slack: &SlackConfig{WebhookURLs: []string{"https://hooks.slack.com/services/T000/B000/XXX"}, DNSName: "example.com"}},
+				{Type: "cloudflare", Cloudflare: &CloudflareConfig{APIToken: "abc", DNSName: "example.com"}},
+			},
+		}
+		rules, err := config.Mapping(newNotifierSetFromClient(fakekube.NewSimpleClientset(), time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets := rules[0].Broadcaster.(multiBroadcaster)
+		if targets[0].NoCatchUp != (state == nil) || targets[1].NoCatchUp {
+			t.Errorf("invalid catch-up with state %+v: expected the slack one skipped without state but got %+v", state, targets)
+		}
+	}
+}
+
+func TestConfigWebhookURLs(t *testing.T) {
+	ok, okRequests := helperWebhook(http.StatusOK, 0)
+	defer ok.Close()
+	failing, failingRequests := helperWebhook(http.StatusServiceUnavailable, 0)
+	defer failing.Close()
+	config := &Config{
+		Broadcasters: []BroadcasterConfig{
+			{Type: "webhook", Webhook: &WebhookConfig{URLs: []string{ok.URL, failing.URL}, DNSName: "example.com"}},
+			{Type: "slack", Slack: &SlackConfig{WebhookURLs: []string{ok.URL, failing.URL}, DNSName: "example.com"}},
+		},
+	}
+	b, err := config.Broadcaster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	change := newChange(nil, []string{"1.2.3.4"}, nil)
+	report := DeliverChange(ctx, b, change)
+	if failed := report.Failed(); !helperEqual(failed, []string{"slack#1/url#1", "webhook#0/url#1"}) {
+		t.Fatalf("invalid failures: expected [slack#1/url#1 webhook#0/url#1] but got %v", failed)
+	}
+	RedeliverChange(ctx, b, change, report)
+	if len(okRequests()) != 2 || len(failingRequests()) != 4 {
+		t.Errorf("invalid redelivery: expected only the failed urls again but got %d and %d requests", len(okRequests()), len(failingRequests()))
+	}
+}
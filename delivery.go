@@ -0,0 +1,247 @@
+package ip8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NamedBroadcaster is a target of Deliver, named in its DeliveryReport.
+type NamedBroadcaster struct {
+	Name        string
+	Broadcaster Broadcaster
+	// NoCatchUp leaves the target out of the broadcast of the latest IPs by
+	// a new leader, for the notifications it would send again.
+	NoCatchUp bool
+}
+
+// Delivery is the outcome of the broadcast to a target.
+type Delivery struct {
+	Err      error
+	Duration time.Duration
+}
+
+// DeliveryReport maps the name of each target to its delivery.
+type DeliveryReport map[string]Delivery
+
+// DeliveryError is the failure of the broadcast to a target.
+type DeliveryError struct {
+	Target string
+	Err    error
+}
+
+func (e DeliveryError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Target, e.Err)
+}
+
+func (e DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Deliver broadcasts the change concurrently to the targets.
+func Deliver(ctx context.Context, change Change, targets ...NamedBroadcaster) DeliveryReport {
+	report := make(DeliveryReport, len(targets))
+	l := sync.Mutex{}
+	w := sync.WaitGroup{}
+	w.Add(len(targets))
+	for _, target := range targets {
+		go func(target NamedBroadcaster) {
+			defer w.Done()
+			start := time.Now()
+			err := BroadcastChange(ctx, target.Broadcaster, change)
+			l.Lock()
+			defer l.Unlock()
+			report[target.Name] = Delivery{Err: err, Duration: time.Since(start)}
+		}(target)
+	}
+	w.Wait()
+	return report
+}
+
+// Redeliver broadcasts the change again to the targets which failed in r,
+// and returns r updated with their new deliveries. The targets missing from
+// r are ignored.
+func (r DeliveryReport) Redeliver(ctx context.Context, change Change, targets ...NamedBroadcaster) DeliveryReport {
+	failed := make([]NamedBroadcaster, 0, len(targets))
+	for _, target := range targets {
+		if delivery, exists := r[target.Name]; exists && delivery.Err != nil {
+			failed = append(failed, target)
+		}
+	}
+	report := make(DeliveryReport, len(r))
+	for name, delivery := range r {
+		report[name] = delivery
+	}
+	for name, delivery := range Deliver(ctx, change, failed...) {
+		report[name] = delivery
+	}
+	return report
+}
+
+// Failed returns the sorted names of the failed targets.
+func (r DeliveryReport) Failed() []string {
+	failed := []string{}
+	for name, delivery := range r {
+		if delivery.Err != nil {
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// Err returns nil when all the targets succeeded, the DeliveryErrors of the
+// failed ones otherwise.
+func (r DeliveryReport) Err() error {
+	failed := r.Failed()
+	errs := make([]error, len(failed))
+	for i, name := range failed {
+		errs[i] = DeliveryError{Target: name, Err: r[name].Err}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errors.Wrap(errs[0], "one broadcast failed")
+	default:
+		return errors.Wrap(multiError(errs), "multiple errors occurred during broadcasting")
+	}
+}
+
+// Deliverer is implemented by the broadcasters fanning out to several
+// targets.
+type Deliverer interface {
+	Deliver(ctx context.Context, change Change) DeliveryReport
+	// Redeliver only broadcasts to the targets which failed in report.
+	Redeliver(ctx context.Context, change Change, report DeliveryReport) DeliveryReport
+}
+
+// DeliverChange delivers the change with b when it is a Deliverer, to b as
+// the single target "" otherwise.
+func DeliverChange(ctx context.Context, b Broadcaster, change Change) DeliveryReport {
+	if deliverer, ok := b.(Deliverer); ok {
+		return deliverer.Deliver(ctx, change)
+	}
+	return Deliver(ctx, change, NamedBroadcaster{Broadcaster: b})
+}
+
+// RedeliverChange delivers the change again with b to the targets which
+// failed in report, see DeliverChange.
+func RedeliverChange(ctx context.Context, b Broadcaster, change Change, report DeliveryReport) DeliveryReport {
+	if deliverer, ok := b.(Deliverer); ok {
+		return deliverer.Redeliver(ctx, change, report)
+	}
+	return report.Redeliver(ctx, change, NamedBroadcaster{Broadcaster: b})
+}
+
+// DeliveryOption configures DeliverEvents.
+type DeliveryOption func(*eventDelivery)
+
+type eventDelivery struct {
+	backoff    time.Duration
+	maxBackoff time.Duration
+	onEvent    func(Event)
+	onReport   func(Change, DeliveryReport, time.Duration)
+	catchUp    bool
+}
+
+// DeliveryBackoff redelivers the failed targets after backoff, doubled up
+// to maxBackoff (default: 10s up to 5m).
+func DeliveryBackoff(backoff, maxBackoff time.Duration) DeliveryOption {
+	return func(d *eventDelivery) {
+		d.backoff, d.maxBackoff = backoff, maxBackoff
+	}
+}
+
+// DeliveryEventHandler calls f with each event, before its change is
+// delivered.
+func DeliveryEventHandler(f func(Event)) DeliveryOption {
+	return func(d *eventDelivery) {
+		d.onEvent = f
+	}
+}
+
+// DeliveryReportHandler calls f after each delivery of the change, with the
+// delay before the failed targets are redelivered, 0 when none failed.
+func DeliveryReportHandler(f func(change Change, report DeliveryReport, retry time.Duration)) DeliveryOption {
+	return func(d *eventDelivery) {
+		d.onReport = f
+	}
+}
+
+// DeliveryCatchUp only delivers the IPs of the first change to the targets
+// a new leader catches up, for a restarted delivery not to send the
+// notifications again.
+func DeliveryCatchUp() DeliveryOption {
+	return func(d *eventDelivery) {
+		d.catchUp = true
+	}
+}
+
+// DeliverEvents delivers the changes of events with b until events is
+// closed or ctx is done. The failed targets are redelivered until they
+// succeed or the IPs change again. Nothing is delivered once ctx is done.
+func DeliverEvents(ctx context.Context, b Broadcaster, events <-chan Event, opts ...DeliveryOption) {
+	d := eventDelivery{
+		backoff:    10 * time.Second,
+		maxBackoff: 5 * time.Minute,
+		onEvent:    func(Event) {},
+		onReport:   func(Change, DeliveryReport, time.Duration) {},
+	}
+	for _, opt := range opts {
+		opt(&d)
+	}
+	// change is the last change delivered to target and report its delivery
+	var change Change
+	var target Broadcaster
+	var report DeliveryReport
+	backoff := d.backoff
+	redelivery := time.NewTimer(backoff)
+	redelivery.Stop()
+	defer redelivery.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok || ctx.Err() != nil {
+				return
+			}
+			d.onEvent(event)
+			if event.Err != nil || event.Recovered {
+				continue
+			}
+			// the newer change replaces the pending redelivery
+			if !redelivery.Stop() {
+				select {
+				case <-redelivery.C:
+				default:
+				}
+			}
+			change, target, backoff = event.Change, b, d.backoff
+			if d.catchUp {
+				change, target = Change{IPs: change.IPs, Nodes: change.Nodes}, caughtUp(b)
+				d.catchUp = false
+			}
+			report = DeliverChange(ctx, target, change)
+		case <-redelivery.C:
+			if ctx.Err() != nil {
+				return
+			}
+			report = RedeliverChange(ctx, target, change, report)
+			if backoff *= 2; backoff > d.maxBackoff {
+				backoff = d.maxBackoff
+			}
+		case <-ctx.Done():
+			return
+		}
+		var retry time.Duration
+		if report.Err() != nil {
+			retry = backoff
+			redelivery.Reset(retry)
+		}
+		d.onReport(change, report, retry)
+	}
+}
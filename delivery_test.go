@@ -0,0 +1,173 @@
+package ip8s
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+var errUnavailable = errors.New("unavailable")
+
+type statusError int
+
+func (e statusError) Error() string {
+	return "failed"
+}
+
+func (e statusError) HTTPStatusCode() int {
+	return int(e)
+}
+
+func TestDeliver(t *testing.T) {
+	ok, unavailable, forbidden := &recordingBroadcaster{}, &recordingBroadcaster{err: errors.Wrap(errUnavailable, "slack")}, &recordingBroadcaster{err: statusError(403)}
+	report := Deliver(context.Background(), Change{IPs: []string{"1.2.3.4"}},
+		NamedBroadcaster{Name: "slack#0", Broadcaster: unavailable},
+		NamedBroadcaster{Name: "webhook#1", Broadcaster: ok},
+		NamedBroadcaster{Name: "cloudflare#2", Broadcaster: forbidden},
+	)
+	if len(report) != 3 || report["webhook#1"].Err != nil {
+		t.Errorf("invalid report: expected 3 deliveries with webhook#1 succeeding but got %+v", report)
+	}
+	if failed := report.Failed(); !helperEqual(failed, []string{"cloudflare#2", "slack#0"}) {
+		t.Errorf("invalid failures: expected [cloudflare#2 slack#0] but got %v", failed)
+	}
+	err := report.Err()
+	if err == nil || !strings.Contains(err.Error(), "slack#0: slack: unavailable") {
+		t.Errorf("invalid error: expected the failure of slack#0 but got %v", err)
+	}
+	if !errors.Is(err, errUnavailable) {
+		t.Errorf("unavailable not found: expected errors.Is but got %v", err)
+	}
+	var withStatus interface{ HTTPStatusCode() int }
+	if !errors.As(err, &withStatus) || withStatus.HTTPStatusCode() != 403 {
+		t.Errorf("status not found: expected 403 but got %v", withStatus)
+	}
+	var delivery DeliveryError
+	if !errors.As(err, &delivery) || delivery.Target != "cloudflare#2" {
+		t.Errorf("invalid first failure: expected cloudflare#2 but got %+v", delivery)
+	}
+	if err := Deliver(context.Background(), Change{}, NamedBroadcaster{Name: "webhook#1", Broadcaster: ok}).Err(); err != nil {
+		t.Errorf("successful delivery failed: expected <nil> but got %v", err)
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	ctx := context.Background()
+	change := Change{IPs: []string{"1.2.3.4"}}
+	ok, flaky := &recordingBroadcaster{}, &recordingBroadcaster{err: errUnavailable}
+	b := NewNamedMultiBroadcaster(NamedBroadcaster{Name: "slack#0", Broadcaster: ok}, NamedBroadcaster{Name: "webhook#1", Broadcaster: flaky})
+	deliverer, isDeliverer := b.(Deliverer)
+	if !isDeliverer {
+		t.Fatalf("invalid broadcaster: expected a Deliverer but got %T", b)
+	}
+	report := deliverer.Deliver(ctx, change)
+	if failed := report.Failed(); !helperEqual(failed, []string{"webhook#1"}) {
+		t.Fatalf("invalid failures: expected [webhook#1] but got %v", failed)
+	}
+
+	flaky.err = nil
+	report = deliverer.Redeliver(ctx, change, report)
+	if err := report.Err(); err != nil || len(report) != 2 {
+		t.Errorf("redelivery failed: expected 2 successes but got %+v", report)
+	}
+	if len(ok.broadcasts) != 1 || len(flaky.broadcasts) != 2 {
+		t.Errorf("invalid redelivery: expected only webhook#1 again but got %d and %d broadcasts", len(ok.broadcasts), len(flaky.broadcasts))
+	}
+}
+
+func TestRedeliverChange(t *testing.T) {
+	ctx := context.Background()
+	change := Change{IPs: []string{"1.2.3.4"}}
+	flaky := &recordingBroadcaster{err: errUnavailable}
+	report := DeliverChange(ctx, flaky, change)
+	if failed := report.Failed(); !helperEqual(failed, []string{""}) {
+		t.Fatalf("invalid failures: expected the broadcaster itself but got %v", failed)
+	}
+	flaky.err = nil
+	report = RedeliverChange(ctx, flaky, change, report)
+	if err := report.Err(); err != nil || len(flaky.broadcasts) != 2 {
+		t.Errorf("redelivery failed: expected a second successful broadcast but got %+v after %d broadcasts", report, len(flaky.broadcasts))
+	}
+
+	// the followers leave the redelivery to the leader
+	e := helperLeaderElector(t, fakekube.NewSimpleClientset(), "follower")
+	flaky.err = errUnavailable
+	b := e.Broadcaster(NewNamedMultiBroadcaster(NamedBroadcaster{Name: "webhook#0", Broadcaster: flaky}))
+	if report := DeliverChange(ctx, b, change); len(report) != 0 {
+		t.Errorf("follower delivered: expected an empty report but got %+v", report)
+	}
+	if report := RedeliverChange(ctx, b, change, DeliveryReport{"webhook#0": {Err: errUnavailable}}); len(report) != 0 {
+		t.Errorf("follower redelivered: expected an empty report but got %+v", report)
+	}
+	if len(flaky.broadcasts) != 2 {
+		t.Errorf("follower broadcast: expected 2 broadcasts but got %d", len(flaky.broadcasts))
+	}
+}
+
+func TestDeliverEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ok, flaky := &recordingBroadcaster{}, &recordingBroadcaster{err: errUnavailable}
+	b := NewNamedMultiBroadcaster(NamedBroadcaster{Name: "slack#0", Broadcaster: ok}, NamedBroadcaster{Name: "webhook#1", Broadcaster: flaky})
+	events := make(chan Event, 3)
+	events <- Event{Err: errUnavailable}
+	events <- Event{Change: Change{IPs: []string{"1.2.3.4"}}}
+	received := 0
+	retries := []time.Duration{}
+	DeliverEvents(ctx, b, events,
+		DeliveryBackoff(10*time.Millisecond, 25*time.Millisecond),
+		DeliveryEventHandler(func(event Event) {
+			received++
+		}),
+		DeliveryReportHandler(func(change Change, report DeliveryReport, retry time.Duration) {
+			retries = append(retries, retry)
+			switch len(retries) {
+			case 3:
+				flaky.err = nil
+			case 4:
+				cancel()
+			}
+		}),
+	)
+	if received != 2 {
+		t.Errorf("invalid events: expected 2 but got %d", received)
+	}
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond, 0}
+	if len(retries) != len(expected) {
+		t.Fatalf("invalid deliveries: expected %v but got %v", expected, retries)
+	}
+	for i := range expected {
+		if retries[i] != expected[i] {
+			t.Errorf("invalid retry #%d: expected %s but got %s", i, expected[i], retries[i])
+		}
+	}
+	if len(ok.broadcasts) != 1 || len(flaky.broadcasts) != 4 {
+		t.Errorf("invalid redeliveries: expected only webhook#1 again but got %d and %d broadcasts", len(ok.broadcasts), len(flaky.broadcasts))
+	}
+}
+
+func TestDeliverEventsCatchUp(t *testing.T) {
+	dns, slack := &recordingBroadcaster{}, &recordingBroadcaster{}
+	b := NewNamedMultiBroadcaster(NamedBroadcaster{Name: "cloudflare#0", Broadcaster: dns}, NamedBroadcaster{Name: "slack#1", Broadcaster: slack, NoCatchUp: true})
+	events := make(chan Event, 2)
+	events <- Event{Change: Change{IPs: []string{"1.2.3.4"}, Added: []string{"1.2.3.4"}}}
+	events <- Event{Change: Change{IPs: []string{"1.2.3.4", "1.2.3.5"}, Added: []string{"1.2.3.5"}}}
+	close(events)
+	changes := []Change{}
+	DeliverEvents(context.Background(), b, events,
+		DeliveryCatchUp(),
+		DeliveryReportHandler(func(change Change, report DeliveryReport, retry time.Duration) {
+			changes = append(changes, change)
+		}),
+	)
+	if len(changes) != 2 || len(changes[0].Added) != 0 || !helperEqual(changes[1].Added, []string{"1.2.3.5"}) {
+		t.Errorf("invalid changes: expected the IPs then the added 1.2.3.5 but got %+v", changes)
+	}
+	if len(dns.broadcasts) != 2 || len(slack.broadcasts) != 1 {
+		t.Errorf("invalid catch-up: expected 2 and 1 broadcasts but got %d and %d", len(dns.broadcasts), len(slack.broadcasts))
+	}
+}
@@ -0,0 +1,374 @@
+package ip8s
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SMTPSecurity is the way the connection to the SMTP server is secured.
+type SMTPSecurity int
+
+const (
+	// StartTLS upgrades the connection, the server must support it.
+	StartTLS SMTPSecurity = iota
+	// ImplicitTLS connects over TLS (usually port 465).
+	ImplicitTLS
+	// NoTLS sends everything in clear text.
+	NoTLS
+)
+
+// SMTPAuthMechanism is the SASL mechanism used to authenticate.
+type SMTPAuthMechanism string
+
+const (
+	PlainAuth SMTPAuthMechanism = "PLAIN"
+	LoginAuth SMTPAuthMechanism = "LOGIN"
+)
+
+var defaultEmailSubject = `IPs for {{ .DNSName }} {{ if .IPs }}changed{{ else }}were deleted{{ end }}`
+
+var defaultEmailText = `IPs for {{ .DNSName }} {{ with .IPs }}changed:
+{{ range . }}
+- {{ . }}{{ end }}{{ else }}were deleted{{ end }}
+`
+
+var defaultEmailHTML = `<p>IPs for <b>{{ .DNSName }}</b> {{ with .IPs }}changed:</p>
+<ul>{{ range . }}
+<li><code>{{ . }}</code></li>{{ end }}
+</ul>{{ else }}were deleted</p>{{ end }}
+`
+
+type emailBroadcaster struct {
+	server    string
+	security  SMTPSecurity
+	tlsConfig *tls.Config
+	mechanism SMTPAuthMechanism
+	username  string
+	password  string
+	from      string
+	to        []string
+	dnsName   string
+
+	subjectTmpl string
+	textTmpl    string
+	htmlTmpl    string
+	subject     *template.Template
+	text        *template.Template
+	html        *htmltemplate.Template
+}
+
+type EmailOption func(*emailBroadcaster)
+
+// EmailSecurity secures the connection (default: StartTLS).
+func EmailSecurity(security SMTPSecurity) EmailOption {
+	return func(b *emailBroadcaster) {
+		b.security = security
+	}
+}
+
+// EmailTLSConfig customizes the TLS connections (CA, server name, ...).
+func EmailTLSConfig(config *tls.Config) EmailOption {
+	return func(b *emailBroadcaster) {
+		b.tlsConfig = config
+	}
+}
+
+func EmailAuth(mechanism SMTPAuthMechanism, username, password string) EmailOption {
+	return func(b *emailBroadcaster) {
+		b.mechanism = mechanism
+		b.username = username
+		b.password = password
+	}
+}
+
+// EmailTemplates replaces the default text/template of the subject, the
+// plain text and the HTML (html/template) bodies, empty ones are kept.
+// They are executed with the DNSName and the IPs.
+func EmailTemplates(subject, text, html string) EmailOption {
+	return func(b *emailBroadcaster) {
+		if subject != "" {
+			b.subjectTmpl = subject
+		}
+		if text != "" {
+			b.textTmpl = text
+		}
+		if html != "" {
+			b.htmlTmpl = html
+		}
+	}
+}
+
+// NewEmailBroadcaster sends the IPs by mail through the SMTP server
+// (host:port) to all the recipients.
+func NewEmailBroadcaster(server, from string, to []string, dnsName string, opts ...EmailOption) (Broadcaster, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, errors.Wrapf(err, "invalid smtp server %q", server)
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, errors.Wrapf(err, "invalid sender %q", from)
+	}
+	if len(to) == 0 {
+		return nil, errors.New("missing recipients")
+	}
+	for _, recipient := range to {
+		if _, err := mail.ParseAddress(recipient); err != nil {
+			return nil, errors.Wrapf(err, "invalid recipient %q", recipient)
+		}
+	}
+	if err := validateDNSName(dnsName); err != nil {
+		return nil, err
+	}
+	b := &emailBroadcaster{
+		server:      server,
+		from:        from,
+		to:          append([]string(nil), to...),
+		dnsName:     dnsName,
+		subjectTmpl: defaultEmailSubject,
+		textTmpl:    defaultEmailText,
+		htmlTmpl:    defaultEmailHTML,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	switch b.security {
+	case StartTLS, ImplicitTLS, NoTLS:
+	default:
+		return nil, errors.Errorf("unknown smtp security %d", b.security)
+	}
+	switch b.mechanism {
+	case "", PlainAuth, LoginAuth:
+	default:
+		return nil, errors.Errorf("unknown smtp auth mechanism %q", b.mechanism)
+	}
+	var err error
+	funcs := map[string]interface{}{"join": join}
+	if b.subject, err = template.New("subject").Funcs(funcs).Parse(b.subjectTmpl); err != nil {
+		return nil, errors.Wrap(err, "invalid subject template")
+	}
+	if b.text, err = template.New("text").Funcs(funcs).Parse(b.textTmpl); err != nil {
+		return nil, errors.Wrap(err, "invalid text template")
+	}
+	if b.html, err = htmltemplate.New("html").Funcs(funcs).Parse(b.htmlTmpl); err != nil {
+		return nil, errors.Wrap(err, "invalid html template")
+	}
+	return b, nil
+}
+
+func (b *emailBroadcaster) templateData(ips []string) map[string]interface{} {
+	return map[string]interface{}{
+		"DNSName": b.dnsName,
+		"IPs":     ips,
+	}
+}
+
+func writeQuotedPrintable(w *multipart.Writer, contentType, content string) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// buildMessage renders a multipart/alternative mail with a plain text and
+// an HTML version.
+func (b *emailBroadcaster) buildMessage(ips []string, date time.Time) ([]byte, error) {
+	data := b.templateData(ips)
+	subject, text, html := &strings.Builder{}, &strings.Builder{}, &strings.Builder{}
+	if err := b.subject.Execute(subject, data); err != nil {
+		return nil, errors.Wrap(err, "failed to render the subject")
+	}
+	if err := b.text.Execute(text, data); err != nil {
+		return nil, errors.Wrap(err, "failed to render the text body")
+	}
+	if err := b.html.Execute(html, data); err != nil {
+		return nil, errors.Wrap(err, "failed to render the html body")
+	}
+
+	msg := &bytes.Buffer{}
+	body := multipart.NewWriter(msg)
+	header := func(label, content string) {
+		msg.WriteString(label)
+		msg.WriteString(": ")
+		msg.WriteString(content)
+		msg.WriteString("\r\n")
+	}
+	header("From", b.from)
+	header("To", strings.Join(b.to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", body.Boundary()))
+	msg.WriteString("\r\n")
+	if err := writeQuotedPrintable(body, "text/plain", text.String()); err != nil {
+		return nil, errors.Wrap(err, "failed to quote the text content")
+	}
+	if err := writeQuotedPrintable(body, "text/html", html.String()); err != nil {
+		return nil, errors.Wrap(err, "failed to quote the html content")
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+type loginAuth struct {
+	host, username, password string
+}
+
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+func (a loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return string(LoginAuth), nil, nil
+}
+
+func (a loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, errors.Errorf("unexpected server challenge %q", fromServer)
+	}
+}
+
+func (b *emailBroadcaster) auth(host string) smtp.Auth {
+	switch b.mechanism {
+	case PlainAuth:
+		return smtp.PlainAuth("", b.username, b.password, host)
+	case LoginAuth:
+		return loginAuth{host, b.username, b.password}
+	default:
+		return nil
+	}
+}
+
+func (b *emailBroadcaster) tlsConfigFor(host string) *tls.Config {
+	config := &tls.Config{}
+	if b.tlsConfig != nil {
+		config = b.tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+func (b *emailBroadcaster) dial(ctx context.Context, host string) (*smtp.Client, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", b.server)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", b.server)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if b.security == ImplicitTLS {
+		conn = tls.Client(conn, b.tlsConfigFor(host))
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to greet %s", b.server)
+	}
+	return client, nil
+}
+
+func (b *emailBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	msg, err := b.buildMessage(ips, time.Now())
+	if err != nil {
+		return Permanent(err)
+	}
+	host, _, _ := net.SplitHostPort(b.server)
+	client, err := b.dial(ctx, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	// the connection is closed on cancellation to unblock the exchange
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	if b.security == StartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return Permanent(errors.Errorf("%s does not support STARTTLS", b.server))
+		}
+		if err := client.StartTLS(b.tlsConfigFor(host)); err != nil {
+			return errors.Wrap(err, "failed to start TLS")
+		}
+	}
+	if auth := b.auth(host); auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return errors.Wrap(err, "failed to authenticate")
+		}
+	}
+	from, _ := mail.ParseAddress(b.from)
+	if err := client.Mail(from.Address); err != nil {
+		return errors.Wrapf(err, "sender %s refused", b.from)
+	}
+	for _, recipient := range b.to {
+		to, _ := mail.ParseAddress(recipient)
+		if err := client.Rcpt(to.Address); err != nil {
+			return errors.Wrapf(err, "recipient %s refused", recipient)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return errors.Wrap(err, "failed to send mail")
+	}
+	if _, err := w.Write(msg); err != nil {
+		return errors.Wrap(err, "failed to send mail")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "failed to send mail")
+	}
+	return client.Quit()
+}
+
+func (b *emailBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	subject := &strings.Builder{}
+	if err := b.subject.Execute(subject, b.templateData(ips)); err != nil {
+		return nil, errors.Wrap(err, "failed to render the subject")
+	}
+	return Plan{{Kind: SendAction, Target: "email " + strings.Join(b.to, ", "), Value: strings.TrimSpace(subject.String())}}, nil
+}
@@ -0,0 +1,283 @@
+package ip8s
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type newEmailBroadcasterTestCase struct {
+	server string
+	from   string
+	to     []string
+	opts   []EmailOption
+	valid  bool
+}
+
+func TestNewEmailBroadcaster(t *testing.T) {
+	testCases := map[string]newEmailBroadcasterTestCase{
+		"Valid": {
+			server: "smtp.example.com:587",
+			from:   "ip8s <ip8s@example.com>",
+			to:     []string{"ops@example.com", "Dev <dev@example.com>"},
+			valid:  true,
+		},
+		"MissingPort": {
+			server: "smtp.example.com",
+			from:   "ip8s@example.com",
+			to:     []string{"ops@example.com"},
+			valid:  false,
+		},
+		"InvalidSender": {
+			server: "smtp.example.com:587",
+			from:   "ip8s",
+			to:     []string{"ops@example.com"},
+			valid:  false,
+		},
+		"MissingRecipients": {
+			server: "smtp.example.com:587",
+			from:   "ip8s@example.com",
+			valid:  false,
+		},
+		"InvalidRecipient": {
+			server: "smtp.example.com:587",
+			from:   "ip8s@example.com",
+			to:     []string{"ops@example.com", "dev"},
+			valid:  false,
+		},
+		"InvalidTemplate": {
+			server: "smtp.example.com:587",
+			from:   "ip8s@example.com",
+			to:     []string{"ops@example.com"},
+			opts:   []EmailOption{EmailTemplates("{{ .DNSName", "", "")},
+			valid:  false,
+		},
+		"UnknownMechanism": {
+			server: "smtp.example.com:587",
+			from:   "ip8s@example.com",
+			to:     []string{"ops@example.com"},
+			opts:   []EmailOption{EmailAuth("CRAM-MD5", "user", "secret")},
+			valid:  false,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewEmailBroadcaster(testCase.server, testCase.from, testCase.to, "example.com", testCase.opts...)
+			if testCase.valid && err != nil {
+				t.Errorf("broadcaster rejected: expected <nil> but got %v", err)
+			} else if !testCase.valid && err == nil {
+				t.Error("broadcaster accepted: expected an error but got <nil>")
+			}
+		})
+	}
+}
+
+// readMail returns the decoded subject and the plain text and HTML parts.
+func readMail(t *testing.T, data string) (string, string, string) {
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid mail: expected <nil> but got %v", err)
+	}
+	subject, err := (&mime.WordDecoder{}).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("invalid subject: expected <nil> but got %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("invalid content type: expected multipart/alternative but got %s (%v)", mediaType, err)
+	}
+	parts := map[string]string{}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(part)
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[contentType] = string(content)
+	}
+	return subject, parts["text/plain"], parts["text/html"]
+}
+
+type emailBroadcasterTestCase struct {
+	server   SMTPSecurity
+	security SMTPSecurity
+	auth     SMTPAuthMechanism
+	password string
+	success  bool
+	tls      bool
+}
+
+func TestEmailBroadcaster(t *testing.T) {
+	testCases := map[string]emailBroadcasterTestCase{
+		"StartTLSPlain": {
+			server:   StartTLS,
+			security: StartTLS,
+			auth:     PlainAuth,
+			password: "secret",
+			success:  true,
+			tls:      true,
+		},
+		"ImplicitTLSLogin": {
+			server:   ImplicitTLS,
+			security: ImplicitTLS,
+			auth:     LoginAuth,
+			password: "secret",
+			success:  true,
+			tls:      true,
+		},
+		"ClearText": {
+			server:   NoTLS,
+			security: NoTLS,
+			success:  true,
+			tls:      false,
+		},
+		"StartTLSUnsupported": {
+			server:   NoTLS,
+			security: StartTLS,
+			success:  false,
+		},
+		"WrongPassword": {
+			server:   StartTLS,
+			security: StartTLS,
+			auth:     LoginAuth,
+			password: "guess",
+			success:  false,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server, config := helperSMTP(t, testCase.server)
+			defer server.Close()
+			opts := []EmailOption{EmailSecurity(testCase.security), EmailTLSConfig(config)}
+			if testCase.auth != "" {
+				opts = append(opts, EmailAuth(testCase.auth, "user", testCase.password))
+			}
+			to := []string{"ops@example.com", "Dev <dev@example.com>"}
+			b, err := NewEmailBroadcaster(server.Addr(), "ip8s@example.com", to, "example.com", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Broadcast(context.Background(), []string{"1.2.3.4", "2001:db8::1"})
+			mails := server.Mails()
+			if !testCase.success {
+				if err == nil {
+					t.Error("mail sent: expected an error but got <nil>")
+				}
+				if len(mails) != 0 {
+					t.Errorf("mail delivered: expected no mail but got %d", len(mails))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mail not sent: expected <nil> but got %v", err)
+			}
+			if len(mails) != 1 {
+				t.Fatalf("invalid mails: expected 1 mail but got %d", len(mails))
+			}
+			sent := mails[0]
+			if sent.From != "ip8s@example.com" {
+				t.Errorf("invalid sender: expected ip8s@example.com but got %s", sent.From)
+			}
+			if expected := []string{"ops@example.com", "dev@example.com"}; !reflect.DeepEqual(sent.To, expected) {
+				t.Errorf("invalid recipients: expected %v but got %v", expected, sent.To)
+			}
+			if sent.TLS != testCase.tls {
+				t.Errorf("invalid encryption: expected %v but got %v", testCase.tls, sent.TLS)
+			}
+			if sent.Auth != string(testCase.auth) {
+				t.Errorf("invalid authentication: expected '%s' but got '%s'", testCase.auth, sent.Auth)
+			}
+			subject, text, html := readMail(t, sent.Data)
+			if subject != "IPs for example.com changed" {
+				t.Errorf("invalid subject: expected 'IPs for example.com changed' but got '%s'", subject)
+			}
+			if !strings.Contains(text, "- 1.2.3.4\n- 2001:db8::1\n") {
+				t.Errorf("invalid text: expected the IPs but got %q", text)
+			}
+			if !strings.Contains(html, "<li><code>2001:db8::1</code></li>") {
+				t.Errorf("invalid html: expected the IPs but got %q", html)
+			}
+		})
+	}
+}
+
+func TestEmailBroadcasterTemplates(t *testing.T) {
+	server, _ := helperSMTP(t, NoTLS)
+	defer server.Close()
+	b, err := NewEmailBroadcaster(server.Addr(), "ip8s@example.com", []string{"ops@example.com"}, "example.com",
+		EmailSecurity(NoTLS),
+		EmailTemplates(
+			"Nœuds de {{ .DNSName }}: {{ len .IPs }}",
+			"{{ join \", \" .IPs }}",
+			"<p>{{ .DNSName }}</p><script>var ips = {{ .IPs }};</script>",
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4", "5.6.7.8"}); err != nil {
+		t.Fatalf("mail not sent: expected <nil> but got %v", err)
+	}
+	mails := server.Mails()
+	if len(mails) != 1 {
+		t.Fatalf("invalid mails: expected 1 mail but got %d", len(mails))
+	}
+	subject, text, html := readMail(t, mails[0].Data)
+	if subject != "Nœuds de example.com: 2" {
+		t.Errorf("invalid subject: expected 'Nœuds de example.com: 2' but got '%s'", subject)
+	}
+	if text != "1.2.3.4, 5.6.7.8" {
+		t.Errorf("invalid text: expected '1.2.3.4, 5.6.7.8' but got '%s'", text)
+	}
+	if expected := `<script>var ips = ["1.2.3.4","5.6.7.8"];</script>`; !strings.Contains(html, expected) {
+		t.Errorf("html not escaped: expected '%s' but got '%s'", expected, html)
+	}
+}
+
+func TestEmailBroadcasterFailures(t *testing.T) {
+	server, _ := helperSMTP(t, NoTLS)
+	defer server.Close()
+	server.RejectRecipient("dev@example.com")
+	b, err := NewEmailBroadcaster(server.Addr(), "ip8s@example.com", []string{"ops@example.com", "dev@example.com"}, "example.com",
+		EmailSecurity(NoTLS),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err == nil || !strings.Contains(err.Error(), "dev@example.com") {
+		t.Errorf("recipient accepted: expected an error about dev@example.com but got %v", err)
+	}
+	if mails := server.Mails(); len(mails) != 0 {
+		t.Errorf("mail delivered: expected no mail but got %d", len(mails))
+	}
+
+	server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.Broadcast(ctx, []string{"1.2.3.4"}); err == nil || !IsRetryable(err) {
+		t.Errorf("server down: expected a retryable error but got %v", err)
+	}
+}
+
+func TestEmailBroadcasterStartTLSRequired(t *testing.T) {
+	server, _ := helperSMTP(t, NoTLS)
+	defer server.Close()
+	b, err := NewEmailBroadcaster(server.Addr(), "ip8s@example.com", []string{"ops@example.com"}, "example.com",
+		EmailTLSConfig(&tls.Config{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err == nil || IsRetryable(err) {
+		t.Errorf("plain text connection: expected a permanent error but got %v", err)
+	}
+}
@@ -1,12 +1,17 @@
 module github.com/max4t/ip8s
 
-go 1.13
+go 1.15
 
 require (
+	github.com/aws/aws-sdk-go v1.25.43
 	github.com/cloudflare/cloudflare-go v0.11.0
+	github.com/miekg/dns v1.1.25
 	github.com/nlopes/slack v0.6.0
-	github.com/pkg/errors v0.9.0
-	k8s.io/api v0.17.0
-	k8s.io/apimachinery v0.17.0
-	k8s.io/client-go v0.17.0
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.2.1
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
+	k8s.io/api v0.19.16
+	k8s.io/apimachinery v0.19.16
+	k8s.io/client-go v0.19.16
+	sigs.k8s.io/yaml v1.2.0
 )
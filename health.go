@@ -0,0 +1,230 @@
+package ip8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BroadcasterStatus is the outcome of the last broadcast of a broadcaster.
+type BroadcasterStatus struct {
+	LastAttempt time.Time  `json:"lastAttempt"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// RuleStatus is the last IP set of a rule.
+type RuleStatus struct {
+	IPs       []string   `json:"ips"`
+	ChangedAt *time.Time `json:"changedAt,omitempty"`
+	// Error is the last failure to compute the IPs, cleared by the next set.
+	Error string `json:"error,omitempty"`
+}
+
+// StatusSnapshot is the state served on /state. The IPs of the rules
+// other than the default one are under Rules.
+type StatusSnapshot struct {
+	Synced bool `json:"synced"`
+	RuleStatus
+	Rules        map[string]RuleStatus        `json:"rules,omitempty"`
+	Broadcasters map[string]BroadcasterStatus `json:"broadcasters"`
+}
+
+// Status tracks the notifier and the broadcasters for the health endpoints.
+type Status struct {
+	l            sync.Mutex
+	synced       func() bool
+	rules        map[string]ruleState
+	broadcasters map[string]BroadcasterStatus
+	now          func() time.Time
+}
+
+type ruleState struct {
+	ips       []string
+	changedAt *time.Time
+	err       error
+}
+
+func (r ruleState) status() RuleStatus {
+	status := RuleStatus{IPs: r.ips, ChangedAt: r.changedAt}
+	if status.IPs == nil {
+		status.IPs = []string{}
+	}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	return status
+}
+
+func NewStatus() *Status {
+	return &Status{
+		rules:        map[string]ruleState{},
+		broadcasters: map[string]BroadcasterStatus{},
+		now:          time.Now,
+	}
+}
+
+// Notifier makes the readiness wait for the nodes of n, a Notifier or a
+// NotifierSet, to be synced.
+func (s *Status) Notifier(n interface{ HasSynced() bool }) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.synced = n.HasSynced
+}
+
+// Event records the last set of IPs or the error preventing to compute it.
+func (s *Status) Event(event Event) {
+	s.RuleEvent("", event)
+}
+
+// RuleEvent records the events of the notifier of a rule, "" being the
+// default one.
+func (s *Status) RuleEvent(rule string, event Event) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	state := s.rules[rule]
+	if event.Err != nil || event.Recovered {
+		// the IPs did not change when recovered
+		state.err = event.Err
+		s.rules[rule] = state
+		return
+	}
+	now := s.now()
+	s.rules[rule] = ruleState{ips: event.IPs, changedAt: &now}
+}
+
+func (s *Status) broadcast(name string, err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	status := s.broadcasters[name]
+	status.LastAttempt = s.now()
+	status.Error = ""
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		success := status.LastAttempt
+		status.LastSuccess = &success
+	}
+	s.broadcasters[name] = status
+}
+
+// forget forgets the broadcasters named with prefix.
+func (s *Status) forget(prefix string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for name := range s.broadcasters {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.broadcasters, name)
+		}
+	}
+}
+
+func (s *Status) Snapshot() StatusSnapshot {
+	s.l.Lock()
+	defer s.l.Unlock()
+	snapshot := StatusSnapshot{
+		Synced:       s.synced != nil && s.synced(),
+		RuleStatus:   s.rules[""].status(),
+		Broadcasters: map[string]BroadcasterStatus{},
+	}
+	for rule, state := range s.rules {
+		if rule == "" {
+			continue
+		}
+		if snapshot.Rules == nil {
+			snapshot.Rules = map[string]RuleStatus{}
+		}
+		snapshot.Rules[rule] = state.status()
+	}
+	for name, status := range s.broadcasters {
+		snapshot.Broadcasters[name] = status
+	}
+	return snapshot
+}
+
+// Ready returns why ip8s is not ready: nodes not synced yet, failure to
+// compute the IPs or to broadcast them. It is nil when ready.
+func (s *Status) Ready() []string {
+	snapshot := s.Snapshot()
+	var reasons []string
+	if !snapshot.Synced {
+		reasons = append(reasons, "nodes not synced")
+	}
+	if snapshot.Error != "" {
+		reasons = append(reasons, "failed to list the node IPs: "+snapshot.Error)
+	}
+	for rule, status := range snapshot.Rules {
+		if status.Error != "" {
+			reasons = append(reasons, fmt.Sprintf("rule %s failed to list the node IPs: %s", rule, status.Error))
+		}
+	}
+	for name, status := range snapshot.Broadcasters {
+		if status.Error != "" {
+			reasons = append(reasons, fmt.Sprintf("broadcaster %s failed: %s", name, status.Error))
+		}
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// Handler serves /healthz (always ok while serving), /readyz and /state.
+func (s *Status) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		reasons := s.Ready()
+		if len(reasons) == 0 {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, reason := range reasons {
+			fmt.Fprintln(w, reason)
+		}
+	})
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Snapshot())
+	})
+	return mux
+}
+
+type statusBroadcaster struct {
+	broadcaster Broadcaster
+	name        string
+	status      *Status
+}
+
+// NewStatusBroadcaster records the outcome of the broadcasts of b under the
+// name. It should wrap the retry broadcaster to only record the final
+// outcome of each broadcast.
+func NewStatusBroadcaster(b Broadcaster, name string, s *Status) Broadcaster {
+	return statusBroadcaster{b, name, s}
+}
+
+func (b statusBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	err := b.broadcaster.Broadcast(ctx, ips)
+	b.status.broadcast(b.name, err)
+	return err
+}
+
+func (b statusBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	err := BroadcastChange(ctx, b.broadcaster, change)
+	b.status.broadcast(b.name, err)
+	return err
+}
+
+func (b statusBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	return PlanBroadcast(ctx, b.broadcaster, ips)
+}
+
+func (b statusBroadcaster) PlanChange(ctx context.Context, change Change) (Plan, error) {
+	return PlanBroadcastChange(ctx, b.broadcaster, change)
+}
@@ -0,0 +1,164 @@
+package ip8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+type syncedNotifier struct {
+	Notifier
+	synced bool
+}
+
+func (n *syncedNotifier) HasSynced() bool {
+	return n.synced
+}
+
+func helperGet(t *testing.T, handler http.Handler, path string) (int, string) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w.Code, w.Body.String()
+}
+
+type readinessStep struct {
+	apply  func(s *Status, n *syncedNotifier, b *recordingBroadcaster)
+	status int
+	reason string
+}
+
+func TestStatusReadiness(t *testing.T) {
+	s := NewStatus()
+	n := &syncedNotifier{}
+	s.Notifier(n)
+	recorder := &recordingBroadcaster{}
+	b := NewStatusBroadcaster(recorder, "webhook#0", s)
+	handler := s.Handler()
+	broadcast := func(err error) func(*Status, *syncedNotifier, *recordingBroadcaster) {
+		return func(s *Status, n *syncedNotifier, r *recordingBroadcaster) {
+			r.err = err
+			b.Broadcast(context.Background(), []string{"1.2.3.4"})
+		}
+	}
+	steps := []readinessStep{
+		{apply: func(*Status, *syncedNotifier, *recordingBroadcaster) {}, status: http.StatusServiceUnavailable, reason: "nodes not synced"},
+		{apply: func(s *Status, n *syncedNotifier, r *recordingBroadcaster) { n.synced = true }, status: http.StatusOK},
+		{apply: func(s *Status, n *syncedNotifier, r *recordingBroadcaster) {
+			s.Event(Event{Err: errors.New("forbidden")})
+		}, status: http.StatusServiceUnavailable, reason: "failed to list the node IPs: forbidden"},
+		{apply: func(s *Status, n *syncedNotifier, r *recordingBroadcaster) {
+			s.Event(Event{Change: Change{IPs: []string{"1.2.3.4"}}})
+		}, status: http.StatusOK},
+		{apply: func(s *Status, n *syncedNotifier, r *recordingBroadcaster) {
+			s.Event(Event{Err: errors.New("forbidden")})
+		}, status: http.StatusServiceUnavailable, reason: "failed to list the node IPs: forbidden"},
+		{apply: func(s *Status, n *syncedNotifier, r *recordingBroadcaster) {
+			s.Event(Event{Change: Change{IPs: []string{"1.2.3.4"}, Previous: []string{"1.2.3.4"}}, Recovered: true})
+		}, status: http.StatusOK},
+		{apply: broadcast(errors.New("HTTP status 500")), status: http.StatusServiceUnavailable, reason: "broadcaster webhook#0 failed: HTTP status 500"},
+		{apply: broadcast(nil), status: http.StatusOK},
+	}
+	for i, step := range steps {
+		step.apply(s, n, recorder)
+		code, body := helperGet(t, handler, "/readyz")
+		if code != step.status || !strings.Contains(body, step.reason) {
+			t.Errorf("invalid readiness at step %d: expected %d %q but got %d %q", i, step.status, step.reason, code, body)
+		}
+		if code, _ := helperGet(t, handler, "/healthz"); code != http.StatusOK {
+			t.Errorf("invalid liveness at step %d: expected 200 but got %d", i, code)
+		}
+	}
+}
+
+func TestStatusState(t *testing.T) {
+	s := NewStatus()
+	s.now = func() time.Time { return time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC) }
+	s.Notifier(&syncedNotifier{synced: true})
+	s.Event(Event{Change: Change{IPs: []string{"1.2.3.4", "1.2.3.5"}}})
+	NewStatusBroadcaster(&recordingBroadcaster{err: errors.New("no_service")}, "slack#1", s).Broadcast(context.Background(), nil)
+	NewStatusBroadcaster(&recordingBroadcaster{}, "cloudflare#0", s).Broadcast(context.Background(), nil)
+	code, body := helperGet(t, s.Handler(), "/state")
+	if code != http.StatusOK {
+		t.Fatalf("invalid status: expected 200 but got %d", code)
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &state); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"synced":    true,
+		"ips":       []interface{}{"1.2.3.4", "1.2.3.5"},
+		"changedAt": "2019-12-01T10:00:00Z",
+		"broadcasters": map[string]interface{}{
+			"cloudflare#0": map[string]interface{}{"lastAttempt": "2019-12-01T10:00:00Z", "lastSuccess": "2019-12-01T10:00:00Z"},
+			"slack#1":      map[string]interface{}{"lastAttempt": "2019-12-01T10:00:00Z", "error": "no_service"},
+		},
+	}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("invalid state: expected %v but got %v", expected, state)
+	}
+}
+
+func TestStatusRules(t *testing.T) {
+	s := NewStatus()
+	s.Notifier(&syncedNotifier{synced: true})
+	s.RuleEvent("ingress", Event{Change: Change{IPs: []string{"1.2.3.4"}}})
+	s.RuleEvent("workers", Event{Err: errors.New("forbidden")})
+	snapshot := s.Snapshot()
+	if len(snapshot.IPs) != 0 || !helperEqual(snapshot.Rules["ingress"].IPs, []string{"1.2.3.4"}) {
+		t.Errorf("invalid IPs: expected [1.2.3.4] for ingress only but got %+v", snapshot)
+	}
+	expected := []string{"rule workers failed to list the node IPs: forbidden"}
+	if reasons := s.Ready(); !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("invalid readiness: expected %v but got %v", expected, reasons)
+	}
+}
+
+func TestNotifierHasSynced(t *testing.T) {
+	client := fakekube.NewSimpleClientset(healthyNode1.Build("node1"))
+	notifier, err := newNotifierFromClient(client, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notifier.HasSynced() {
+		t.Error("synced before notifying: expected false but got true")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	<-notifier.NotifyWithErrors(ctx)
+	if !notifier.HasSynced() {
+		t.Error("not synced after the first set: expected true but got false")
+	}
+}
+
+func TestConfigTrack(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	s := NewStatus()
+	config := &Config{Broadcasters: []BroadcasterConfig{
+		{Type: "slack", Slack: &SlackConfig{WebhookURLs: []string{server.WebhookURL("ops")}, DNSName: "example.com"}},
+		{Type: "slack", Slack: &SlackConfig{WebhookURLs: []string{server.WebhookURL("dev")}, DNSName: "example.com"}},
+	}}
+	config.Track(s)
+	b, err := config.Broadcaster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	broadcasters := s.Snapshot().Broadcasters
+	for _, name := range []string{"slack#0", "slack#1"} {
+		if status, exists := broadcasters[name]; !exists || status.LastSuccess == nil {
+			t.Errorf("broadcast of %s not tracked: expected a success but got %+v", name, broadcasters)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 )
 
 type nodeBuilder struct {
+	labels     map[string]string
 	conditions []v1.NodeCondition
 	addresses  []v1.NodeAddress
 }
@@ -19,6 +20,14 @@ func buildNode() *nodeBuilder {
 	return &nodeBuilder{}
 }
 
+func (b *nodeBuilder) Label(key, value string) *nodeBuilder {
+	if b.labels == nil {
+		b.labels = map[string]string{}
+	}
+	b.labels[key] = value
+	return b
+}
+
 func (b *nodeBuilder) Condition(typ v1.NodeConditionType, status v1.ConditionStatus) *nodeBuilder {
 	b.conditions = append(b.conditions, v1.NodeCondition{
 		Type:   typ,
@@ -42,7 +51,8 @@ func (b *nodeBuilder) Build(name string) *v1.Node {
 			Kind:       "Node",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
+			Name:   name,
+			Labels: b.labels,
 		},
 		Status: v1.NodeStatus{
 			Conditions: b.conditions,
@@ -0,0 +1,233 @@
+package ip8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// fakeCloudflare is an in-memory stand-in for the subset of the Cloudflare
+// API used by the broadcaster.
+type fakeCloudflare struct {
+	l        sync.Mutex
+	zones    map[string]string
+	records  map[string]cloudflareRecord
+	nextID   int
+	failures map[string]int
+	requests []string
+	server   *httptest.Server
+}
+
+func helperCloudflare(t *testing.T, zones ...string) (*fakeCloudflare, *cloudflare.API) {
+	f := &fakeCloudflare{
+		zones:    map[string]string{},
+		records:  map[string]cloudflareRecord{},
+		failures: map[string]int{},
+	}
+	for _, zone := range zones {
+		f.zones[zone] = "zone-" + zone
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	api, err := cloudflare.NewWithAPIToken("token",
+		cloudflare.UsingRateLimit(1000),
+		cloudflare.UsingRetryPolicy(0, 0, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.BaseURL = f.server.URL
+	return f, api
+}
+
+func (f *fakeCloudflare) Close() {
+	f.server.Close()
+}
+
+func (f *fakeCloudflare) AddRecord(typ, name, content string) string {
+	f.l.Lock()
+	defer f.l.Unlock()
+	zoneID := ""
+	for zone, id := range f.zones {
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			zoneID = id
+		}
+	}
+	return f.add(cloudflareRecord{Type: typ, Name: name, Content: content, ZoneID: zoneID})
+}
+
+// Fail makes the requests matching "METHOD content" answer with the given
+// status.
+func (f *fakeCloudflare) Fail(request string, status int) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.failures[request] = status
+}
+
+// Update changes a record as an operator would from the dashboard.
+func (f *fakeCloudflare) Update(id string, update func(*cloudflareRecord)) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	record := f.records[id]
+	update(&record)
+	f.records[id] = record
+}
+
+func (f *fakeCloudflare) Records(name string) []cloudflareRecord {
+	f.l.Lock()
+	defer f.l.Unlock()
+	var records []cloudflareRecord
+	for _, record := range f.records {
+		if record.Name == name {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Content < records[j].Content
+	})
+	return records
+}
+
+func (f *fakeCloudflare) Contents(name string) []string {
+	contents := []string{}
+	for _, record := range f.Records(name) {
+		contents = append(contents, record.Type+" "+record.Content)
+	}
+	return contents
+}
+
+func (f *fakeCloudflare) Requests() []string {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeCloudflare) add(record cloudflareRecord) string {
+	f.nextID++
+	record.ID = fmt.Sprintf("record-%d", f.nextID)
+	if record.TTL == 0 {
+		record.TTL = 1
+	}
+	if record.Proxied == nil {
+		proxied := false
+		record.Proxied = &proxied
+	}
+	f.records[record.ID] = record
+	return record.ID
+}
+
+func (f *fakeCloudflare) reply(w http.ResponseWriter, status int, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     status < 300,
+		"errors":      []interface{}{},
+		"messages":    []interface{}{},
+		"result":      result,
+		"result_info": map[string]int{"page": 1, "per_page": 100, "total_pages": 1},
+	})
+}
+
+func (f *fakeCloudflare) failure(w http.ResponseWriter, request string) bool {
+	status, exists := f.failures[request]
+	if exists {
+		f.reply(w, status, nil)
+	}
+	return exists
+}
+
+func (f *fakeCloudflare) serve(w http.ResponseWriter, r *http.Request) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	switch {
+	case len(path) == 1 && path[0] == "zones" && r.Method == http.MethodGet:
+		f.requests = append(f.requests, "GET zones "+query.Get("name"))
+		zones := []cloudflare.Zone{}
+		if id, exists := f.zones[query.Get("name")]; exists {
+			zones = append(zones, cloudflare.Zone{ID: id, Name: query.Get("name")})
+		}
+		f.reply(w, http.StatusOK, zones)
+	case len(path) == 3 && path[2] == "dns_records" && r.Method == http.MethodGet:
+		f.requests = append(f.requests, "GET "+query.Get("type")+" "+query.Get("name"))
+		records := []cloudflareRecord{}
+		if page := query.Get("page"); page != "" && page != "1" {
+			f.reply(w, http.StatusOK, records)
+			return
+		}
+		for _, record := range f.records {
+			if record.ZoneID == path[1] && record.Name == query.Get("name") &&
+				(query.Get("type") == "" || record.Type == query.Get("type")) {
+				records = append(records, record)
+			}
+		}
+		f.reply(w, http.StatusOK, records)
+	case len(path) == 3 && path[2] == "dns_records" && r.Method == http.MethodPost:
+		record := cloudflareRecord{}
+		json.NewDecoder(r.Body).Decode(&record)
+		f.requests = append(f.requests, "POST "+record.Type+" "+record.Content)
+		if f.failure(w, "POST "+record.Content) {
+			return
+		}
+		record.ZoneID = path[1]
+		id := f.add(record)
+		f.reply(w, http.StatusOK, f.records[id])
+	case len(path) == 4 && r.Method == http.MethodGet:
+		record, exists := f.records[path[3]]
+		if !exists {
+			f.reply(w, http.StatusNotFound, nil)
+			return
+		}
+		f.reply(w, http.StatusOK, record)
+	case len(path) == 4 && r.Method == http.MethodPatch:
+		update := cloudflareRecord{}
+		json.NewDecoder(r.Body).Decode(&update)
+		f.requests = append(f.requests, "PATCH "+update.Type+" "+update.Content)
+		record, exists := f.records[path[3]]
+		if !exists {
+			f.reply(w, http.StatusNotFound, nil)
+			return
+		}
+		if f.failure(w, "PATCH "+update.Content) {
+			return
+		}
+		if update.Content != "" {
+			record.Content = update.Content
+		}
+		if update.TTL != 0 {
+			record.TTL = update.TTL
+		}
+		if update.Proxied != nil {
+			record.Proxied = update.Proxied
+		}
+		if update.Comment != "" {
+			record.Comment = update.Comment
+		}
+		if update.Tags != nil {
+			record.Tags = update.Tags
+		}
+		f.records[record.ID] = record
+		f.reply(w, http.StatusOK, record)
+	case len(path) == 4 && r.Method == http.MethodDelete:
+		record, exists := f.records[path[3]]
+		f.requests = append(f.requests, "DELETE "+record.Type+" "+record.Content)
+		if !exists {
+			f.reply(w, http.StatusNotFound, nil)
+			return
+		}
+		if f.failure(w, "DELETE "+record.Content) {
+			return
+		}
+		delete(f.records, record.ID)
+		f.reply(w, http.StatusOK, map[string]string{"id": record.ID})
+	default:
+		f.reply(w, http.StatusNotFound, nil)
+	}
+}
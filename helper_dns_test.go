@@ -0,0 +1,201 @@
+package ip8s
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeDNS is an in-process authoritative server of a single zone handling
+// queries and RFC 2136 updates, signed with TSIG when a secret is set.
+type fakeDNS struct {
+	l       sync.Mutex
+	zone    string
+	keyName string
+	secret  string
+	records map[string][]string
+	updates int
+	// race is called once before the next update is applied, as another
+	// writer would.
+	race   func()
+	server *dns.Server
+}
+
+func helperDNS(t *testing.T, network, zone, keyName, secret string) *fakeDNS {
+	f := &fakeDNS{
+		zone:    dns.Fqdn(zone),
+		keyName: dns.Fqdn(keyName),
+		secret:  secret,
+		records: map[string][]string{},
+	}
+	started := make(chan struct{})
+	f.server = &dns.Server{
+		Net:               network,
+		Handler:           dns.HandlerFunc(f.serve),
+		NotifyStartedFunc: func() { close(started) },
+		// the default one rejects the updates
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	if secret != "" {
+		f.server.TsigSecret = map[string]string{f.keyName: secret}
+	}
+	if network == "tcp" {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.server.Listener = listener
+	} else {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.server.PacketConn = conn
+	}
+	go f.server.ActivateAndServe()
+	<-started
+	return f
+}
+
+func (f *fakeDNS) Addr() string {
+	if f.server.Listener != nil {
+		return f.server.Listener.Addr().String()
+	}
+	return f.server.PacketConn.LocalAddr().String()
+}
+
+func (f *fakeDNS) Close() {
+	f.server.Shutdown()
+}
+
+// Set replaces the records of a type, e.g. Set("app.example.com", "A", ...).
+func (f *fakeDNS) Set(name, typ string, ips ...string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.records[dns.Fqdn(name)+" "+typ] = ips
+}
+
+// Records returns the records of a name as "A 1.2.3.4" strings.
+func (f *fakeDNS) Records(name string) []string {
+	f.l.Lock()
+	defer f.l.Unlock()
+	records := []string{}
+	for key, ips := range f.records {
+		if strings.HasPrefix(key, dns.Fqdn(name)+" ") {
+			for _, ip := range ips {
+				records = append(records, strings.TrimPrefix(key, dns.Fqdn(name)+" ")+" "+ip)
+			}
+		}
+	}
+	sort.Strings(records)
+	return records
+}
+
+func (f *fakeDNS) Updates() int {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.updates
+}
+
+func (f *fakeDNS) Race(race func()) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.race = race
+}
+
+func (f *fakeDNS) reply(w dns.ResponseWriter, r *dns.Msg, rcode int, answer []dns.RR) {
+	m := &dns.Msg{}
+	m.SetRcode(r, rcode)
+	m.Authoritative = true
+	m.Answer = answer
+	if t := r.IsTsig(); t != nil && rcode != dns.RcodeNotAuth {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+func rrIP(rr dns.RR) string {
+	return normalizeAddress(rrValue(rr))
+}
+
+func (f *fakeDNS) serve(w dns.ResponseWriter, r *dns.Msg) {
+	if f.secret != "" && (r.IsTsig() == nil || w.TsigStatus() != nil) {
+		f.reply(w, r, dns.RcodeNotAuth, nil)
+		return
+	}
+	if r.Opcode == dns.OpcodeUpdate {
+		f.l.Lock()
+		race := f.race
+		f.race = nil
+		f.l.Unlock()
+		if race != nil {
+			race()
+		}
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	question := r.Question[0]
+	if r.Opcode == dns.OpcodeQuery {
+		var answer []dns.RR
+		exists := false
+		for key, ips := range f.records {
+			exists = exists || (strings.HasPrefix(key, question.Name+" ") && len(ips) != 0)
+		}
+		typ := dns.TypeToString[question.Qtype]
+		for _, ip := range f.records[question.Name+" "+typ] {
+			rr, _ := dns.NewRR(question.Name + " 300 IN " + typ + " " + ip)
+			answer = append(answer, rr)
+		}
+		rcode := dns.RcodeSuccess
+		if !exists {
+			rcode = dns.RcodeNameError
+		}
+		f.reply(w, r, rcode, answer)
+		return
+	}
+	if question.Name != f.zone {
+		f.reply(w, r, dns.RcodeNotZone, nil)
+		return
+	}
+	// prerequisites, the value dependent ones are grouped by RRset
+	used := map[string][]string{}
+	for _, rr := range r.Answer {
+		key := rr.Header().Name + " " + dns.TypeToString[rr.Header().Rrtype]
+		switch rr.Header().Class {
+		case dns.ClassNONE:
+			if len(f.records[key]) != 0 {
+				f.reply(w, r, dns.RcodeYXRrset, nil)
+				return
+			}
+		case dns.ClassINET:
+			used[key] = append(used[key], rrIP(rr))
+		}
+	}
+	for key, ips := range used {
+		sort.Strings(ips)
+		current := append([]string(nil), f.records[key]...)
+		sort.Strings(current)
+		if diff(ips, current) {
+			f.reply(w, r, dns.RcodeNXRrset, nil)
+			return
+		}
+	}
+	for _, rr := range r.Ns {
+		key := rr.Header().Name + " " + dns.TypeToString[rr.Header().Rrtype]
+		switch rr.Header().Class {
+		case dns.ClassANY:
+			delete(f.records, key)
+		case dns.ClassNONE:
+			f.records[key] = difference(f.records[key], []string{rrIP(rr)})
+		default:
+			f.records[key] = append(difference(f.records[key], []string{rrIP(rr)}), rrIP(rr))
+		}
+	}
+	f.updates++
+	f.reply(w, r, dns.RcodeSuccess, nil)
+}
@@ -0,0 +1,305 @@
+package ip8s
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+type fakeRecord struct {
+	Value string `xml:"Value"`
+}
+
+type fakeRecordSet struct {
+	Name             string       `xml:"Name"`
+	Type             string       `xml:"Type"`
+	SetIdentifier    string       `xml:"SetIdentifier,omitempty"`
+	Weight           *int64       `xml:"Weight,omitempty"`
+	MultiValueAnswer *bool        `xml:"MultiValueAnswer,omitempty"`
+	TTL              int64        `xml:"TTL"`
+	ResourceRecords  []fakeRecord `xml:"ResourceRecords>ResourceRecord"`
+}
+
+func (s fakeRecordSet) key() string {
+	return s.Name + " " + s.Type + " " + s.SetIdentifier
+}
+
+// String returns "A 1.2.3.4 5.6.7.8" (with the sorted values).
+func (s fakeRecordSet) String() string {
+	values := make([]string, len(s.ResourceRecords))
+	for i, record := range s.ResourceRecords {
+		values[i] = record.Value
+	}
+	sort.Strings(values)
+	return strings.Join(append([]string{s.Type}, values...), " ")
+}
+
+type fakeChange struct {
+	Action    string        `xml:"Action"`
+	RecordSet fakeRecordSet `xml:"ResourceRecordSet"`
+}
+
+type fakeZone struct {
+	ID      string
+	Name    string
+	Private bool
+	sets    map[string]fakeRecordSet
+}
+
+// fakeRoute53 is an in-memory stand-in for the subset of the Route53 REST
+// API used by the broadcaster.
+type fakeRoute53 struct {
+	l        sync.Mutex
+	zones    []*fakeZone
+	changes  map[string]int
+	failures map[string]string
+	requests []string
+	server   *httptest.Server
+}
+
+func helperRoute53(t *testing.T, zones ...string) (*fakeRoute53, *route53.Route53) {
+	f := &fakeRoute53{
+		changes:  map[string]int{},
+		failures: map[string]string{},
+	}
+	for _, zone := range zones {
+		f.AddZone(zone, false)
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(f.server.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, route53.New(sess)
+}
+
+func (f *fakeRoute53) Close() {
+	f.server.Close()
+}
+
+func (f *fakeRoute53) AddZone(name string, private bool) string {
+	f.l.Lock()
+	defer f.l.Unlock()
+	zone := &fakeZone{
+		ID:      fmt.Sprintf("Z%d", len(f.zones)+1),
+		Name:    fqdn(name),
+		Private: private,
+		sets:    map[string]fakeRecordSet{},
+	}
+	f.zones = append(f.zones, zone)
+	return zone.ID
+}
+
+func (f *fakeRoute53) zone(id string) *fakeZone {
+	for _, zone := range f.zones {
+		if zone.ID == id {
+			return zone
+		}
+	}
+	return nil
+}
+
+func (f *fakeRoute53) AddRecordSet(zoneID string, set fakeRecordSet) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	set.Name = fqdn(set.Name)
+	f.zone(zoneID).sets[set.key()] = set
+}
+
+// RecordSets returns the record sets of a name as "A 1.2.3.4" strings.
+func (f *fakeRoute53) RecordSets(zoneID, name string) []string {
+	f.l.Lock()
+	defer f.l.Unlock()
+	sets := []string{}
+	for _, set := range f.zone(zoneID).sets {
+		if set.Name == fqdn(name) {
+			sets = append(sets, set.String())
+		}
+	}
+	sort.Strings(sets)
+	return sets
+}
+
+func (f *fakeRoute53) RecordSet(zoneID, name, typ, setIdentifier string) (fakeRecordSet, bool) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	set, exists := f.zone(zoneID).sets[fqdn(name)+" "+typ+" "+setIdentifier]
+	return set, exists
+}
+
+// Fail makes the requests "METHOD resource" (e.g. "POST rrset") answer with
+// the given error code.
+func (f *fakeRoute53) Fail(request, code string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.failures[request] = code
+}
+
+func (f *fakeRoute53) Requests() []string {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeRoute53) reply(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(response)
+}
+
+func (f *fakeRoute53) fail(w http.ResponseWriter, code, message string) {
+	status := http.StatusBadRequest
+	if code == "InternalError" {
+		status = http.StatusInternalServerError
+	}
+	type routeError struct {
+		Type    string
+		Code    string
+		Message string
+	}
+	f.reply(w, status, struct {
+		XMLName   xml.Name `xml:"ErrorResponse"`
+		Error     routeError
+		RequestId string
+	}{Error: routeError{"Sender", code, message}, RequestId: "request"})
+}
+
+func (f *fakeRoute53) changeInfo(id string) interface{} {
+	status := "PENDING"
+	if f.changes[id] > 1 {
+		status = "INSYNC"
+	}
+	return struct {
+		Id          string
+		Status      string
+		SubmittedAt string
+	}{"/change/" + id, status, "2019-12-01T10:00:00Z"}
+}
+
+func (f *fakeRoute53) serve(w http.ResponseWriter, r *http.Request) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/2013-04-01"), "/"), "/")
+	query := r.URL.Query()
+	resource := path[0]
+	if len(path) > 2 {
+		resource = path[2]
+	}
+	f.requests = append(f.requests, r.Method+" "+resource)
+	if code, exists := f.failures[r.Method+" "+resource]; exists {
+		f.fail(w, code, "injected failure")
+		return
+	}
+	switch {
+	case resource == "hostedzonesbyname" && r.Method == http.MethodGet:
+		type config struct {
+			PrivateZone bool
+		}
+		type hostedZone struct {
+			Id              string
+			Name            string
+			CallerReference string
+			Config          config
+		}
+		zones := []hostedZone{}
+		for _, zone := range f.zones {
+			// zones are listed from the requested name on
+			if zone.Name >= fqdn(query.Get("dnsname")) {
+				zones = append(zones, hostedZone{"/hostedzone/" + zone.ID, zone.Name, zone.ID, config{zone.Private}})
+			}
+		}
+		sort.SliceStable(zones, func(i, j int) bool { return zones[i].Name < zones[j].Name })
+		f.reply(w, http.StatusOK, struct {
+			XMLName     xml.Name     `xml:"ListHostedZonesByNameResponse"`
+			HostedZones []hostedZone `xml:"HostedZones>HostedZone"`
+			IsTruncated bool
+			MaxItems    string
+		}{HostedZones: zones, MaxItems: query.Get("maxitems")})
+	case resource == "rrset" && r.Method == http.MethodGet:
+		zone := f.zone(path[1])
+		if zone == nil {
+			f.fail(w, "NoSuchHostedZone", "no such hosted zone")
+			return
+		}
+		sets := []fakeRecordSet{}
+		for _, set := range zone.sets {
+			if set.Name >= query.Get("name") {
+				sets = append(sets, set)
+			}
+		}
+		sort.Slice(sets, func(i, j int) bool { return sets[i].key() < sets[j].key() })
+		f.reply(w, http.StatusOK, struct {
+			XMLName            xml.Name        `xml:"ListResourceRecordSetsResponse"`
+			ResourceRecordSets []fakeRecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+			IsTruncated        bool
+			MaxItems           string
+		}{ResourceRecordSets: sets, MaxItems: "100"})
+	case resource == "rrset" && r.Method == http.MethodPost:
+		zone := f.zone(path[1])
+		if zone == nil {
+			f.fail(w, "NoSuchHostedZone", "no such hosted zone")
+			return
+		}
+		batch := struct {
+			Changes []fakeChange `xml:"ChangeBatch>Changes>Change"`
+		}{}
+		if err := xml.NewDecoder(r.Body).Decode(&batch); err != nil {
+			f.fail(w, "InvalidInput", err.Error())
+			return
+		}
+		// the batch is validated as a whole before being applied
+		for _, change := range batch.Changes {
+			existing, exists := zone.sets[change.RecordSet.key()]
+			switch change.Action {
+			case "DELETE":
+				if !exists || existing.String() != change.RecordSet.String() {
+					f.fail(w, "InvalidChangeBatch", "record set not found: "+change.RecordSet.key())
+					return
+				}
+			case "CREATE":
+				if exists {
+					f.fail(w, "InvalidChangeBatch", "record set already exists: "+change.RecordSet.key())
+					return
+				}
+			}
+		}
+		for _, change := range batch.Changes {
+			if change.Action == "DELETE" {
+				delete(zone.sets, change.RecordSet.key())
+			} else {
+				zone.sets[change.RecordSet.key()] = change.RecordSet
+			}
+		}
+		id := fmt.Sprintf("C%d", len(f.changes)+1)
+		f.changes[id] = 0
+		f.reply(w, http.StatusOK, struct {
+			XMLName    xml.Name `xml:"ChangeResourceRecordSetsResponse"`
+			ChangeInfo interface{}
+		}{ChangeInfo: f.changeInfo(id)})
+	case resource == "change" && r.Method == http.MethodGet:
+		// a change gets INSYNC on the second poll
+		id := path[1]
+		f.changes[id]++
+		f.reply(w, http.StatusOK, struct {
+			XMLName    xml.Name `xml:"GetChangeResponse"`
+			ChangeInfo interface{}
+		}{ChangeInfo: f.changeInfo(id)})
+	default:
+		f.fail(w, "InvalidInput", "unknown request "+r.Method+" "+r.URL.Path)
+	}
+}
@@ -0,0 +1,113 @@
+package ip8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+type fakeSlackMessage struct {
+	Channel  string
+	Text     string
+	ThreadTS string
+	Blocks   []map[string]interface{}
+}
+
+// fakeSlack records the messages posted with chat.postMessage or to the
+// incoming webhooks (/services/...).
+type fakeSlack struct {
+	l        sync.Mutex
+	messages []fakeSlackMessage
+	status   int
+	code     string
+	server   *httptest.Server
+}
+
+func helperSlack(t *testing.T) *fakeSlack {
+	f := &fakeSlack{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeSlack) Close() {
+	f.server.Close()
+}
+
+// Option points the slack client to the fake.
+func (f *fakeSlack) Option() SlackOption {
+	return SlackClientOptions(slack.OptionAPIURL(f.server.URL + "/"))
+}
+
+func (f *fakeSlack) WebhookURL(channel string) string {
+	return f.server.URL + "/services/T000/B000/" + channel
+}
+
+// FailWebhooks makes the incoming webhooks answer with the status and the
+// error code.
+func (f *fakeSlack) FailWebhooks(status int, code string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.status = status
+	f.code = code
+}
+
+func (f *fakeSlack) Messages() []fakeSlackMessage {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return append([]fakeSlackMessage(nil), f.messages...)
+}
+
+func (f *fakeSlack) serve(w http.ResponseWriter, r *http.Request) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/services/") {
+		f.serveWebhook(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path != "/chat.postMessage" {
+		fmt.Fprint(w, `{"ok":false,"error":"unknown_method"}`)
+		return
+	}
+	message := fakeSlackMessage{
+		Channel:  r.FormValue("channel"),
+		Text:     r.FormValue("text"),
+		ThreadTS: r.FormValue("thread_ts"),
+	}
+	if blocks := r.FormValue("blocks"); blocks != "" {
+		if err := json.Unmarshal([]byte(blocks), &message.Blocks); err != nil {
+			fmt.Fprintf(w, `{"ok":false,"error":%q}`, err.Error())
+			return
+		}
+	}
+	f.messages = append(f.messages, message)
+	fmt.Fprintf(w, `{"ok":true,"channel":%q,"ts":"%d.000100"}`, message.Channel, len(f.messages))
+}
+
+func (f *fakeSlack) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		fmt.Fprint(w, f.code)
+		return
+	}
+	message := fakeSlackMessage{Channel: path.Base(r.URL.Path)}
+	body := struct {
+		Text   string
+		Blocks []map[string]interface{}
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "invalid_payload")
+		return
+	}
+	message.Text, message.Blocks = body.Text, body.Blocks
+	f.messages = append(f.messages, message)
+	fmt.Fprint(w, "ok")
+}
@@ -0,0 +1,211 @@
+package ip8s
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeMail struct {
+	From string
+	To   []string
+	Data string
+	TLS  bool
+	Auth string
+}
+
+// fakeSMTP is an in-process SMTP server supporting STARTTLS (or implicit
+// TLS), PLAIN and LOGIN authentication.
+type fakeSMTP struct {
+	l          sync.Mutex
+	listener   net.Listener
+	tls        *tls.Config
+	implicit   bool
+	startTLS   bool
+	username   string
+	password   string
+	rejectRcpt map[string]bool
+	mails      []fakeMail
+}
+
+// helperSMTP starts the server and returns the TLS configuration trusting
+// its certificate. STARTTLS is only advertised with the StartTLS security.
+func helperSMTP(t *testing.T, security SMTPSecurity) (*fakeSMTP, *tls.Config) {
+	// borrow the self-signed certificate of httptest, valid for 127.0.0.1
+	https := httptest.NewUnstartedServer(nil)
+	https.StartTLS()
+	certificates := https.TLS.Certificates
+	pool := x509.NewCertPool()
+	pool.AddCert(https.Certificate())
+	https.Close()
+
+	f := &fakeSMTP{
+		tls:        &tls.Config{Certificates: certificates},
+		implicit:   security == ImplicitTLS,
+		startTLS:   security == StartTLS,
+		username:   "user",
+		password:   "secret",
+		rejectRcpt: map[string]bool{},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.implicit {
+		listener = tls.NewListener(listener, f.tls)
+	}
+	f.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, &tls.Config{RootCAs: pool}
+}
+
+func (f *fakeSMTP) Addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeSMTP) Close() {
+	f.listener.Close()
+}
+
+func (f *fakeSMTP) RejectRecipient(address string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.rejectRcpt[address] = true
+}
+
+func (f *fakeSMTP) rejected(address string) bool {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.rejectRcpt[address]
+}
+
+func (f *fakeSMTP) Mails() []fakeMail {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return append([]fakeMail(nil), f.mails...)
+}
+
+func (f *fakeSMTP) credentials(tp *textproto.Conn, mechanism, initial string) (string, string, bool) {
+	decode := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+	switch mechanism {
+	case "PLAIN":
+		parts := strings.Split(decode(initial), "\x00")
+		if len(parts) != 3 {
+			return "", "", false
+		}
+		return parts[1], parts[2], true
+	case "LOGIN":
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+		username, err := tp.ReadLine()
+		if err != nil {
+			return "", "", false
+		}
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+		password, err := tp.ReadLine()
+		if err != nil {
+			return "", "", false
+		}
+		return decode(username), decode(password), true
+	default:
+		return "", "", false
+	}
+}
+
+func address(arg string) string {
+	return strings.Trim(arg[strings.Index(arg, ":")+1:], "<> ")
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	secure := f.implicit
+	auth := ""
+	mail := fakeMail{}
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			extensions := []string{"localhost"}
+			if f.startTLS && !secure {
+				extensions = append(extensions, "STARTTLS")
+			}
+			extensions = append(extensions, "AUTH PLAIN LOGIN")
+			for i, extension := range extensions {
+				separator := "-"
+				if i == len(extensions)-1 {
+					separator = " "
+				}
+				tp.PrintfLine("250%s%s", separator, extension)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready to start TLS")
+			tlsConn := tls.Server(conn, f.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, tp, secure = tlsConn, textproto.NewConn(tlsConn), true
+		case "AUTH":
+			params := append(strings.SplitN(arg, " ", 2), "")
+			username, password, ok := f.credentials(tp, params[0], params[1])
+			if !ok || username != f.username || password != f.password {
+				tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			auth = params[0]
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			mail = fakeMail{From: address(arg), TLS: secure, Auth: auth}
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			if f.rejected(address(arg)) {
+				tp.PrintfLine("550 no such user")
+				continue
+			}
+			mail.To = append(mail.To, address(arg))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.Data = string(data)
+			f.l.Lock()
+			f.mails = append(f.mails, mail)
+			f.l.Unlock()
+			tp.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package ip8s
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElector elects, with a Lease, the single replica allowed to
+// broadcast. The other replicas keep their informers warm and take over
+// within the lease duration.
+type LeaderElector struct {
+	client        kubernetes.Interface
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+	logger        *log.Logger
+
+	l sync.Mutex
+	// leading is the context of the current leadership, nil when following.
+	leading      context.Context
+	broadcasters []*leaderBroadcaster
+	callbacks    []func(leading context.Context)
+}
+
+type LeaderElectionOption func(*LeaderElector)
+
+// LeaderElectionIdentity identifies the replica in the lease (default: the
+// hostname, i.e. the pod name).
+func LeaderElectionIdentity(identity string) LeaderElectionOption {
+	return func(e *LeaderElector) {
+		e.identity = identity
+	}
+}
+
+// LeaderElectionTiming sets how long a lease is valid, how long the leader
+// tries to renew it before giving up and how often the replicas try to
+// acquire or renew it (default: 15s, 10s and 2s).
+func LeaderElectionTiming(leaseDuration, renewDeadline, retryPeriod time.Duration) LeaderElectionOption {
+	return func(e *LeaderElector) {
+		e.leaseDuration = leaseDuration
+		e.renewDeadline = renewDeadline
+		e.retryPeriod = retryPeriod
+	}
+}
+
+// LeaderElectionLogger logs the leadership changes and the failures of the
+// catch-up broadcasts (default: stderr).
+func LeaderElectionLogger(logger *log.Logger) LeaderElectionOption {
+	return func(e *LeaderElector) {
+		e.logger = logger
+	}
+}
+
+// NewLeaderElector uses the Lease namespace/name as lock.
+func NewLeaderElector(client kubernetes.Interface, namespace, name string, opts ...LeaderElectionOption) (*LeaderElector, error) {
+	if namespace == "" || name == "" {
+		return nil, errors.New("missing namespace or name of the lease")
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the hostname")
+	}
+	e := &LeaderElector{
+		client:        client,
+		namespace:     namespace,
+		name:          name,
+		identity:      hostname,
+		leaseDuration: 15 * time.Second,
+		renewDeadline: 10 * time.Second,
+		retryPeriod:   2 * time.Second,
+		logger:        log.New(os.Stderr, "", log.LstdFlags),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.identity == "" {
+		return nil, errors.New("missing leader election identity")
+	}
+	if _, err := e.elector(); err != nil {
+		return nil, errors.Wrap(err, "invalid leader election")
+	}
+	return e, nil
+}
+
+func (e *LeaderElector) elector() (*leaderelection.LeaderElector, error) {
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: e.namespace, Name: e.name},
+			Client:     e.client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: e.identity},
+		},
+		LeaseDuration: e.leaseDuration,
+		RenewDeadline: e.renewDeadline,
+		RetryPeriod:   e.retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: e.startedLeading,
+			OnStoppedLeading: e.stoppedLeading,
+			OnNewLeader: func(identity string) {
+				e.logger.Printf("leader election: %s leads %s/%s", identity, e.namespace, e.name)
+			},
+		},
+		// hands over the lease right away on shutdown
+		ReleaseOnCancel: true,
+		Name:            e.name,
+	})
+}
+
+// Run takes part in the election until ctx is done, releasing the lease if
+// leading. A replica losing its leadership goes back to following.
+func (e *LeaderElector) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		elector, err := e.elector()
+		if err != nil {
+			// unexpected, the configuration was validated by NewLeaderElector
+			e.logger.Printf("leader election: %v", err)
+			return
+		}
+		elector.Run(ctx)
+	}
+}
+
+func (e *LeaderElector) IsLeader() bool {
+	return e.leadership() != nil
+}
+
+// leadership returns the context of the current leadership, nil when
+// following.
+func (e *LeaderElector) leadership() context.Context {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if e.leading == nil || e.leading.Err() != nil {
+		// OnStartedLeading runs in its own goroutine, possibly after
+		// OnStoppedLeading
+		return nil
+	}
+	return e.leading
+}
+
+func (e *LeaderElector) startedLeading(ctx context.Context) {
+	e.l.Lock()
+	e.leading = ctx
+	broadcasters := append([]*leaderBroadcaster(nil), e.broadcasters...)
+	callbacks := append([]func(leading context.Context){}, e.callbacks...)
+	e.l.Unlock()
+	e.logger.Printf("leader election: started leading %s/%s", e.namespace, e.name)
+	for _, b := range broadcasters {
+		if err := b.catchUp(ctx); err != nil {
+			e.logger.Printf("leader election: failed to broadcast the latest IPs: %v", err)
+		}
+	}
+	for _, f := range callbacks {
+		f(ctx)
+	}
+}
+
+func (e *LeaderElector) stoppedLeading() {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if e.leading != nil {
+		e.logger.Printf("leader election: stopped leading %s/%s", e.namespace, e.name)
+	}
+	e.leading = nil
+}
+
+// Broadcaster only broadcasts with b while leading. The followers remember
+// the latest IPs and broadcast them when they take over, in case the
+// previous leader did not, except to the targets of b without catch-up.
+func (e *LeaderElector) Broadcaster(b Broadcaster) Broadcaster {
+	e.l.Lock()
+	defer e.l.Unlock()
+	broadcaster := e.gate(b)
+	e.broadcasters = append(e.broadcasters, broadcaster)
+	return broadcaster
+}
+
+// gate only broadcasts with b while leading, without catch-up.
+func (e *LeaderElector) gate(b Broadcaster) *leaderBroadcaster {
+	return &leaderBroadcaster{elector: e, broadcaster: b}
+}
+
+// OnLeading calls f with the context of the leadership each time the
+// replica starts leading, after the catch-up of the broadcasters.
+func (e *LeaderElector) OnLeading(f func(leading context.Context)) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.callbacks = append(e.callbacks, f)
+}
+
+type leaderBroadcaster struct {
+	elector     *LeaderElector
+	broadcaster Broadcaster
+
+	// l serializes the broadcasts and guards latest
+	l      sync.Mutex
+	latest *Change
+}
+
+// withLeadership cancels ctx when the leadership is lost.
+func withLeadership(ctx, leading context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-leading.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (b *leaderBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	return b.BroadcastChange(ctx, Change{IPs: ips})
+}
+
+func (b *leaderBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.latest = &change
+	leading := b.elector.leadership()
+	if leading == nil {
+		return nil
+	}
+	ctx, cancel := withLeadership(ctx, leading)
+	defer cancel()
+	return BroadcastChange(ctx, b.broadcaster, change)
+}
+
+// Deliver is a no-op returning an empty report while following.
+func (b *leaderBroadcaster) Deliver(ctx context.Context, change Change) DeliveryReport {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.latest = &change
+	leading := b.elector.leadership()
+	if leading == nil {
+		return DeliveryReport{}
+	}
+	ctx, cancel := withLeadership(ctx, leading)
+	defer cancel()
+	return DeliverChange(ctx, b.broadcaster, change)
+}
+
+// Redeliver gives up while following, the next leader catches up.
+func (b *leaderBroadcaster) Redeliver(ctx context.Context, change Change, report DeliveryReport) DeliveryReport {
+	b.l.Lock()
+	defer b.l.Unlock()
+	leading := b.elector.leadership()
+	if leading == nil {
+		return DeliveryReport{}
+	}
+	ctx, cancel := withLeadership(ctx, leading)
+	defer cancel()
+	return RedeliverChange(ctx, b.broadcaster, change, report)
+}
+
+// caughtUpBroadcaster is implemented by the broadcasters of which only
+// some targets are caught up by a new leader.
+type caughtUpBroadcaster interface {
+	caughtUp() Broadcaster
+}
+
+// caughtUp returns the part of b a new leader broadcasts the latest IPs to.
+func caughtUp(b Broadcaster) Broadcaster {
+	if broadcaster, ok := b.(caughtUpBroadcaster); ok {
+		return broadcaster.caughtUp()
+	}
+	return b
+}
+
+// caughtUp only broadcasts with the caught-up part of b while leading.
+func (b *leaderBroadcaster) caughtUp() Broadcaster {
+	return b.elector.gate(caughtUp(b.broadcaster))
+}
+
+// catchUp broadcasts the latest IPs, without their differences with the
+// previous ones which may not be the ones the previous leader broadcast.
+func (b *leaderBroadcaster) catchUp(ctx context.Context) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.latest == nil {
+		return nil
+	}
+	return BroadcastChange(ctx, caughtUp(b.broadcaster), Change{IPs: b.latest.IPs, Nodes: b.latest.Nodes})
+}
+
+func (b *leaderBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	return PlanBroadcast(ctx, b.broadcaster, ips)
+}
+
+func (b *leaderBroadcaster) PlanChange(ctx context.Context, change Change) (Plan, error) {
+	return PlanBroadcastChange(ctx, b.broadcaster, change)
+}
@@ -0,0 +1,147 @@
+package ip8s
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+// changeChanBroadcaster sends its changes to a channel, for the broadcasts
+// happening in the background.
+type changeChanBroadcaster chan Change
+
+func (b changeChanBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	return b.BroadcastChange(ctx, Change{IPs: ips})
+}
+
+func (b changeChanBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	b <- change
+	return nil
+}
+
+func helperLeaderElector(t *testing.T, client *fakekube.Clientset, identity string) *LeaderElector {
+	e, err := NewLeaderElector(client, "ip8s", "ip8s",
+		LeaderElectionIdentity(identity),
+		LeaderElectionTiming(time.Second, 500*time.Millisecond, 100*time.Millisecond),
+		LeaderElectionLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func helperReceiveChange(t *testing.T, c <-chan Change) Change {
+	select {
+	case change := <-c:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("no broadcast")
+		return Change{}
+	}
+}
+
+func helperNoChange(t *testing.T, c <-chan Change) {
+	select {
+	case change := <-c:
+		t.Errorf("follower broadcast: expected nothing but got %+v", change)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNewLeaderElector(t *testing.T) {
+	client := fakekube.NewSimpleClientset()
+	if _, err := NewLeaderElector(client, "", "ip8s"); err == nil {
+		t.Error("missing namespace accepted: expected an error but got <nil>")
+	}
+	if _, err := NewLeaderElector(client, "ip8s", "ip8s", LeaderElectionTiming(time.Second, 2*time.Second, 100*time.Millisecond)); err == nil {
+		t.Error("renew deadline after the lease accepted: expected an error but got <nil>")
+	}
+	if _, err := NewLeaderElector(client, "ip8s", "ip8s"); err != nil {
+		t.Errorf("valid election rejected: expected <nil> but got %v", err)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	client := fakekube.NewSimpleClientset()
+	first, second := helperLeaderElector(t, client, "first"), helperLeaderElector(t, client, "second")
+	firstChanges, secondChanges := make(changeChanBroadcaster, 10), make(changeChanBroadcaster, 10)
+	firstBroadcaster, secondBroadcaster := first.Broadcaster(firstChanges), second.Broadcaster(secondChanges)
+	ctx := context.Background()
+	change := newChange(nil, []string{"1.2.3.4"}, nil)
+	for _, b := range []Broadcaster{firstBroadcaster, secondBroadcaster} {
+		if err := BroadcastChange(ctx, b, change); err != nil {
+			t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+		}
+	}
+	helperNoChange(t, firstChanges)
+
+	// the first leader catches up with the IPs received before its election
+	firstCtx, firstCancel := context.WithCancel(ctx)
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		first.Run(firstCtx)
+	}()
+	if caughtUp := helperReceiveChange(t, firstChanges); !helperEqual(caughtUp.IPs, []string{"1.2.3.4"}) {
+		t.Errorf("invalid catch-up: expected [1.2.3.4] but got %v", caughtUp.IPs)
+	}
+	secondCtx, secondCancel := context.WithCancel(ctx)
+	defer secondCancel()
+	go second.Run(secondCtx)
+
+	change = newChange([]string{"1.2.3.4"}, []string{"1.2.3.5"}, nil)
+	for _, b := range []Broadcaster{firstBroadcaster, secondBroadcaster} {
+		if err := BroadcastChange(ctx, b, change); err != nil {
+			t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+		}
+	}
+	if broadcast := helperReceiveChange(t, firstChanges); !helperEqual(broadcast.Added, []string{"1.2.3.5"}) {
+		t.Errorf("invalid broadcast: expected [1.2.3.5] added but got %+v", broadcast)
+	}
+	helperNoChange(t, secondChanges)
+	if !first.IsLeader() || second.IsLeader() {
+		t.Errorf("invalid leadership: expected first but got first %v, second %v", first.IsLeader(), second.IsLeader())
+	}
+
+	// the lease is released on shutdown, the second one takes over
+	firstCancel()
+	<-firstDone
+	caughtUp := helperReceiveChange(t, secondChanges)
+	if !helperEqual(caughtUp.IPs, []string{"1.2.3.5"}) || len(caughtUp.Added) != 0 || len(caughtUp.Removed) != 0 {
+		t.Errorf("invalid catch-up: expected [1.2.3.5] without difference but got %+v", caughtUp)
+	}
+	if first.IsLeader() || !second.IsLeader() {
+		t.Errorf("invalid leadership: expected second but got first %v, second %v", first.IsLeader(), second.IsLeader())
+	}
+}
+
+func TestLeaderElectionNoCatchUp(t *testing.T) {
+	client := fakekube.NewSimpleClientset()
+	e := helperLeaderElector(t, client, "first")
+	dns, notification := make(changeChanBroadcaster, 10), make(changeChanBroadcaster, 10)
+	targets := NewNamedMultiBroadcaster(
+		NamedBroadcaster{Name: "cloudflare#0", Broadcaster: dns},
+		NamedBroadcaster{Name: "slack#1", Broadcaster: notification, NoCatchUp: true},
+	)
+	b := e.Broadcaster(targets)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := BroadcastChange(ctx, b, newChange(nil, []string{"1.2.3.4"}, nil)); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	go e.Run(ctx)
+	if caughtUp := helperReceiveChange(t, dns); !helperEqual(caughtUp.IPs, []string{"1.2.3.4"}) {
+		t.Errorf("invalid catch-up: expected [1.2.3.4] but got %v", caughtUp.IPs)
+	}
+	helperNoChange(t, notification)
+
+	dryRun := caughtUp(NewDryRunBroadcaster(targets, log.New(ioutil.Discard, "", 0)))
+	if plan, err := PlanBroadcast(ctx, dryRun, []string{"1.2.3.4"}); err != nil || len(plan) != 1 {
+		t.Errorf("invalid dry-run catch-up: expected the plan of cloudflare#0 only but got %v, %v", plan, err)
+	}
+}
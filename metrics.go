@@ -0,0 +1,200 @@
+package ip8s
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metrics are the prometheus collectors of the notifiers and broadcasters.
+type Metrics struct {
+	ips         *prometheus.GaugeVec
+	lastChange  *prometheus.GaugeVec
+	nodeEvents  *prometheus.CounterVec
+	sets        *prometheus.CounterVec
+	listErrors  *prometheus.CounterVec
+	broadcasts  *prometheus.CounterVec
+	failures    *prometheus.CounterVec
+	lastSuccess *prometheus.GaugeVec
+	latency     *prometheus.HistogramVec
+}
+
+// NewMetrics creates the collectors and registers them, e.g. with
+// prometheus.DefaultRegisterer to serve them with promhttp.Handler.
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		ips: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ip8s_ips",
+			Help: "Number of IPs in the last set of the notifier.",
+		}, []string{"notifier"}),
+		lastChange: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ip8s_last_change_timestamp_seconds",
+			Help: "Time the last set of IPs of the notifier was emitted.",
+		}, []string{"notifier"}),
+		nodeEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ip8s_node_events_total",
+			Help: "Node events received by the notifier, by type (add, update, delete).",
+		}, []string{"notifier", "event"}),
+		sets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ip8s_sets_total",
+			Help: "Sets of IPs emitted by the notifier.",
+		}, []string{"notifier"}),
+		listErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ip8s_list_errors_total",
+			Help: "Failures to compute the set of IPs of the notifier.",
+		}, []string{"notifier"}),
+		broadcasts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ip8s_broadcasts_total",
+			Help: "Broadcast attempts, including the retries.",
+		}, []string{"broadcaster", "type"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ip8s_broadcast_failures_total",
+			Help: "Failed broadcast attempts.",
+		}, []string{"broadcaster", "type"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ip8s_last_broadcast_success_timestamp_seconds",
+			Help: "Time of the last successful broadcast.",
+		}, []string{"broadcaster", "type"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ip8s_broadcast_duration_seconds",
+			Help:    "Duration of the broadcast attempts.",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"broadcaster", "type"}),
+	}
+	for _, collector := range []prometheus.Collector{
+		m.ips, m.lastChange, m.nodeEvents, m.sets, m.listErrors,
+		m.broadcasts, m.failures, m.lastSuccess, m.latency,
+	} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, errors.Wrap(err, "failed to register the metrics")
+		}
+	}
+	return m, nil
+}
+
+func (m *Metrics) nodeEvent(notifier, event string) {
+	if m != nil {
+		m.nodeEvents.WithLabelValues(notifier, event).Inc()
+	}
+}
+
+func (m *Metrics) listError(notifier string) {
+	if m != nil {
+		m.listErrors.WithLabelValues(notifier).Inc()
+	}
+}
+
+func (m *Metrics) set(notifier string, ips []string) {
+	if m != nil {
+		m.sets.WithLabelValues(notifier).Inc()
+		m.ips.WithLabelValues(notifier).Set(float64(len(ips)))
+		m.lastChange.WithLabelValues(notifier).SetToCurrentTime()
+	}
+}
+
+// forget deletes the series of the notifier name and of the broadcasters
+// named after it (e.g. "default/app/slack#0"), once they are stopped.
+func (m *Metrics) forget(name string) {
+	if m == nil {
+		return
+	}
+	for _, vec := range []interface {
+		prometheus.Collector
+		Delete(prometheus.Labels) bool
+	}{
+		m.ips, m.lastChange, m.nodeEvents, m.sets, m.listErrors,
+		m.broadcasts, m.failures, m.lastSuccess, m.latency,
+	} {
+		metrics := make(chan prometheus.Metric)
+		go func() {
+			vec.Collect(metrics)
+			close(metrics)
+		}()
+		var forgotten []prometheus.Labels
+		for metric := range metrics {
+			series := &dto.Metric{}
+			if err := metric.Write(series); err != nil {
+				continue
+			}
+			labels := prometheus.Labels{}
+			for _, label := range series.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if notifier, ok := labels["notifier"]; ok && notifier == name {
+				forgotten = append(forgotten, labels)
+			} else if broadcaster, ok := labels["broadcaster"]; ok && strings.HasPrefix(broadcaster, name+"/") {
+				forgotten = append(forgotten, labels)
+			}
+		}
+		for _, labels := range forgotten {
+			vec.Delete(labels)
+		}
+	}
+}
+
+// WithMetrics instruments the notifier.
+func WithMetrics(m *Metrics) NotifierOption {
+	return func(s *notifierSettings) {
+		s.metrics = m
+	}
+}
+
+// WithMetricsName labels the metrics of the notifier with name (default:
+// its node selector), e.g. the name of its rule.
+func WithMetricsName(name string) NotifierOption {
+	return func(s *notifierSettings) {
+		s.name = &name
+	}
+}
+
+type instrumentedBroadcaster struct {
+	broadcaster     Broadcaster
+	name            string
+	broadcasterType string
+	metrics         *Metrics
+}
+
+// NewInstrumentedBroadcaster records the broadcasts of b under its name,
+// unique among the broadcasters (e.g. "ingress/slack#0"), and its type (e.g.
+// "slack"). It should be wrapped by the retry broadcaster so that each
+// attempt is recorded.
+func NewInstrumentedBroadcaster(b Broadcaster, name, broadcasterType string, m *Metrics) Broadcaster {
+	return instrumentedBroadcaster{b, name, broadcasterType, m}
+}
+
+func (b instrumentedBroadcaster) observe(broadcast func() error) error {
+	start := time.Now()
+	err := broadcast()
+	b.metrics.broadcasts.WithLabelValues(b.name, b.broadcasterType).Inc()
+	b.metrics.latency.WithLabelValues(b.name, b.broadcasterType).Observe(time.Since(start).Seconds())
+	if err != nil {
+		b.metrics.failures.WithLabelValues(b.name, b.broadcasterType).Inc()
+	} else {
+		b.metrics.lastSuccess.WithLabelValues(b.name, b.broadcasterType).SetToCurrentTime()
+	}
+	return err
+}
+
+func (b instrumentedBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	return b.observe(func() error {
+		return b.broadcaster.Broadcast(ctx, ips)
+	})
+}
+
+func (b instrumentedBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	return b.observe(func() error {
+		return BroadcastChange(ctx, b.broadcaster, change)
+	})
+}
+
+func (b instrumentedBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	return PlanBroadcast(ctx, b.broadcaster, ips)
+}
+
+func (b instrumentedBroadcaster) PlanChange(ctx context.Context, change Change) (Plan, error) {
+	return PlanBroadcastChange(ctx, b.broadcaster, change)
+}
@@ -0,0 +1,181 @@
+package ip8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	v1 "k8s.io/api/core/v1"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+func helperMetrics(t *testing.T) *Metrics {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// helperSeries counts the series of the collector.
+func helperSeries(c prometheus.Collector) int {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(metrics)
+		close(metrics)
+	}()
+	count := 0
+	for range metrics {
+		count++
+	}
+	return count
+}
+
+func TestNewMetricsRegistered(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if _, err := NewMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMetrics(registry); err == nil {
+		t.Error("metrics registered twice: expected an error but got <nil>")
+	}
+}
+
+func TestInstrumentedBroadcaster(t *testing.T) {
+	m := helperMetrics(t)
+	transient := errors.New("HTTP status 503: unavailable")
+	flaky := &flakyBroadcaster{errs: []error{transient, transient}}
+	b, err := NewRetryBroadcaster(NewInstrumentedBroadcaster(flaky, "webhook", "webhook", m), RetryBackoff(time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := BroadcastChange(context.Background(), b, Change{IPs: []string{"1.2.3.4"}}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if attempts := testutil.ToFloat64(m.broadcasts.WithLabelValues("webhook", "webhook")); attempts != 3 {
+		t.Errorf("invalid attempts: expected 3 but got %v", attempts)
+	}
+	if failures := testutil.ToFloat64(m.failures.WithLabelValues("webhook", "webhook")); failures != 2 {
+		t.Errorf("invalid failures: expected 2 but got %v", failures)
+	}
+	if success := testutil.ToFloat64(m.lastSuccess.WithLabelValues("webhook", "webhook")); success < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Errorf("invalid last success: expected now but got %v", success)
+	}
+	latency := &dto.Metric{}
+	if err := m.latency.WithLabelValues("webhook", "webhook").(prometheus.Metric).Write(latency); err != nil {
+		t.Fatal(err)
+	}
+	if count := latency.GetHistogram().GetSampleCount(); count != 3 {
+		t.Errorf("invalid latency samples: expected 3 but got %v", count)
+	}
+}
+
+func TestMetricsForget(t *testing.T) {
+	m := helperMetrics(t)
+	for _, name := range []string{"default/app", "default/app2"} {
+		m.set(name, []string{"1.2.3.4"})
+		m.nodeEvent(name, "add")
+		b := NewInstrumentedBroadcaster(&flakyBroadcaster{}, name+"/slack#0", "slack", m)
+		if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.forget("default/app")
+	for _, collector := range []prometheus.Collector{m.ips, m.nodeEvents, m.broadcasts, m.lastSuccess, m.latency} {
+		if count := helperSeries(collector); count != 1 {
+			t.Errorf("invalid series: expected only those of default/app2 but got %d", count)
+		}
+	}
+	if sets := testutil.ToFloat64(m.sets.WithLabelValues("default/app2")); sets != 1 {
+		t.Errorf("invalid sets of default/app2: expected 1 but got %v", sets)
+	}
+}
+
+func TestNotifierMetrics(t *testing.T) {
+	m := helperMetrics(t)
+	client := fakekube.NewSimpleClientset(healthyNode1.Build("node1"), healthyMultiAddressesNode.Build("node2"))
+	notifier, err := newNotifierFromClient(client, time.Second, "", WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := notifier.NotifyWithErrors(ctx)
+	<-events
+	client.Tracker().Delete(v1.SchemeGroupVersion.WithResource("nodes"), "", "node1")
+	<-events
+	if ips := testutil.ToFloat64(m.ips.WithLabelValues("")); ips != 2 {
+		t.Errorf("invalid IP count: expected 2 but got %v", ips)
+	}
+	if sets := testutil.ToFloat64(m.sets.WithLabelValues("")); sets != 2 {
+		t.Errorf("invalid sets: expected 2 but got %v", sets)
+	}
+	if adds := testutil.ToFloat64(m.nodeEvents.WithLabelValues("", "add")); adds != 2 {
+		t.Errorf("invalid add events: expected 2 but got %v", adds)
+	}
+	if deletes := testutil.ToFloat64(m.nodeEvents.WithLabelValues("", "delete")); deletes != 1 {
+		t.Errorf("invalid delete events: expected 1 but got %v", deletes)
+	}
+}
+
+func TestConfigInstrument(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	m := helperMetrics(t)
+	config := &Config{Broadcasters: []BroadcasterConfig{{
+		Type:  "slack",
+		Retry: &RetryConfig{MaxAttempts: 2},
+		Slack: &SlackConfig{WebhookURLs: []string{server.WebhookURL("ops")}, DNSName: "example.com"},
+	}}}
+	config.Instrument(m)
+	b, err := config.Broadcaster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if attempts := testutil.ToFloat64(m.broadcasts.WithLabelValues("slack#0", "slack")); attempts != 1 {
+		t.Errorf("invalid attempts: expected 1 but got %v", attempts)
+	}
+}
+
+func TestConfigInstrumentRules(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	m := helperMetrics(t)
+	slack := BroadcasterConfig{Type: "slack", Slack: &SlackConfig{WebhookURLs: []string{server.WebhookURL("ops")}, DNSName: "example.com"}}
+	config := &Config{Rules: []RuleConfig{
+		{Name: "ingress", Broadcasters: []BroadcasterConfig{slack, slack}},
+		{Name: "workers", Broadcasters: []BroadcasterConfig{slack}},
+	}}
+	config.Instrument(m)
+	client := fakekube.NewSimpleClientset(healthyNode1.Build("node1"))
+	rules, err := config.Mapping(newNotifierSetFromClient(client, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, rule := range rules {
+		<-rule.Notifier.NotifyWithErrors(ctx)
+	}
+	// the rules share the same selector and the broadcasters their type
+	for _, name := range []string{"ingress", "workers"} {
+		if sets := testutil.ToFloat64(m.sets.WithLabelValues(name)); sets != 1 {
+			t.Errorf("invalid sets of %s: expected 1 but got %v", name, sets)
+		}
+	}
+	if err := rules[0].Broadcaster.Broadcast(ctx, []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	for name, expected := range map[string]float64{"ingress/slack#0": 1, "ingress/slack#1": 1, "workers/slack#0": 0} {
+		if attempts := testutil.ToFloat64(m.broadcasts.WithLabelValues(name, "slack")); attempts != expected {
+			t.Errorf("invalid attempts of %s: expected %v but got %v", name, expected, attempts)
+		}
+	}
+}
@@ -2,57 +2,349 @@ package ip8s
 
 import (
 	"context"
-	"fmt"
+	"net"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	api "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 )
 
-func NewInClusterNotifier(resyncDuration time.Duration, selector string) (Notifier, error) {
+func NewInClusterNotifier(resyncDuration time.Duration, selector string, opts ...NotifierOption) (Notifier, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read cluster config")
 	}
 
-	return NewNotifier(config, resyncDuration, selector)
+	return NewNotifier(config, resyncDuration, selector, opts...)
 }
 
-func NewNotifier(config *rest.Config, resyncDuration time.Duration, selector string) (Notifier, error) {
-	client, err := kubernetes.NewForConfig(config)
+func NewNotifier(config *rest.Config, resyncDuration time.Duration, selector string, opts ...NotifierOption) (Notifier, error) {
+	set, err := NewNotifierSet(config, resyncDuration)
 	if err != nil {
 		return nil, err
 	}
+	return set.Notifier(selector, opts...)
+}
+
+func newNotifierFromClient(client kubernetes.Interface, resyncDuration time.Duration, selector string, opts ...NotifierOption) (Notifier, error) {
+	return newNotifierSetFromClient(client, resyncDuration).Notifier(selector, opts...)
+}
+
+// NotifierSet creates notifiers sharing the same node informer and cache,
+// e.g. one per node pool. The informer runs from Start, or the first
+// notification, until its stop channel is closed.
+type NotifierSet struct {
+	factory informers.SharedInformerFactory
+	nodes   coreinformers.NodeInformer
 
-	return newNotifierFromClient(client, resyncDuration, selector), nil
+	// the informer handlers cannot be removed, a single one dispatches the
+	// events to the notifications in progress
+	l           sync.Mutex
+	subscribers []*nodeSubscriber
+}
+
+// nodeSubscriber receives the add, update (old and new node) and delete
+// events of the nodes.
+type nodeSubscriber struct {
+	handle func(event string, objs ...interface{})
+}
+
+func NewNotifierSet(config *rest.Config, resyncDuration time.Duration) (*NotifierSet, error) {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return newNotifierSetFromClient(client, resyncDuration), nil
 }
 
-func newNotifierFromClient(client kubernetes.Interface, resyncDuration time.Duration, selector string) Notifier {
+func newNotifierSetFromClient(client kubernetes.Interface, resyncDuration time.Duration) *NotifierSet {
 	factory := informers.NewSharedInformerFactory(client, resyncDuration)
 	nodes := factory.Core().V1().Nodes()
-	lister := &nodeLister{nodes.Lister()}
-	observer := &nodeObserver{nodes.Informer()}
-	return &notifier{observer, lister, selector, false, nil}
+	s := &NotifierSet{factory: factory, nodes: nodes}
+	// registers the informer before the factory starts
+	nodes.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.dispatch("add", obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			s.dispatch("update", oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			s.dispatch("delete", obj)
+		},
+	})
+	return s
+}
+
+func (s *NotifierSet) dispatch(event string, objs ...interface{}) {
+	s.l.Lock()
+	subscribers := append([]*nodeSubscriber(nil), s.subscribers...)
+	s.l.Unlock()
+	for _, subscriber := range subscribers {
+		subscriber.handle(event, objs...)
+	}
+}
+
+// subscribe dispatches the node events to handle until unsubscribe is
+// called.
+func (s *NotifierSet) subscribe(handle func(event string, objs ...interface{})) (unsubscribe func()) {
+	subscriber := &nodeSubscriber{handle}
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.subscribers = append(s.subscribers, subscriber)
+	return func() {
+		s.l.Lock()
+		defer s.l.Unlock()
+		for i, sub := range s.subscribers {
+			if sub == subscriber {
+				s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Notifier notifies the IPs of the nodes matching selector.
+func (s *NotifierSet) Notifier(selector string, opts ...NotifierOption) (Notifier, error) {
+	label, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := newNotifierSettings(opts)
+	if err != nil {
+		return nil, err
+	}
+	name := label.String()
+	if settings.name != nil {
+		name = *settings.name
+	}
+	lister := &nodeLister{s.nodes.Lister(), settings.addressTypes, settings.addressPolicy, settings.family}
+	observer := &nodeObserver{s, settings.quietPeriod, settings.maxWait, settings.metrics, name, label}
+	return &notifier{observer: observer, lister: lister, selector: label, metrics: settings.metrics, name: name}, nil
+}
+
+// Start runs the informer until stop is closed, unless already started.
+func (s *NotifierSet) Start(stop <-chan struct{}) {
+	s.factory.Start(stop)
+}
+
+// HasSynced tells whether the nodes were listed.
+func (s *NotifierSet) HasSynced() bool {
+	return s.nodes.Informer().HasSynced()
+}
+
+// run starts the informer, unless already started, and returns once stop
+// is closed.
+func (s *NotifierSet) run(stop <-chan struct{}) {
+	s.factory.Start(stop)
+	<-stop
+}
+
+// AddressPolicy tells which of the addresses reported by a node are published.
+type AddressPolicy int
+
+const (
+	// AllAddresses publishes all the addresses of all the listed types.
+	AllAddresses AddressPolicy = iota
+	// FirstAddress publishes a single address per node: the first one of
+	// the first listed type the node reports.
+	FirstAddress
+	// FallbackAddresses publishes, per node, all the addresses of the first
+	// listed type the node reports.
+	FallbackAddresses
+)
+
+// AddressFamily is the IP family of an address.
+type AddressFamily int
+
+const (
+	// AllFamilies does not restrict the addresses to a family.
+	AllFamilies AddressFamily = iota
+	IPv4
+	IPv6
+)
+
+// IPFamily returns the family of an IP address, false if addr is not an IP.
+func IPFamily(addr string) (AddressFamily, bool) {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return AllFamilies, false
+	case ip.To4() != nil:
+		return IPv4, true
+	default:
+		return IPv6, true
+	}
+}
+
+// SplitFamilies splits IPs by family, rejecting anything that is not an IP.
+func SplitFamilies(addrs []string) (v4 []string, v6 []string, err error) {
+	for _, addr := range addrs {
+		family, ok := IPFamily(addr)
+		switch {
+		case !ok:
+			return nil, nil, errors.Errorf("%q is not an IP address", addr)
+		case family == IPv4:
+			v4 = append(v4, addr)
+		default:
+			v6 = append(v6, addr)
+		}
+	}
+	return v4, v6, nil
+}
+
+func (f AddressFamily) matches(addr string) bool {
+	if f == AllFamilies {
+		return true
+	}
+	family, ok := IPFamily(addr)
+	return ok && family == f
+}
+
+type notifierSettings struct {
+	addressTypes  []api.NodeAddressType
+	addressPolicy AddressPolicy
+	family        AddressFamily
+	quietPeriod   time.Duration
+	maxWait       time.Duration
+	metrics       *Metrics
+	name          *string
+}
+
+// newNotifierSettings applies opts to the default settings.
+func newNotifierSettings(opts []NotifierOption) (*notifierSettings, error) {
+	settings := &notifierSettings{
+		addressTypes:  []api.NodeAddressType{api.NodeExternalIP},
+		addressPolicy: AllAddresses,
+	}
+	for _, opt := range opts {
+		opt(settings)
+	}
+	return settings, settings.validate()
+}
+
+func (s *notifierSettings) validate() error {
+	if len(s.addressTypes) == 0 {
+		return errors.New("no node address type")
+	}
+	for _, typ := range s.addressTypes {
+		switch typ {
+		case api.NodeExternalIP, api.NodeInternalIP, api.NodeHostName, api.NodeExternalDNS, api.NodeInternalDNS:
+		default:
+			return errors.Errorf("unknown node address type %q", typ)
+		}
+	}
+	switch s.addressPolicy {
+	case AllAddresses, FirstAddress, FallbackAddresses:
+	default:
+		return errors.Errorf("unknown address policy %d", s.addressPolicy)
+	}
+	switch s.family {
+	case AllFamilies, IPv4, IPv6:
+	default:
+		return errors.Errorf("unknown address family %d", s.family)
+	}
+	if s.quietPeriod < 0 || s.maxWait < 0 {
+		return errors.Errorf("invalid debounce timing %s/%s", s.quietPeriod, s.maxWait)
+	}
+	return nil
+}
+
+type NotifierOption func(*notifierSettings)
+
+// WithAddressTypes selects the node addresses to publish, types are listed
+// by order of preference (default: all the ExternalIP addresses).
+func WithAddressTypes(policy AddressPolicy, types ...api.NodeAddressType) NotifierOption {
+	return func(s *notifierSettings) {
+		s.addressPolicy = policy
+		s.addressTypes = types
+	}
+}
+
+func parseSelector(sel string) (labels.Selector, error) {
+	if sel == "" {
+		return labels.Everything(), nil
+	}
+	label, err := labels.Parse(sel)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid node selector %q", sel)
+	}
+	return label, nil
+}
+
+// NodeInfo describes the node reporting an IP.
+type NodeInfo struct {
+	Name   string
+	Labels map[string]string
+	// Zone is the topology zone of the node, empty when not labelled.
+	Zone string
+}
+
+// zoneLabels are the node labels holding the zone, by order of preference.
+var zoneLabels = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+
+// Change is a new set of IPs along with what changed since the previous one.
+type Change struct {
+	IPs []string
+	// Previous is the set of the last change, empty for the first one.
+	Previous []string
+	Added    []string
+	Removed  []string
+	// Nodes maps each IP to the node reporting it.
+	Nodes map[string]NodeInfo
+}
+
+func newChange(previous, ips []string, nodes map[string]NodeInfo) Change {
+	return Change{
+		IPs:      ips,
+		Previous: previous,
+		Added:    difference(ips, previous),
+		Removed:  difference(previous, ips),
+		Nodes:    nodes,
+	}
+}
+
+// Event is either a change of the IPs or an error preventing to compute it.
+type Event struct {
+	Change
+	Err error
+	// Recovered reports that the IPs could be listed again after an error
+	// and did not change: there is nothing to broadcast, Change only holds
+	// the current IPs.
+	Recovered bool
 }
 
 type Notifier interface {
+	// Notify only sends the IP sets, errors are dropped. Nothing is sent once
+	// ctx is done.
 	Notify(ctx context.Context) <-chan []string
+	// NotifyWithErrors sends the changes of the IP sets and the errors.
+	NotifyWithErrors(ctx context.Context) <-chan Event
+	// HasSynced tells whether the nodes were listed since the notification
+	// started.
+	HasSynced() bool
 }
 
 type notifier struct {
 	observer *nodeObserver
 	lister   *nodeLister
 
-	selector   string
+	selector   labels.Selector
+	metrics    *Metrics
+	name       string
 	subsequent bool
 	lastIPs    []string
+	// failed tells whether the last listing failed
+	failed bool
 }
 
 func diff(one, two []string) bool {
@@ -67,77 +359,258 @@ func diff(one, two []string) bool {
 	return false
 }
 
-func (n *notifier) sendIPs(c chan<- []string) {
-	ips, err := n.lister.List(n.selector)
+func (n *notifier) sendIPs(ctx context.Context, c chan<- Event) {
+	ips, nodes, err := n.lister.List(n.selector)
 	if err != nil {
-		// TODO: handle error properly
-		fmt.Println(err)
+		n.metrics.listError(n.name)
+		n.failed = true
+		send(ctx, c, Event{Err: err})
 		return
 	}
 	if !n.subsequent || diff(n.lastIPs, ips) {
+		change := newChange(n.lastIPs, ips, nodes)
 		n.lastIPs = ips
-		c <- ips
+		n.metrics.set(n.name, ips)
+		send(ctx, c, Event{Change: change})
+	} else if n.failed {
+		send(ctx, c, Event{Change: Change{IPs: ips, Previous: ips, Nodes: nodes}, Recovered: true})
 	}
 	n.subsequent = true
+	n.failed = false
 }
 
-func (n *notifier) Notify(ctx context.Context) <-chan []string {
+func send(ctx context.Context, c chan<- Event, event Event) {
+	select {
+	case c <- event:
+	case <-ctx.Done():
+	}
+}
+
+func (n *notifier) NotifyWithErrors(ctx context.Context) <-chan Event {
 	return n.observer.Observe(ctx, n.sendIPs)
 }
 
-type nodeObserver struct {
-	informer cache.SharedIndexInformer
+func (n *notifier) HasSynced() bool {
+	return n.observer.set.HasSynced()
 }
 
-func (o *nodeObserver) Observe(ctx context.Context, sender func(c chan<- []string)) <-chan []string {
+func (n *notifier) Notify(ctx context.Context) <-chan []string {
+	return forwardIPs(ctx, n.NotifyWithErrors(ctx))
+}
+
+// forwardIPs forwards the IPs of the changes of events until it is closed.
+// Nothing is forwarded once ctx is done, even while c has room.
+func forwardIPs(ctx context.Context, events <-chan Event) <-chan []string {
 	c := make(chan []string, 128)
-	o.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			sender(c)
-		},
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			sender(c)
-		},
-		DeleteFunc: func(obj interface{}) {
-			sender(c)
-		},
+	go func() {
+		defer close(c)
+		for event := range events {
+			if event.Err != nil || event.Recovered || ctx.Err() != nil {
+				continue
+			}
+			select {
+			case c <- event.IPs:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return c
+}
+
+type nodeObserver struct {
+	set         *NotifierSet
+	quietPeriod time.Duration
+	maxWait     time.Duration
+	metrics     *Metrics
+	name        string
+	selector    labels.Selector
+}
+
+// selects tells whether obj is one of the observed nodes, or may be one
+// (e.g. the tombstone of a deleted node).
+func (o *nodeObserver) selects(obj interface{}) bool {
+	n, ok := obj.(*api.Node)
+	return !ok || o.selector.Matches(labels.Set(n.Labels))
+}
+
+// event counts and triggers the events of the observed nodes.
+func (o *nodeObserver) event(event string, trigger func(), objs ...interface{}) {
+	for _, obj := range objs {
+		if o.selects(obj) {
+			o.metrics.nodeEvent(o.name, event)
+			trigger()
+			return
+		}
+	}
+}
+
+func (o *nodeObserver) Observe(ctx context.Context, sender func(ctx context.Context, c chan<- Event)) <-chan Event {
+	c := make(chan Event, 128)
+	// the sender runs from the informer handler and the debouncer timers,
+	// the lock serializes them and prevents sending once c is closed
+	l := sync.Mutex{}
+	closed := false
+	// the events before the first listing, once synced, would list a
+	// partial cache
+	listed := false
+	emit := func() {
+		l.Lock()
+		defer l.Unlock()
+		if !closed {
+			sender(ctx, c)
+			listed = true
+		}
+	}
+	next := emit
+	var d *debouncer
+	if o.quietPeriod > 0 {
+		d = newDebouncer(o.quietPeriod, o.maxWait, emit)
+		next = d.Trigger
+	}
+	trigger := func() {
+		l.Lock()
+		ready := listed
+		l.Unlock()
+		if ready {
+			next()
+		}
+	}
+	// a node leaving the selection is observed too, through the old node of
+	// its update
+	unsubscribe := o.set.subscribe(func(event string, objs ...interface{}) {
+		o.event(event, trigger, objs...)
 	})
 	go func() {
-		o.informer.Run(ctx.Done())
+		o.set.run(ctx.Done())
+		unsubscribe()
+		if d != nil {
+			d.Stop()
+		}
+		l.Lock()
+		defer l.Unlock()
+		closed = true
 		close(c)
 	}()
-	cache.WaitForCacheSync(ctx.Done(), o.informer.HasSynced)
-	sender(c)
+	if !cache.WaitForCacheSync(ctx.Done(), o.set.HasSynced) {
+		// stopped before the sync, an empty cache is not an empty set
+		return c
+	}
+	emit()
 	return c
 }
 
-type nodeLister struct {
-	lister v1.NodeLister
+// debouncer calls fn once Trigger was not called for quiet, or maxWait
+// after the first call if it keeps being called.
+type debouncer struct {
+	quiet   time.Duration
+	maxWait time.Duration
+	fn      func()
+
+	l          sync.Mutex
+	timer      *time.Timer
+	generation int
+	first      time.Time
+	stopped    bool
+}
+
+func newDebouncer(quiet, maxWait time.Duration, fn func()) *debouncer {
+	return &debouncer{quiet: quiet, maxWait: maxWait, fn: fn}
 }
 
-func (l *nodeLister) List(sel string) ([]string, error) {
-	label := labels.NewSelector()
-	if sel != "" {
-		var err error
-		label, err = labels.Parse(sel)
-		if err != nil {
-			return nil, errors.Wrap(err, "invalid node selector")
+func (d *debouncer) Trigger() {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if d.stopped {
+		return
+	}
+	now := time.Now()
+	if d.timer == nil {
+		d.first = now
+	} else {
+		d.timer.Stop()
+	}
+	delay := d.quiet
+	if d.maxWait > 0 {
+		if left := d.first.Add(d.maxWait).Sub(now); left < delay {
+			delay = left
 		}
 	}
+	d.generation++
+	generation := d.generation
+	d.timer = time.AfterFunc(delay, func() {
+		d.fire(generation)
+	})
+}
+
+func (d *debouncer) fire(generation int) {
+	d.l.Lock()
+	if d.stopped || generation != d.generation {
+		d.l.Unlock()
+		return
+	}
+	d.timer = nil
+	d.l.Unlock()
+	d.fn()
+}
+
+func (d *debouncer) Stop() {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+// WithAddressFamily only publishes the IPs of the given family, addresses
+// that are not IPs (hostnames, ...) are then ignored.
+func WithAddressFamily(family AddressFamily) NotifierOption {
+	return func(s *notifierSettings) {
+		s.family = family
+	}
+}
+
+// WithDebounce waits for the nodes to settle before emitting their IPs:
+// the set is only computed once no node changed for quietPeriod, or at the
+// latest maxWait after the first pending change (0 for no limit).
+func WithDebounce(quietPeriod, maxWait time.Duration) NotifierOption {
+	return func(s *notifierSettings) {
+		s.quietPeriod = quietPeriod
+		s.maxWait = maxWait
+	}
+}
 
-	nodes, err := l.lister.List(label)
+type nodeLister struct {
+	lister v1.NodeLister
+	types  []api.NodeAddressType
+	policy AddressPolicy
+	family AddressFamily
+}
+
+// List returns the sorted IPs of the available nodes and the node of each
+// IP, the first one by name when several nodes report the same IP.
+func (l *nodeLister) List(sel labels.Selector) ([]string, map[string]NodeInfo, error) {
+	nodes, err := l.lister.List(sel)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to list the nodes")
+		return nil, nil, errors.Wrap(err, "failed to list the nodes")
 	}
 	ips := []string{}
+	infos := map[string]NodeInfo{}
 	for _, nod := range nodes {
 		n := &node{nod}
-		if n.Available() {
-			ips = append(ips, n.IPs()...)
+		if !n.Available() {
+			continue
+		}
+		for _, addr := range n.Addresses(l.types, l.policy, l.family) {
+			addr = normalizeAddress(addr)
+			ips = append(ips, addr)
+			if info, exists := infos[addr]; !exists || nod.Name < info.Name {
+				infos[addr] = n.Info()
+			}
 		}
 	}
 	sort.Strings(ips)
-	return ips, nil
+	return dedup(ips), infos, nil
 }
 
 type node struct {
@@ -153,12 +626,63 @@ func (n *node) Available() bool {
 	return false
 }
 
-func (n *node) IPs() []string {
-	var ips []string
+// Info returns the attribution of the node, with a copy of its labels.
+func (n *node) Info() NodeInfo {
+	info := NodeInfo{Name: n.node.Name, Labels: map[string]string{}}
+	for key, value := range n.node.Labels {
+		info.Labels[key] = value
+	}
+	for _, label := range zoneLabels {
+		if zone, exists := n.node.Labels[label]; exists && info.Zone == "" {
+			info.Zone = zone
+		}
+	}
+	return info
+}
+
+func (n *node) addressesOfType(typ api.NodeAddressType, family AddressFamily) []string {
+	var addrs []string
 	for _, addr := range n.node.Status.Addresses {
-		if addr.Type == api.NodeExternalIP {
-			ips = append(ips, addr.Address)
+		if addr.Type == typ && family.matches(addr.Address) {
+			addrs = append(addrs, addr.Address)
+		}
+	}
+	return addrs
+}
+
+func (n *node) Addresses(types []api.NodeAddressType, policy AddressPolicy, family AddressFamily) []string {
+	var addrs []string
+	for _, typ := range types {
+		found := n.addressesOfType(typ, family)
+		switch {
+		case len(found) == 0:
+			continue
+		case policy == FirstAddress:
+			return found[:1]
+		case policy == FallbackAddresses:
+			return found
+		}
+		addrs = append(addrs, found...)
+	}
+	return addrs
+}
+
+// normalizeAddress writes IPs in their canonical form so that the same
+// IPv6 address reported differently by two nodes is not published twice.
+func normalizeAddress(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// dedup removes the consecutive duplicates of a sorted slice.
+func dedup(sorted []string) []string {
+	res := sorted[:0]
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			res = append(res, s)
 		}
 	}
-	return ips
+	return res
 }
@@ -3,17 +3,22 @@ package ip8s
 import (
 	//fakerest "k8s.io/client-go/rest/fake"
 	"context"
+	"errors"
 	"testing"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
 	fakekube "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	restclient "k8s.io/client-go/rest"
 	testingkube "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
 )
 
 type testObject struct {
@@ -58,6 +63,13 @@ var healthyInternalAddressesNode = buildNode().
 	Condition(v1.NodeReady, v1.ConditionTrue).
 	Address(v1.NodeExternalIP, "1.2.3.10").
 	Address(v1.NodeInternalIP, "1.2.3.11")
+var dualStackNode = buildNode().
+	Condition(v1.NodeReady, v1.ConditionTrue).
+	Address(v1.NodeExternalIP, "1.2.3.12").
+	Address(v1.NodeExternalIP, "2001:db8::1")
+var denormalizedIPv6Node = buildNode().
+	Condition(v1.NodeReady, v1.ConditionTrue).
+	Address(v1.NodeExternalIP, "2001:DB8:0::1")
 
 type changeType int
 
@@ -145,6 +157,15 @@ func TestNotifier(t *testing.T) {
 				{},
 			},
 		},
+		"DualStackNormalized": notifierTestCase{
+			initial: map[string]*nodeBuilder{
+				"node1": dualStackNode,
+				"node2": denormalizedIPv6Node,
+			},
+			result: [][]string{
+				{"1.2.3.12", "2001:db8::1"},
+			},
+		},
 		"EmptyOneHealthy": notifierTestCase{
 			changes: []nodeChange{
 				{typ: addChange, name: "node1", node: healthyNode1},
@@ -221,11 +242,16 @@ func TestNotifier(t *testing.T) {
 				initState = append(initState, node.Build(n))
 			}
 			client := fakekube.NewSimpleClientset(initState...)
-			notifier := newNotifierFromClient(client, time.Second, "")
+			notifier, err := newNotifierFromClient(client, time.Second, "")
+			if err != nil {
+				t.Fatal(err)
+			}
 			ctx, cancel := context.WithCancel(context.Background())
 			ipsChan := notifier.Notify(ctx)
 			go func(changes []nodeChange) {
 				defer cancel()
+				// nothing is forwarded once cancelled, even the initial IPs
+				<-time.After(50 * time.Millisecond)
 				tracker := client.Tracker()
 				for _, change := range changes {
 					curNode := change.node.Build(change.name)
@@ -238,9 +264,13 @@ func TestNotifier(t *testing.T) {
 					case deleteChange:
 						tracker.Delete(resource, "", change.name)
 					default:
-						t.Fatal("unknown change type")
+						// t.Fatal cannot stop the test from this goroutine
+						t.Error("unknown change type")
+						return
 					}
-					<-time.After(50 * time.Microsecond)
+					// leaves the informer the time to deliver the change before
+					// the next one and the final cancel, also under -race
+					<-time.After(50 * time.Millisecond)
 				}
 			}(testCase.changes)
 			assertChanOfStringList(t, testCase.result, ipsChan)
@@ -285,7 +315,10 @@ func testNotifier2(t *testing.T) {
 	client.AddProxyReactor("*", func(action testingkube.Action) (handled bool, ret restclient.ResponseWrapper, err error) {
 		panic(action)
 	})
-	notifier := newNotifierFromClient(client, time.Second, "")
+	notifier, err := newNotifierFromClient(client, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer func() {
 		cancel()
@@ -300,3 +333,441 @@ func testNotifier2(t *testing.T) {
 	case <-ctx.Done():
 	}
 }
+
+func TestNotifierInvalidSelector(t *testing.T) {
+	client := fakekube.NewSimpleClientset()
+	if _, err := newNotifierFromClient(client, time.Second, "role in (ingress"); err == nil {
+		t.Error("invalid selector accepted: expected an error but got <nil>")
+	}
+}
+
+func TestNotifyWithErrorsSelector(t *testing.T) {
+	ingress := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	worker := buildNode().
+		Label("role", "worker").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.5")
+	client := fakekube.NewSimpleClientset(ingress.Build("node1"), worker.Build("node2"))
+	notifier, err := newNotifierFromClient(client, time.Second, "role=ingress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	event := <-notifier.NotifyWithErrors(ctx)
+	if event.Err != nil {
+		t.Errorf("unexpected error: expected <nil> but got %v", event.Err)
+	}
+	if !helperEqual(event.IPs, []string{"1.2.3.4"}) {
+		t.Errorf("invalid IPs: expected [1.2.3.4] but got %v", event.IPs)
+	}
+}
+
+func TestNotifierSet(t *testing.T) {
+	ingress := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	worker := buildNode().
+		Label("role", "worker").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.5")
+	client := fakekube.NewSimpleClientset(ingress.Build("node1"), worker.Build("node2"))
+	set := newNotifierSetFromClient(client, time.Second)
+	ingresses, err := set.Notifier("role=ingress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workers, err := set.Notifier("role=worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ingressEvents, workerEvents := ingresses.NotifyWithErrors(ctx), workers.NotifyWithErrors(ctx)
+	if event := <-ingressEvents; !helperEqual(event.IPs, []string{"1.2.3.4"}) {
+		t.Errorf("invalid ingress IPs: expected [1.2.3.4] but got %v", event.IPs)
+	}
+	if event := <-workerEvents; !helperEqual(event.IPs, []string{"1.2.3.5"}) {
+		t.Errorf("invalid worker IPs: expected [1.2.3.5] but got %v", event.IPs)
+	}
+
+	// node2 moves to the ingress pool
+	moved := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.5")
+	client.Tracker().Update(v1.SchemeGroupVersion.WithResource("nodes"), moved.Build("node2"), "")
+	if event := <-ingressEvents; !helperEqual(event.IPs, []string{"1.2.3.4", "1.2.3.5"}) {
+		t.Errorf("invalid ingress IPs: expected [1.2.3.4 1.2.3.5] but got %v", event.IPs)
+	}
+	if event := <-workerEvents; len(event.IPs) != 0 || !helperEqual(event.Removed, []string{"1.2.3.5"}) {
+		t.Errorf("invalid worker change: expected 1.2.3.5 removed but got %+v", event.Change)
+	}
+	lists := 0
+	for _, action := range client.Actions() {
+		if action.Matches("list", "nodes") {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("nodes not shared: expected 1 list but got %d", lists)
+	}
+}
+
+func TestNotifyWithErrorsChanges(t *testing.T) {
+	zoned := buildNode().
+		Label("topology.kubernetes.io/zone", "eu-west-1a").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	legacyZoned := buildNode().
+		Label("failure-domain.beta.kubernetes.io/zone", "eu-west-1b").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.5")
+	client := fakekube.NewSimpleClientset(zoned.Build("node1"))
+	notifier, err := newNotifierFromClient(client, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := notifier.NotifyWithErrors(ctx)
+	first := <-events
+	if !helperEqual(first.Added, []string{"1.2.3.4"}) || len(first.Previous) != 0 || len(first.Removed) != 0 {
+		t.Errorf("invalid first change: expected [1.2.3.4] added but got %+v", first.Change)
+	}
+	if node := first.Nodes["1.2.3.4"]; node.Name != "node1" || node.Zone != "eu-west-1a" {
+		t.Errorf("invalid node of 1.2.3.4: expected node1 in eu-west-1a but got %+v", node)
+	}
+	resource := v1.SchemeGroupVersion.WithResource("nodes")
+	client.Tracker().Create(resource, legacyZoned.Build("node2"), "")
+	second := <-events
+	if !helperEqual(second.Previous, []string{"1.2.3.4"}) || !helperEqual(second.Added, []string{"1.2.3.5"}) || len(second.Removed) != 0 {
+		t.Errorf("invalid second change: expected [1.2.3.5] added but got %+v", second.Change)
+	}
+	if node := second.Nodes["1.2.3.5"]; node.Name != "node2" || node.Zone != "eu-west-1b" {
+		t.Errorf("invalid node of 1.2.3.5: expected node2 in eu-west-1b but got %+v", node)
+	}
+	client.Tracker().Delete(resource, "", "node1")
+	third := <-events
+	if !helperEqual(third.IPs, []string{"1.2.3.5"}) || len(third.Added) != 0 || !helperEqual(third.Removed, []string{"1.2.3.4"}) {
+		t.Errorf("invalid third change: expected [1.2.3.4] removed but got %+v", third.Change)
+	}
+	if _, exists := third.Nodes["1.2.3.4"]; exists {
+		t.Errorf("removed IP attributed: expected no node but got %+v", third.Nodes["1.2.3.4"])
+	}
+}
+
+func TestNodeListerSharedIP(t *testing.T) {
+	shared := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	client := fakekube.NewSimpleClientset(shared.Build("node2"), shared.Build("node1"))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	nodes := factory.Core().V1().Nodes()
+	informer := nodes.Informer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go informer.Run(ctx.Done())
+	cache.WaitForCacheSync(ctx.Done(), informer.HasSynced)
+	lister := &nodeLister{nodes.Lister(), []v1.NodeAddressType{v1.NodeExternalIP}, AllAddresses, AllFamilies}
+	ips, infos, err := lister.List(labels.Everything())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !helperEqual(ips, []string{"1.2.3.4"}) {
+		t.Errorf("invalid IPs: expected [1.2.3.4] but got %v", ips)
+	}
+	if node := infos["1.2.3.4"]; node.Name != "node1" || node.Labels["role"] != "ingress" {
+		t.Errorf("invalid node of 1.2.3.4: expected the ingress node1 but got %+v", node)
+	}
+}
+
+type failingNodeLister struct {
+	corelisters.NodeLister
+	err error
+}
+
+func (l *failingNodeLister) List(selector labels.Selector) ([]*v1.Node, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.NodeLister.List(selector)
+}
+
+func TestNotifierRecovered(t *testing.T) {
+	ingress := buildNode().
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	client := fakekube.NewSimpleClientset(ingress.Build("node1"))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	nodes := factory.Core().V1().Nodes()
+	informer := nodes.Informer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go informer.Run(ctx.Done())
+	cache.WaitForCacheSync(ctx.Done(), informer.HasSynced)
+	failing := &failingNodeLister{NodeLister: nodes.Lister()}
+	n := &notifier{
+		lister:   &nodeLister{failing, []v1.NodeAddressType{v1.NodeExternalIP}, AllAddresses, AllFamilies},
+		selector: labels.Everything(),
+	}
+	events := make(chan Event, 4)
+	n.sendIPs(ctx, events)
+	failing.err = errors.New("forbidden")
+	n.sendIPs(ctx, events)
+	failing.err = nil
+	n.sendIPs(ctx, events)
+	n.sendIPs(ctx, events)
+	close(events)
+	received := []Event{}
+	for event := range events {
+		received = append(received, event)
+	}
+	if len(received) != 3 {
+		t.Fatalf("invalid events: expected a change, an error and a recovery but got %+v", received)
+	}
+	if received[1].Err == nil {
+		t.Errorf("listing error not sent: expected an error but got %+v", received[1])
+	}
+	if recovered := received[2]; !recovered.Recovered || recovered.Err != nil || !helperEqual(recovered.IPs, []string{"1.2.3.4"}) || len(recovered.Added) != 0 {
+		t.Errorf("invalid recovery: expected the unchanged [1.2.3.4] recovered but got %+v", recovered)
+	}
+}
+
+func TestNotifierNotSynced(t *testing.T) {
+	client := fakekube.NewSimpleClientset(healthyNode1.Build("node1"))
+	client.PrependReactor("list", "nodes", func(action testingkube.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+	notifier, err := newNotifierFromClient(client, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	for event := range notifier.NotifyWithErrors(ctx) {
+		t.Errorf("event before the sync: expected none but got %+v", event)
+	}
+}
+
+func TestForwardIPsStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan Event, 2)
+	events <- Event{Change: Change{IPs: []string{"1.2.3.4"}}}
+	events <- Event{Change: Change{IPs: []string{"1.2.3.5"}}}
+	close(events)
+	cancel()
+	for ips := range forwardIPs(ctx, events) {
+		t.Errorf("IPs forwarded once stopped: expected none but got %v", ips)
+	}
+}
+
+type nodeAddressesTestCase struct {
+	node   *nodeBuilder
+	types  []v1.NodeAddressType
+	policy AddressPolicy
+	family AddressFamily
+	result []string
+}
+
+func TestNodeAddresses(t *testing.T) {
+	privateNode := buildNode().
+		Address(v1.NodeInternalIP, "10.0.0.1").
+		Address(v1.NodeInternalIP, "10.0.0.2").
+		Address(v1.NodeHostName, "node1")
+	testCases := map[string]nodeAddressesTestCase{
+		"AllExternal": {
+			node:   healthyInternalAddressesNode,
+			types:  []v1.NodeAddressType{v1.NodeExternalIP},
+			policy: AllAddresses,
+			result: []string{"1.2.3.10"},
+		},
+		"AllTypes": {
+			node:   healthyInternalAddressesNode,
+			types:  []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP},
+			policy: AllAddresses,
+			result: []string{"1.2.3.11", "1.2.3.10"},
+		},
+		"NoExternal": {
+			node:   privateNode,
+			types:  []v1.NodeAddressType{v1.NodeExternalIP},
+			policy: AllAddresses,
+			result: nil,
+		},
+		"FirstMatch": {
+			node:   privateNode,
+			types:  []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP},
+			policy: FirstAddress,
+			result: []string{"10.0.0.1"},
+		},
+		"Fallback": {
+			node:   privateNode,
+			types:  []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP, v1.NodeHostName},
+			policy: FallbackAddresses,
+			result: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		"FallbackPreferred": {
+			node:   healthyInternalAddressesNode,
+			types:  []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP},
+			policy: FallbackAddresses,
+			result: []string{"1.2.3.10"},
+		},
+		"DualStackFirstIPv6": {
+			node:   dualStackNode,
+			types:  []v1.NodeAddressType{v1.NodeExternalIP},
+			policy: FirstAddress,
+			family: IPv6,
+			result: []string{"2001:db8::1"},
+		},
+		"DualStackIPv4": {
+			node:   dualStackNode,
+			types:  []v1.NodeAddressType{v1.NodeExternalIP},
+			policy: AllAddresses,
+			family: IPv4,
+			result: []string{"1.2.3.12"},
+		},
+		"DualStackAll": {
+			node:   dualStackNode,
+			types:  []v1.NodeAddressType{v1.NodeExternalIP},
+			policy: AllAddresses,
+			result: []string{"1.2.3.12", "2001:db8::1"},
+		},
+		"HostnameIgnoredByFamily": {
+			node:   privateNode,
+			types:  []v1.NodeAddressType{v1.NodeHostName},
+			policy: AllAddresses,
+			family: IPv4,
+			result: nil,
+		},
+		"Hostname": {
+			node:   privateNode,
+			types:  []v1.NodeAddressType{v1.NodeHostName},
+			policy: AllAddresses,
+			result: []string{"node1"},
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			n := &node{testCase.node.Build(name)}
+			res := n.Addresses(testCase.types, testCase.policy, testCase.family)
+			if !helperEqual(res, testCase.result) {
+				t.Errorf("invalid addresses: expected %v but got %v", testCase.result, res)
+			}
+		})
+	}
+}
+
+func TestNotifierInvalidAddressTypes(t *testing.T) {
+	client := fakekube.NewSimpleClientset()
+	if _, err := newNotifierFromClient(client, time.Second, "", WithAddressTypes(AllAddresses)); err == nil {
+		t.Error("empty address types accepted: expected an error but got <nil>")
+	}
+	if _, err := newNotifierFromClient(client, time.Second, "", WithAddressTypes(AllAddresses, "PublicIP")); err == nil {
+		t.Error("unknown address type accepted: expected an error but got <nil>")
+	}
+}
+
+type ipFamilyTestCase struct {
+	addr   string
+	family AddressFamily
+	ok     bool
+}
+
+func TestIPFamily(t *testing.T) {
+	testCases := map[string]ipFamilyTestCase{
+		"IPv4":       {addr: "1.2.3.4", family: IPv4, ok: true},
+		"IPv6":       {addr: "2001:db8::1", family: IPv6, ok: true},
+		"IPv4Mapped": {addr: "::ffff:1.2.3.4", family: IPv4, ok: true},
+		"Hostname":   {addr: "node1.example.com", ok: false},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			family, ok := IPFamily(testCase.addr)
+			if ok != testCase.ok || (ok && family != testCase.family) {
+				t.Errorf("invalid family: expected %v,%v but got %v,%v", testCase.family, testCase.ok, family, ok)
+			}
+		})
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	calls := make(chan time.Time, 10)
+	d := newDebouncer(30*time.Millisecond, 0, func() { calls <- time.Now() })
+	defer d.Stop()
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		d.Trigger()
+		<-time.After(10 * time.Millisecond)
+	}
+	select {
+	case call := <-calls:
+		if elapsed := call.Sub(start); elapsed < 70*time.Millisecond {
+			t.Errorf("called before the quiet period: after %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("never called")
+	}
+	select {
+	case <-calls:
+		t.Error("called more than once")
+	case <-time.After(60 * time.Millisecond):
+	}
+}
+
+func TestDebouncerMaxWait(t *testing.T) {
+	calls := make(chan time.Time, 10)
+	d := newDebouncer(50*time.Millisecond, 100*time.Millisecond, func() { calls <- time.Now() })
+	start := time.Now()
+	stop := time.After(300 * time.Millisecond)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			d.Trigger()
+		case <-stop:
+			break loop
+		}
+	}
+	d.Stop()
+	count := len(calls)
+	if count > 0 {
+		if first := <-calls; first.Sub(start) > 200*time.Millisecond {
+			t.Errorf("max wait ignored: first call after %s", first.Sub(start))
+		}
+	}
+	if count < 2 {
+		t.Errorf("max wait ignored: expected at least 2 calls but got %v", count)
+	}
+}
+
+func TestNotifierDebounce(t *testing.T) {
+	client := fakekube.NewSimpleClientset(healthyNode1.Build("node1"))
+	notifier, err := newNotifierFromClient(client, time.Second, "", WithDebounce(100*time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ipsChan := notifier.Notify(ctx)
+	go func() {
+		defer cancel()
+		tracker := client.Tracker()
+		resource := v1.SchemeGroupVersion.WithResource("nodes")
+		tracker.Create(resource, healthyNode2.Build("node2"), "")
+		<-time.After(10 * time.Millisecond)
+		tracker.Create(resource, healthyMultiConditionsNode.Build("node3"), "")
+		<-time.After(10 * time.Millisecond)
+		tracker.Delete(resource, "", "node1")
+		<-time.After(300 * time.Millisecond)
+	}()
+	assertChanOfStringList(t, [][]string{
+		{"1.2.3.4"},
+		{"1.2.3.5", "1.2.3.6"},
+	}, ipsChan)
+}
@@ -0,0 +1,120 @@
+package ip8s
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+type ActionKind string
+
+const (
+	CreateAction ActionKind = "create"
+	UpdateAction ActionKind = "update"
+	DeleteAction ActionKind = "delete"
+	SendAction   ActionKind = "send"
+	// BroadcastAction is used for the broadcasters that cannot detail what
+	// they would do.
+	BroadcastAction ActionKind = "broadcast"
+)
+
+// Action is a single change a broadcaster would apply, e.g. the creation
+// of a record (Target "A example.com", Value "1.2.3.4") or a message (Target
+// "slack C123", Value the message).
+type Action struct {
+	Kind   ActionKind
+	Target string
+	Value  string
+}
+
+func (a Action) String() string {
+	return fmt.Sprintf("%s %s: %s", a.Kind, a.Target, a.Value)
+}
+
+type Plan []Action
+
+func (p Plan) String() string {
+	actions := make([]string, len(p))
+	for i, action := range p {
+		actions[i] = action.String()
+	}
+	return strings.Join(actions, "\n")
+}
+
+// Planner is implemented by the broadcasters able to tell what a broadcast
+// would do without doing it.
+type Planner interface {
+	Plan(ctx context.Context, ips []string) (Plan, error)
+}
+
+// PlanBroadcast returns the plan of b, or a single BroadcastAction when b
+// is not a Planner.
+func PlanBroadcast(ctx context.Context, b Broadcaster, ips []string) (Plan, error) {
+	if planner, ok := b.(Planner); ok {
+		return planner.Plan(ctx, ips)
+	}
+	return Plan{{Kind: BroadcastAction, Target: fmt.Sprintf("%T", b), Value: strings.Join(ips, " ")}}, nil
+}
+
+// ChangePlanner is implemented by the planners whose plan depends on the
+// added and removed IPs and on the nodes of the change.
+type ChangePlanner interface {
+	PlanChange(ctx context.Context, change Change) (Plan, error)
+}
+
+// PlanBroadcastChange returns the plan of the change with b when it is a
+// ChangePlanner, the plan of the new IPs otherwise.
+func PlanBroadcastChange(ctx context.Context, b Broadcaster, change Change) (Plan, error) {
+	if planner, ok := b.(ChangePlanner); ok {
+		return planner.PlanChange(ctx, change)
+	}
+	return PlanBroadcast(ctx, b, change.IPs)
+}
+
+type dryRunBroadcaster struct {
+	broadcaster Broadcaster
+	logger      *log.Logger
+}
+
+// NewDryRunBroadcaster logs the plan of b instead of broadcasting (to stderr
+// when logger is nil).
+func NewDryRunBroadcaster(b Broadcaster, logger *log.Logger) Broadcaster {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return dryRunBroadcaster{b, logger}
+}
+
+func (b dryRunBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	return PlanBroadcast(ctx, b.broadcaster, ips)
+}
+
+func (b dryRunBroadcaster) PlanChange(ctx context.Context, change Change) (Plan, error) {
+	return PlanBroadcastChange(ctx, b.broadcaster, change)
+}
+
+func (b dryRunBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	return b.BroadcastChange(ctx, Change{IPs: ips})
+}
+
+func (b dryRunBroadcaster) caughtUp() Broadcaster {
+	return dryRunBroadcaster{caughtUp(b.broadcaster), b.logger}
+}
+
+// BroadcastChange logs the plan of the change, with the added and removed
+// IPs the broadcast would use.
+func (b dryRunBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	plan, err := b.PlanChange(ctx, change)
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		b.logger.Print("dry-run: nothing to do")
+	}
+	for _, action := range plan {
+		b.logger.Printf("dry-run: %s", action)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package ip8s
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+)
+
+type recordingBroadcaster struct {
+	broadcasts [][]string
+	err        error
+}
+
+func (b *recordingBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	b.broadcasts = append(b.broadcasts, ips)
+	return b.err
+}
+
+func TestCloudflarePlan(t *testing.T) {
+	fake, api := helperCloudflare(t, "example.com")
+	defer fake.Close()
+	fake.AddRecord("A", "example.com", "1.2.3.4")
+	fake.AddRecord("A", "example.com", "1.2.3.5")
+	b, err := NewCloudflareDNSBroadcaster(api, "example.com", CloudflareTTL(300), CloudflareAddressFamily(AllFamilies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := b.(Planner).Plan(context.Background(), []string{"1.2.3.5", "1.2.3.6", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("plan failed: expected <nil> but got %v", err)
+	}
+	expected := Plan{
+		{Kind: CreateAction, Target: "A example.com", Value: "1.2.3.6"},
+		{Kind: UpdateAction, Target: "A example.com", Value: "1.2.3.5"},
+		{Kind: DeleteAction, Target: "A example.com", Value: "1.2.3.4"},
+		{Kind: CreateAction, Target: "AAAA example.com", Value: "2001:db8::1"},
+	}
+	if plan.String() != expected.String() {
+		t.Errorf("invalid plan: expected\n%v\nbut got\n%v", expected, plan)
+	}
+	if res := fake.Contents("example.com"); !helperEqual(res, []string{"A 1.2.3.4", "A 1.2.3.5"}) {
+		t.Errorf("records changed by the plan: %v", res)
+	}
+}
+
+func TestDryRunBroadcaster(t *testing.T) {
+	slackBroadcaster, err := NewSlackBroadcaster("xoxb", "C123", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingBroadcaster{}
+	output := &bytes.Buffer{}
+	b := NewDryRunBroadcaster(NewMultiBroadcaster(slackBroadcaster, recorder), log.New(output, "", 0))
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("dry-run failed: expected <nil> but got %v", err)
+	}
+	if len(recorder.broadcasts) != 0 {
+		t.Errorf("dry-run broadcasted: %v", recorder.broadcasts)
+	}
+	expected := []string{
+		"dry-run: send slack C123: IPs for example.com changed:",
+		"_1.2.3.4_",
+		"dry-run: broadcast *ip8s.recordingBroadcaster: 1.2.3.4",
+	}
+	if lines := strings.Split(strings.TrimSpace(output.String()), "\n"); !helperEqual(lines, expected) {
+		t.Errorf("invalid dry-run output: expected %q but got %q", expected, lines)
+	}
+}
+
+func TestDryRunBroadcasterChange(t *testing.T) {
+	slackBroadcaster, err := NewSlackBroadcaster("xoxb", "C123", "example.com",
+		SlackTemplate(`added {{ join " " .Added }}, removed {{ join " " .Removed }}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	b := NewDryRunBroadcaster(NewMultiBroadcaster(slackBroadcaster), log.New(output, "", 0))
+	change := Change{IPs: []string{"1.2.3.4", "1.2.3.5"}, Added: []string{"1.2.3.5"}, Removed: []string{"1.2.3.6"}}
+	if err := BroadcastChange(context.Background(), b, change); err != nil {
+		t.Fatalf("dry-run failed: expected <nil> but got %v", err)
+	}
+	expected := "dry-run: send slack C123: added 1.2.3.5, removed 1.2.3.6"
+	if line := strings.TrimSpace(output.String()); line != expected {
+		t.Errorf("invalid dry-run output: expected %q but got %q", expected, line)
+	}
+}
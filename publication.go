@@ -0,0 +1,779 @@
+package ip8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// NodeIPPublicationResource is the resource of the NodeIPPublication custom
+// resources, defined in deploy/crd.yaml.
+var NodeIPPublicationResource = schema.GroupVersionResource{
+	Group:    "ip8s.max4t.github.io",
+	Version:  "v1alpha1",
+	Resource: "nodeippublications",
+}
+
+// NodeIPPublicationSpec publishes the IPs of the nodes matching
+// NodeSelector under DNSName, which overrides the dnsName of the
+// broadcasters.
+type NodeIPPublicationSpec struct {
+	NodeSelector  string              `json:"nodeSelector,omitempty"`
+	AddressTypes  []string            `json:"addressTypes,omitempty"`
+	AddressPolicy string              `json:"addressPolicy,omitempty"`
+	AddressFamily string              `json:"addressFamily,omitempty"`
+	DNSName       string              `json:"dnsName"`
+	SecretRef     *SecretReference    `json:"secretRef,omitempty"`
+	Broadcasters  []BroadcasterConfig `json:"broadcasters"`
+}
+
+// SecretReference names a Secret of the namespace of the publication, the
+// ${KEY} references in the broadcasters are replaced by its keys so that
+// the credentials stay out of the spec.
+type SecretReference struct {
+	Name string `json:"name"`
+}
+
+var secretResource = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+// secretKeyReference matches the ${KEY} references of the keys of a Secret.
+var secretKeyReference = regexp.MustCompile(`\$\{([-._a-zA-Z0-9]+)\}`)
+
+// NodeIPPublicationStatus reports the last published IPs and the
+// PublishedCondition.
+type NodeIPPublicationStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	IPs                []string           `json:"ips,omitempty"`
+	PublishedAt        *metav1.Time       `json:"publishedAt,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// PublishedCondition is true once the IPs were broadcast by all the
+// broadcasters of the publication.
+const PublishedCondition = "Published"
+
+// The reasons of the PublishedCondition.
+const (
+	PublishedReason       = "Published"
+	InvalidSpecReason     = "InvalidSpec"
+	ListFailedReason      = "ListFailed"
+	BroadcastFailedReason = "BroadcastFailed"
+)
+
+// PublicationController reconciles the NodeIPPublications with a notifier
+// and broadcasters per publication, restarted when its spec changes.
+type PublicationController struct {
+	client          dynamic.Interface
+	set             *NotifierSet
+	namespace       string
+	resync          time.Duration
+	notifierOptions []NotifierOption
+	deliveryOptions []DeliveryOption
+	metrics         *Metrics
+	store           StateStore
+	status          *Status
+	elector         *LeaderElector
+	dryRun          bool
+	logger          *log.Logger
+	now             func() time.Time
+
+	// the lister and the queue are set by Run
+	publicationLister cache.GenericLister
+	queue             workqueue.RateLimitingInterface
+	done              <-chan struct{}
+
+	// secrets watches the Secrets of the namespaces of the publications
+	// referencing one, started on demand
+	secretsLock sync.Mutex
+	secrets     map[string]informers.GenericInformer
+
+	l sync.Mutex
+	// leadership counts the takeovers of the replica, the publications
+	// started before the last one are restarted
+	leadership   int
+	publications map[string]*publication
+}
+
+type publication struct {
+	// spec is the raw spec the publication runs
+	spec       interface{}
+	generation int64
+	// secret and secretVersion identify the version of the referenced
+	// Secret the publication runs, if any
+	secret        string
+	secretVersion string
+	// leadership is the takeover the publication was started after
+	leadership int
+	// restarted is set when the publication replaces a running one with
+	// the same spec, for a new leader or a new version of its Secret
+	restarted   bool
+	notifier    Notifier
+	broadcaster Broadcaster
+	cancel      context.CancelFunc
+	// done is closed once the publication stopped broadcasting
+	done chan struct{}
+}
+
+type PublicationOption func(*PublicationController)
+
+// PublicationNamespace only watches the publications of namespace (default:
+// all the namespaces).
+func PublicationNamespace(namespace string) PublicationOption {
+	return func(c *PublicationController) {
+		c.namespace = namespace
+	}
+}
+
+// PublicationResync sets the resync period of the publication informer
+// (default: 30s).
+func PublicationResync(resync time.Duration) PublicationOption {
+	return func(c *PublicationController) {
+		c.resync = resync
+	}
+}
+
+// PublicationNotifierOptions are applied to the notifiers of all the
+// publications (e.g. WithDebounce), before the address options of their
+// spec.
+func PublicationNotifierOptions(opts ...NotifierOption) PublicationOption {
+	return func(c *PublicationController) {
+		c.notifierOptions = append(c.notifierOptions, opts...)
+	}
+}
+
+// PublicationDeliveryOptions are applied to the deliveries of all the
+// publications (e.g. DeliveryBackoff).
+func PublicationDeliveryOptions(opts ...DeliveryOption) PublicationOption {
+	return func(c *PublicationController) {
+		c.deliveryOptions = append(c.deliveryOptions, opts...)
+	}
+}
+
+// PublicationMetrics instruments the notifiers and the broadcasters of the
+// publications.
+func PublicationMetrics(m *Metrics) PublicationOption {
+	return func(c *PublicationController) {
+		c.metrics = m
+	}
+}
+
+// PublicationStateStore saves the IPs last broadcast by the broadcasters of
+// the publications, named after the publication, their type and index
+// (e.g. "default/app/cloudflare#0").
+func PublicationStateStore(store StateStore) PublicationOption {
+	return func(c *PublicationController) {
+		c.store = store
+	}
+}
+
+// PublicationStatus records the outcome of the broadcasts of the
+// publications in s, under the names of PublicationStateStore.
+func PublicationStatus(s *Status) PublicationOption {
+	return func(c *PublicationController) {
+		c.status = s
+	}
+}
+
+// PublicationLeaderElector only broadcasts and updates the status of the
+// publications while e leads, they are restarted when it takes over.
+func PublicationLeaderElector(e *LeaderElector) PublicationOption {
+	return func(c *PublicationController) {
+		c.elector = e
+	}
+}
+
+// PublicationDryRun logs what the broadcasters of the publications would
+// do instead of doing it.
+func PublicationDryRun() PublicationOption {
+	return func(c *PublicationController) {
+		c.dryRun = true
+	}
+}
+
+// PublicationLogger logs the reconciliations (default: stderr).
+func PublicationLogger(logger *log.Logger) PublicationOption {
+	return func(c *PublicationController) {
+		c.logger = logger
+	}
+}
+
+// NewPublicationController creates the notifiers of the publications with
+// set.
+func NewPublicationController(client dynamic.Interface, set *NotifierSet, opts ...PublicationOption) (*PublicationController, error) {
+	c := &PublicationController{
+		client:       client,
+		set:          set,
+		resync:       defaultResync,
+		logger:       log.New(os.Stderr, "", log.LstdFlags),
+		now:          time.Now,
+		publications: map[string]*publication{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.resync < 0 {
+		return nil, errors.Errorf("invalid resync duration %s", c.resync)
+	}
+	if _, err := newNotifierSettings(c.notifierOptions); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// publicationWorkers is the number of publications reconciled concurrently.
+const publicationWorkers = 4
+
+// Run watches the publications until ctx is done.
+func (c *PublicationController) Run(ctx context.Context) {
+	c.set.Start(ctx.Done())
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "nodeippublications")
+	go func() {
+		<-ctx.Done()
+		queue.ShutDown()
+	}()
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.client, c.resync, c.namespace, nil)
+	publications := factory.ForResource(NodeIPPublicationResource)
+	c.publicationLister, c.queue, c.done = publications.Lister(), queue, ctx.Done()
+	enqueue := func(obj interface{}) {
+		if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			queue.Add(key)
+		}
+	}
+	publications.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			enqueue(newObj)
+		},
+		DeleteFunc: enqueue,
+	})
+	if c.elector != nil {
+		c.elector.OnLeading(func(leading context.Context) {
+			c.l.Lock()
+			c.leadership++
+			c.l.Unlock()
+			for _, key := range publications.Informer().GetStore().ListKeys() {
+				queue.Add(key)
+			}
+		})
+	}
+	factory.Start(ctx.Done())
+	if cache.WaitForCacheSync(ctx.Done(), publications.Informer().HasSynced) {
+		w := sync.WaitGroup{}
+		w.Add(publicationWorkers)
+		for i := 0; i < publicationWorkers; i++ {
+			go func() {
+				defer w.Done()
+				for c.work(ctx, queue) {
+				}
+			}()
+		}
+		w.Wait()
+	}
+	<-ctx.Done()
+	c.l.Lock()
+	keys := make([]string, 0, len(c.publications))
+	for key := range c.publications {
+		keys = append(keys, key)
+	}
+	c.l.Unlock()
+	for _, key := range keys {
+		c.stop(key)
+	}
+}
+
+// watchSecrets returns the informer of the Secrets of namespace, started
+// on the first call. The changes of a Secret restart the publications
+// referencing it.
+func (c *PublicationController) watchSecrets(namespace string) informers.GenericInformer {
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	if secrets, exists := c.secrets[namespace]; exists {
+		return secrets
+	}
+	if c.secrets == nil {
+		c.secrets = map[string]informers.GenericInformer{}
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.client, c.resync, namespace, nil)
+	secrets := factory.ForResource(secretResource)
+	enqueueReferencing := func(obj interface{}) {
+		for _, key := range c.referencing(obj) {
+			c.queue.Add(key)
+		}
+	}
+	secrets.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueueReferencing,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			enqueueReferencing(newObj)
+		},
+		DeleteFunc: enqueueReferencing,
+	})
+	factory.Start(c.done)
+	c.secrets[namespace] = secrets
+	return secrets
+}
+
+// referencing returns the keys of the publications referencing the Secret
+// obj.
+func (c *PublicationController) referencing(obj interface{}) []string {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return nil
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil
+	}
+	publications, err := c.publicationLister.ByNamespace(namespace).List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	keys := []string{}
+	for _, obj := range publications {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		if secret, _, _ := unstructured.NestedString(u.Object, "spec", "secretRef", "name"); secret == name {
+			keys = append(keys, namespace+"/"+u.GetName())
+		}
+	}
+	return keys
+}
+
+// work reconciles the next publication of queue, it returns false once
+// queue is shut down. The failed reconciliations are retried with a
+// backoff.
+func (c *PublicationController) work(ctx context.Context, queue workqueue.RateLimitingInterface) bool {
+	key, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	defer queue.Done(key)
+	if err := c.sync(ctx, key.(string)); err != nil {
+		queue.AddRateLimited(key)
+		return true
+	}
+	queue.Forget(key)
+	return true
+}
+
+// stop stops the publication of key and waits for its last broadcast, for
+// the status and the metrics of its notifier and broadcasters to be
+// forgotten.
+func (c *PublicationController) stop(key string) {
+	c.l.Lock()
+	p, exists := c.publications[key]
+	delete(c.publications, key)
+	c.l.Unlock()
+	if !exists || p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+	if c.status != nil {
+		c.status.forget(key + "/")
+	}
+	c.metrics.forget(key)
+}
+
+// sync restarts the publication of key when its spec, its Secret or the
+// leadership changed, and stops it once deleted. The queue never syncs a
+// key concurrently. It returns the transient failures, e.g. to read the
+// Secret, to be synced again.
+func (c *PublicationController) sync(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil
+	}
+	obj, err := c.publicationLister.ByNamespace(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		c.stop(key)
+		return nil
+	}
+	if err != nil {
+		c.logger.Printf("publication %s: failed to read it: %v", key, err)
+		return err
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		c.logger.Printf("publication %s: invalid object %T", key, obj)
+		return nil
+	}
+	spec := runtime.DeepCopyJSONValue(u.Object["spec"])
+	secret, secretVersion := c.secretVersion(ctx, namespace, spec)
+	c.l.Lock()
+	leadership := c.leadership
+	p, exists := c.publications[key]
+	c.l.Unlock()
+	// the updates of the status are ignored
+	if exists && reflect.DeepEqual(p.spec, spec) && p.secretVersion == secretVersion && p.leadership == leadership {
+		return nil
+	}
+
+	// a new spec may add broadcasters which never received the IPs
+	restarted := exists && p.cancel != nil && reflect.DeepEqual(p.spec, spec)
+	c.stop(key)
+	generation := u.GetGeneration()
+	p, err = c.publication(ctx, key, spec)
+	if err != nil {
+		c.logger.Printf("publication %s: %v", key, err)
+		c.updateStatus(ctx, key, generation, func(status *NodeIPPublicationStatus) {
+			c.setCondition(status, generation, metav1.ConditionFalse, InvalidSpecReason, err.Error())
+		})
+		if errors.As(err, &secretReadError{}) {
+			return err
+		}
+		c.l.Lock()
+		// remembered to only report it once
+		c.publications[key] = &publication{spec: spec, generation: generation, secret: secret, secretVersion: secretVersion, leadership: leadership}
+		c.l.Unlock()
+		return nil
+	}
+	p.generation, p.leadership, p.restarted = generation, leadership, restarted
+	var publicationCtx context.Context
+	publicationCtx, p.cancel = context.WithCancel(ctx)
+	p.done = make(chan struct{})
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.publications[key] = p
+	go c.publish(publicationCtx, key, p)
+	return nil
+}
+
+// parsePublicationSpec rejects the unknown fields, like ParseConfig.
+func parsePublicationSpec(raw interface{}) (NodeIPPublicationSpec, error) {
+	spec := NodeIPPublicationSpec{}
+	content, err := json.Marshal(raw)
+	if err != nil {
+		return spec, errors.Wrap(err, "invalid spec")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return spec, errors.Wrap(err, "invalid spec")
+	}
+	return spec, nil
+}
+
+// secretVersion returns the name of the Secret referenced by the raw spec
+// of a publication of namespace, and its version if it exists.
+func (c *PublicationController) secretVersion(ctx context.Context, namespace string, raw interface{}) (string, string) {
+	spec, err := parsePublicationSpec(raw)
+	if err != nil || spec.SecretRef == nil {
+		return "", ""
+	}
+	_, version, _ := c.secret(ctx, namespace, spec.SecretRef.Name)
+	return spec.SecretRef.Name, version
+}
+
+// secretReadError is a failure to read a Secret, retried with a backoff.
+type secretReadError struct {
+	error
+}
+
+func (e secretReadError) Unwrap() error {
+	return e.error
+}
+
+// secret returns the data of the Secret and its version, read from the
+// API until the Secrets of namespace are synced, so that the publications
+// do not wait for them.
+func (c *PublicationController) secret(ctx context.Context, namespace, name string) (map[string]string, string, error) {
+	var obj runtime.Object
+	var err error
+	if secrets := c.watchSecrets(namespace); secrets.Informer().HasSynced() {
+		obj, err = secrets.Lister().ByNamespace(namespace).Get(name)
+	} else {
+		obj, err = c.client.Resource(secretResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, "", secretReadError{errors.Wrapf(err, "failed to read the secret %s", name)}
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, "", errors.Errorf("invalid secret %s", name)
+	}
+	encoded, _, err := unstructured.NestedStringMap(u.Object, "data")
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "invalid secret %s", name)
+	}
+	data := make(map[string]string, len(encoded))
+	for key, value := range encoded {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "invalid key %s of the secret %s", key, name)
+		}
+		data[key] = string(decoded)
+	}
+	return data, u.GetResourceVersion(), nil
+}
+
+// expandSecret replaces the ${KEY} references of the strings of value with
+// the keys of the secret.
+func expandSecret(value interface{}, data map[string]string) (interface{}, error) {
+	return expandStrings(value, func(s string) (string, error) {
+		var err error
+		expanded := secretKeyReference.ReplaceAllStringFunc(s, func(ref string) string {
+			key := secretKeyReference.FindStringSubmatch(ref)[1]
+			secret, exists := data[key]
+			if !exists && err == nil {
+				err = errors.Errorf("undefined key %s of the secret", key)
+			}
+			return secret
+		})
+		return expanded, err
+	})
+}
+
+// resolveSecret returns the spec with the broadcasters referencing the
+// keys of its Secret, and the version of the Secret.
+func (c *PublicationController) resolveSecret(ctx context.Context, namespace string, raw interface{}, spec NodeIPPublicationSpec) (NodeIPPublicationSpec, string, error) {
+	data, version, err := c.secret(ctx, namespace, spec.SecretRef.Name)
+	if err != nil {
+		return spec, "", err
+	}
+	expanded := runtime.DeepCopyJSONValue(raw).(map[string]interface{})
+	if expanded["broadcasters"], err = expandSecret(expanded["broadcasters"], data); err != nil {
+		return spec, "", err
+	}
+	spec, err = parsePublicationSpec(expanded)
+	return spec, version, err
+}
+
+// validateCredentials requires the broadcasters of the spec to read their
+// credentials from its Secret. Whoever creates a publication must not
+// broadcast with the credentials of the controller: the default AWS
+// credentials chain of route53 (e.g. its IAM role), the unsigned updates an
+// RFC 2136 server would accept from its address or the mails an SMTP relay
+// would accept from it without authentication.
+func validateCredentials(spec NodeIPPublicationSpec) error {
+	for i, conf := range spec.Broadcasters {
+		switch {
+		case conf.Type == "route53" && conf.Route53 != nil && conf.Route53.AccessKeyID == "":
+			return errors.Errorf("invalid broadcaster #%d: route53.accessKeyID is required, the credentials of the controller cannot be used", i)
+		case conf.Type == "rfc2136" && conf.RFC2136 != nil && conf.RFC2136.TSIGKey == "":
+			return errors.Errorf("invalid broadcaster #%d: rfc2136.tsigKey is required, the updates must be signed", i)
+		case conf.Type == "email" && conf.Email != nil && (conf.Email.Auth == "" || conf.Email.Password == ""):
+			return errors.Errorf("invalid broadcaster #%d: email.auth and email.password are required, the server must be authenticated against", i)
+		}
+		for _, cred := range conf.credentials() {
+			if cred.value == "" {
+				continue
+			}
+			if spec.SecretRef == nil || secretKeyReference.FindString(cred.value) != cred.value {
+				return errors.Errorf("invalid broadcaster #%d: %s must be a ${KEY} reference to the secretRef", i, cred.field)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *PublicationController) publication(ctx context.Context, key string, raw interface{}) (*publication, error) {
+	spec, err := parsePublicationSpec(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCredentials(spec); err != nil {
+		return nil, err
+	}
+	var secretVersion string
+	if spec.SecretRef != nil {
+		namespace, _, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if spec, secretVersion, err = c.resolveSecret(ctx, namespace, raw, spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateDNSName(spec.DNSName); err != nil {
+		return nil, err
+	}
+	if len(spec.Broadcasters) == 0 {
+		return nil, errors.New("no broadcaster configured")
+	}
+	addressOpts, err := addressOptions(spec.AddressTypes, spec.AddressPolicy, spec.AddressFamily)
+	if err != nil {
+		return nil, err
+	}
+	opts := append(append([]NotifierOption{}, c.notifierOptions...), addressOpts...)
+	if c.metrics != nil {
+		opts = append(opts, WithMetrics(c.metrics), WithMetricsName(key))
+	}
+	notifier, err := c.set.Notifier(spec.NodeSelector, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var confs []namedBroadcasterConfig
+	for i, conf := range spec.Broadcasters {
+		conf = conf.withDNSName(spec.DNSName)
+		if err := conf.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid broadcaster #%d", i)
+		}
+		confs = append(confs, namedBroadcasterConfig{fmt.Sprintf("%s/%s#%d", key, conf.Type, i), conf}.perURL()...)
+	}
+	targets := make([]NamedBroadcaster, 0, len(confs))
+	for _, conf := range confs {
+		name := conf.name
+		broadcaster, err := conf.broadcaster(name, c.metrics)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid broadcaster %s", name)
+		}
+		if c.store != nil {
+			broadcaster = NewStatefulBroadcaster(broadcaster, name, c.store, StatefulLogger(c.logger))
+		}
+		if c.status != nil {
+			broadcaster = NewStatusBroadcaster(broadcaster, name, c.status)
+		}
+		// like the rules, without the saved IPs the notifications would be
+		// sent again on every restart
+		noCatchUp := c.store == nil && conf.notification()
+		targets = append(targets, NamedBroadcaster{Name: name, Broadcaster: broadcaster, NoCatchUp: noCatchUp})
+	}
+	p := &publication{spec: raw, notifier: notifier, broadcaster: NewNamedMultiBroadcaster(targets...), secretVersion: secretVersion}
+	if c.dryRun {
+		p.broadcaster = NewDryRunBroadcaster(p.broadcaster, c.logger)
+	}
+	if c.elector != nil {
+		// the new leader restarts the publications to catch up
+		p.broadcaster = c.elector.gate(p.broadcaster)
+	}
+	if spec.SecretRef != nil {
+		p.secret = spec.SecretRef.Name
+	}
+	return p, nil
+}
+
+// publish broadcasts the IPs of the publication until ctx is done.
+func (c *PublicationController) publish(ctx context.Context, key string, p *publication) {
+	defer close(p.done)
+	// broadcastErr is the outcome of the last delivery
+	var broadcastErr error
+	opts := append(append([]DeliveryOption{}, c.deliveryOptions...),
+		DeliveryEventHandler(func(event Event) {
+			if event.Err != nil {
+				c.logger.Printf("publication %s: failed to list the node IPs: %v", key, event.Err)
+				c.updateStatus(ctx, key, p.generation, func(status *NodeIPPublicationStatus) {
+					c.setCondition(status, p.generation, metav1.ConditionFalse, ListFailedReason, event.Err.Error())
+				})
+				return
+			}
+			if event.Recovered {
+				// the listing error gives way to the outcome of the last delivery
+				c.updateStatus(ctx, key, p.generation, func(status *NodeIPPublicationStatus) {
+					if broadcastErr != nil {
+						c.setCondition(status, p.generation, metav1.ConditionFalse, BroadcastFailedReason, broadcastErr.Error())
+						return
+					}
+					c.setCondition(status, p.generation, metav1.ConditionTrue, PublishedReason, fmt.Sprintf("%d IPs published", len(event.IPs)))
+				})
+			}
+		}),
+		DeliveryReportHandler(func(change Change, report DeliveryReport, retry time.Duration) {
+			if c.elector != nil && !c.elector.IsLeader() {
+				// following, the new leader restarts the publication
+				return
+			}
+			if ctx.Err() != nil {
+				// stopped, the status is left to the next publication
+				return
+			}
+			broadcastErr = report.Err()
+			if broadcastErr != nil {
+				c.logger.Printf("publication %s: broadcast failed, retrying in %s: %v", key, retry, broadcastErr)
+			}
+			c.updateStatus(ctx, key, p.generation, func(status *NodeIPPublicationStatus) {
+				if broadcastErr != nil {
+					c.setCondition(status, p.generation, metav1.ConditionFalse, BroadcastFailedReason, broadcastErr.Error())
+					return
+				}
+				now := metav1.NewTime(c.now())
+				status.IPs = change.IPs
+				status.PublishedAt = &now
+				c.setCondition(status, p.generation, metav1.ConditionTrue, PublishedReason, fmt.Sprintf("%d IPs published", len(change.IPs)))
+			})
+		}),
+	)
+	if p.restarted {
+		// the IPs were broadcast to the same broadcasters before the
+		// restart, by this replica or the previous leader
+		opts = append(opts, DeliveryCatchUp())
+	}
+	DeliverEvents(ctx, p.broadcaster, p.notifier.NotifyWithErrors(ctx), opts...)
+}
+
+func (c *PublicationController) setCondition(status *NodeIPPublicationStatus, generation int64, conditionStatus metav1.ConditionStatus, reason, message string) {
+	status.ObservedGeneration = generation
+	// the transition time is only updated when the status changes
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               PublishedCondition,
+		Status:             conditionStatus,
+		LastTransitionTime: metav1.NewTime(c.now()),
+		Reason:             reason,
+		Message:            message,
+	})
+	meta.FindStatusCondition(status.Conditions, PublishedCondition).ObservedGeneration = generation
+}
+
+// updateStatus applies update to the status of the publication of key,
+// unless a follower of the leader election.
+func (c *PublicationController) updateStatus(ctx context.Context, key string, generation int64, update func(*NodeIPPublicationStatus)) {
+	if c.elector != nil && !c.elector.IsLeader() {
+		return
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return
+	}
+	publications := c.client.Resource(NodeIPPublicationResource).Namespace(namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		u, err := publications.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if u.GetGeneration() != generation {
+			// the spec changed meanwhile
+			return nil
+		}
+		status := NodeIPPublicationStatus{}
+		if raw, exists := u.Object["status"].(map[string]interface{}); exists {
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status); err != nil {
+				return errors.Wrap(err, "invalid status")
+			}
+		}
+		update(&status)
+		raw, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode the status")
+		}
+		u.Object["status"] = raw
+		_, err = publications.UpdateStatus(ctx, u, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
+		c.logger.Printf("publication %s: failed to update the status: %v", key, err)
+	}
+}
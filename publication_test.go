@@ -0,0 +1,585 @@
+package ip8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	testingkube "k8s.io/client-go/testing"
+)
+
+func helperPublication(t *testing.T, name string, generation int64, spec string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	u.SetAPIVersion(NodeIPPublicationResource.GroupVersion().String())
+	u.SetKind("NodeIPPublication")
+	u.SetNamespace("default")
+	u.SetName(name)
+	u.SetGeneration(generation)
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(spec), &raw); err != nil {
+		t.Fatal(err)
+	}
+	u.Object["spec"] = raw
+	return u
+}
+
+// helperPublicationStatus waits for the status of the publication to be
+// accepted.
+func helperPublicationStatus(t *testing.T, client *fakedynamic.FakeDynamicClient, name string, accept func(NodeIPPublicationStatus) bool) NodeIPPublicationStatus {
+	status := NodeIPPublicationStatus{}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		u, err := client.Resource(NodeIPPublicationResource).Namespace("default").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := u.Object["status"].(map[string]interface{})
+		status = NodeIPPublicationStatus{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status); err != nil {
+			t.Fatal(err)
+		}
+		if accept(status) {
+			return status
+		}
+	}
+	t.Fatalf("invalid status of %s: got %+v", name, status)
+	return status
+}
+
+func helperPublished(reason string, ips ...string) func(NodeIPPublicationStatus) bool {
+	return func(status NodeIPPublicationStatus) bool {
+		condition := meta.FindStatusCondition(status.Conditions, PublishedCondition)
+		return condition != nil && condition.Reason == reason && (len(ips) == 0 || helperEqual(status.IPs, ips))
+	}
+}
+
+func TestPublicationController(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	ingress := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	worker := buildNode().
+		Label("role", "worker").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.5")
+	set := newNotifierSetFromClient(fakekube.NewSimpleClientset(ingress.Build("node1"), worker.Build("node2")), time.Second)
+	spec := `{
+		"nodeSelector": "role=%s",
+		"dnsName": "app.example.com",
+		"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["` + server.WebhookURL("ops") + `"]}}]
+	}`
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(),
+		helperPublication(t, "app", 1, strings.Replace(spec, "%s", "ingress", 1)),
+		helperPublication(t, "invalid", 1, `{"nodeSelector": "role=ingress", "broadcasters": []}`),
+	)
+	controller, err := NewPublicationController(client, set, PublicationLogger(log.New(ioutil.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go controller.Run(ctx)
+
+	status := helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.4"))
+	if status.ObservedGeneration != 1 || status.PublishedAt == nil {
+		t.Errorf("invalid status: expected generation 1 published but got %+v", status)
+	}
+	if messages := server.Messages(); len(messages) != 1 || !strings.Contains(messages[0].Text, "app.example.com") {
+		t.Errorf("invalid messages: expected one about app.example.com but got %+v", messages)
+	}
+	status = helperPublicationStatus(t, client, "invalid", helperPublished(InvalidSpecReason))
+	if condition := meta.FindStatusCondition(status.Conditions, PublishedCondition); condition.Status != metav1.ConditionFalse {
+		t.Errorf("invalid condition: expected False but got %+v", condition)
+	}
+
+	// the publication moves to the workers
+	publications := client.Resource(NodeIPPublicationResource).Namespace("default")
+	if _, err := publications.Update(ctx, helperPublication(t, "app", 2, strings.Replace(spec, "%s", "worker", 1)), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	status = helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.5"))
+	if status.ObservedGeneration != 2 {
+		t.Errorf("invalid observed generation: expected 2 but got %d", status.ObservedGeneration)
+	}
+	// the new spec does not catch up, its broadcasters may be new
+	if messages := server.Messages(); len(messages) != 2 || !strings.Contains(messages[1].Text, "1.2.3.5") {
+		t.Errorf("invalid messages: expected a second one about 1.2.3.5 but got %+v", messages)
+	}
+	// the unchanged IPs are broadcast to the new broadcasters
+	devSpec := strings.Replace(strings.Replace(spec, "%s", "worker", 1), `"]}}]`, `", "`+server.WebhookURL("dev")+`"]}}]`, 1)
+	if _, err := publications.Update(ctx, helperPublication(t, "app", 3, devSpec), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	helperPublicationStatus(t, client, "app", func(status NodeIPPublicationStatus) bool {
+		return status.ObservedGeneration == 3 && helperPublished(PublishedReason, "1.2.3.5")(status)
+	})
+	dev := 0
+	for _, message := range server.Messages() {
+		if message.Channel == "dev" {
+			dev++
+		}
+	}
+	if dev != 1 {
+		t.Errorf("invalid messages: expected one on dev but got %+v", server.Messages())
+	}
+
+	if err := publications.Delete(ctx, "app", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		controller.l.Lock()
+		_, running := controller.publications["default/app"]
+		controller.l.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("deleted publication still running")
+		}
+	}
+}
+
+func TestPublicationControllerLeadership(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	ingress := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	kube := fakekube.NewSimpleClientset(ingress.Build("node1"))
+	set := newNotifierSetFromClient(kube, time.Second)
+	elector := helperLeaderElector(t, kube, "first")
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(),
+		helperPublication(t, "app", 1, `{
+			"nodeSelector": "role=ingress",
+			"dnsName": "app.example.com",
+			"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["`+server.WebhookURL("ops")+`"]}}]
+		}`),
+		helperPublication(t, "invalid", 1, `{"nodeSelector": "role=ingress", "broadcasters": []}`),
+	)
+	controller, err := NewPublicationController(client, set,
+		PublicationLeaderElector(elector),
+		PublicationLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go controller.Run(ctx)
+	helperSubscribers(t, set, 1)
+	time.Sleep(200 * time.Millisecond)
+	if messages := server.Messages(); len(messages) != 0 {
+		t.Errorf("follower broadcast: expected no message but got %+v", messages)
+	}
+	for _, name := range []string{"app", "invalid"} {
+		u, err := client.Resource(NodeIPPublicationResource).Namespace("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, exists := u.Object["status"]; exists {
+			t.Errorf("follower updated the status of %s: expected none but got %v", name, status)
+		}
+	}
+
+	// the leader reports what the follower skipped, without notifying again
+	go elector.Run(ctx)
+	helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.4"))
+	helperPublicationStatus(t, client, "invalid", helperPublished(InvalidSpecReason))
+	if messages := server.Messages(); len(messages) != 0 {
+		t.Errorf("new leader notified: expected no message but got %+v", messages)
+	}
+
+	// the next change is notified
+	other := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.5")
+	if _, err := kube.CoreV1().Nodes().Create(ctx, other.Build("node2"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.4", "1.2.3.5"))
+	if messages := server.Messages(); len(messages) != 1 {
+		t.Errorf("invalid messages: expected 1 but got %+v", messages)
+	}
+}
+
+func TestPublicationControllerRedelivery(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	server.FailWebhooks(http.StatusServiceUnavailable, "unavailable")
+	ingress := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	set := newNotifierSetFromClient(fakekube.NewSimpleClientset(ingress.Build("node1")), time.Second)
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(),
+		helperPublication(t, "app", 1, `{
+			"dnsName": "app.example.com",
+			"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["`+server.WebhookURL("ops")+`"]}}]
+		}`),
+	)
+	status := NewStatus()
+	controller, err := NewPublicationController(client, set,
+		PublicationStatus(status),
+		PublicationDeliveryOptions(DeliveryBackoff(10*time.Millisecond, 10*time.Millisecond)),
+		PublicationLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go controller.Run(ctx)
+
+	helperPublicationStatus(t, client, "app", helperPublished(BroadcastFailedReason))
+	if broadcaster := status.Snapshot().Broadcasters["default/app/slack#0"]; broadcaster.Error == "" {
+		t.Errorf("failure not tracked: expected an error but got %+v", broadcaster)
+	}
+
+	// the failed broadcaster is redelivered
+	server.FailWebhooks(0, "")
+	helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.4"))
+	if messages := server.Messages(); len(messages) != 1 {
+		t.Errorf("invalid messages: expected 1 but got %+v", messages)
+	}
+	if broadcaster := status.Snapshot().Broadcasters["default/app/slack#0"]; broadcaster.Error != "" || broadcaster.LastSuccess == nil {
+		t.Errorf("success not tracked: expected no error but got %+v", broadcaster)
+	}
+
+	// the deleted publication leaves the status
+	if err := client.Resource(NodeIPPublicationResource).Namespace("default").Delete(ctx, "app", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	broadcasters := status.Snapshot().Broadcasters
+	for deadline := time.Now().Add(5 * time.Second); len(broadcasters) != 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		broadcasters = status.Snapshot().Broadcasters
+	}
+	if len(broadcasters) != 0 {
+		t.Errorf("deleted publication tracked: expected no broadcaster but got %+v", broadcasters)
+	}
+}
+
+func TestPublicationControllerDryRun(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	ingress := buildNode().
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	set := newNotifierSetFromClient(fakekube.NewSimpleClientset(ingress.Build("node1")), time.Second)
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(),
+		helperPublication(t, "app", 1, `{
+			"dnsName": "app.example.com",
+			"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["`+server.WebhookURL("ops")+`"]}}]
+		}`),
+	)
+	output := &bytes.Buffer{}
+	controller, err := NewPublicationController(client, set,
+		PublicationDryRun(),
+		PublicationLogger(log.New(output, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go controller.Run(ctx)
+
+	helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.4"))
+	if messages := server.Messages(); len(messages) != 0 {
+		t.Errorf("dry-run notified: expected no message but got %+v", messages)
+	}
+	if !strings.Contains(output.String(), "dry-run: send slack webhook #0") {
+		t.Errorf("invalid output: expected the planned message but got %q", output.String())
+	}
+}
+
+func helperSecret(version string, data map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	u.SetAPIVersion("v1")
+	u.SetKind("Secret")
+	u.SetNamespace("default")
+	u.SetName("credentials")
+	u.SetResourceVersion(version)
+	encoded := map[string]interface{}{}
+	for key, value := range data {
+		encoded[key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	u.Object["data"] = encoded
+	return u
+}
+
+func TestPublicationControllerSecret(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	ingress := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	kube := fakekube.NewSimpleClientset(ingress.Build("node1"))
+	set := newNotifierSetFromClient(kube, time.Second)
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(),
+		helperSecret("1", map[string]string{"webhook-url": server.WebhookURL("ops")}),
+		helperPublication(t, "app", 1, `{
+			"dnsName": "app.example.com",
+			"secretRef": {"name": "credentials"},
+			"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["${webhook-url}"]}}]
+		}`),
+		helperPublication(t, "undefined", 1, `{
+			"dnsName": "app.example.com",
+			"secretRef": {"name": "credentials"},
+			"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["${token}"]}}]
+		}`),
+	)
+	status := NewStatus()
+	controller, err := NewPublicationController(client, set,
+		PublicationStateStore(NewMemoryStateStore()),
+		PublicationStatus(status),
+		PublicationLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go controller.Run(ctx)
+
+	helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.4"))
+	if messages := server.Messages(); len(messages) != 1 || messages[0].Channel != "ops" {
+		t.Errorf("invalid messages: expected one on ops but got %+v", messages)
+	}
+	undefined := helperPublicationStatus(t, client, "undefined", helperPublished(InvalidSpecReason))
+	if condition := meta.FindStatusCondition(undefined.Conditions, PublishedCondition); !strings.Contains(condition.Message, "undefined key token") {
+		t.Errorf("invalid message: expected the undefined key but got %q", condition.Message)
+	}
+
+	// the new credentials restart the publication, which skips the
+	// unchanged IPs saved in the state store
+	rotated := time.Now()
+	secrets := client.Resource(secretResource).Namespace("default")
+	if _, err := secrets.Update(ctx, helperSecret("2", map[string]string{"webhook-url": server.WebhookURL("dev")}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if broadcaster, exists := status.Snapshot().Broadcasters["default/app/slack#0"]; exists && broadcaster.LastAttempt.After(rotated) {
+			break
+		}
+	}
+	if messages := server.Messages(); len(messages) != 1 {
+		t.Errorf("restart notified: expected 1 message but got %+v", messages)
+	}
+
+	other := buildNode().
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.5")
+	if _, err := kube.CoreV1().Nodes().Create(ctx, other.Build("node2"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.4", "1.2.3.5"))
+	if messages := server.Messages(); len(messages) != 2 || messages[1].Channel != "dev" {
+		t.Errorf("invalid messages: expected a second one on dev but got %+v", messages)
+	}
+}
+
+func TestPublicationControllerSecretForbidden(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	ingress := buildNode().
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	set := newNotifierSetFromClient(fakekube.NewSimpleClientset(ingress.Build("node1")), time.Second)
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(),
+		helperSecret("1", map[string]string{"webhook-url": server.WebhookURL("ops")}),
+		helperPublication(t, "app", 1, `{
+			"dnsName": "app.example.com",
+			"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["`+server.WebhookURL("dev")+`"]}}]
+		}`),
+	)
+	// the secrets can be read but not listed
+	client.PrependReactor("list", "secrets", func(action testingkube.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(secretResource.GroupResource(), "", errors.New("forbidden"))
+	})
+	var unavailable int32
+	client.PrependReactor("get", "secrets", func(action testingkube.Action) (bool, runtime.Object, error) {
+		if atomic.AddInt32(&unavailable, -1) < 0 {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewServiceUnavailable("unavailable")
+	})
+	controller, err := NewPublicationController(client, set, PublicationLogger(log.New(ioutil.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go controller.Run(ctx)
+
+	// the publications without secret do not wait for the secrets
+	helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.4"))
+	controller.secretsLock.Lock()
+	watched := len(controller.secrets)
+	controller.secretsLock.Unlock()
+	if watched != 0 {
+		t.Errorf("secrets watched: expected none without secretRef but got %d namespaces", watched)
+	}
+
+	// the referenced secret is read from the API until its namespace is synced
+	if _, err := client.Resource(NodeIPPublicationResource).Namespace("default").Create(ctx, helperPublication(t, "secret", 1, `{
+		"dnsName": "app.example.com",
+		"secretRef": {"name": "credentials"},
+		"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["${webhook-url}"]}}]
+	}`), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	helperPublicationStatus(t, client, "secret", helperPublished(PublishedReason, "1.2.3.4"))
+	messages := server.Messages()
+	channels := make([]string, len(messages))
+	for i, message := range messages {
+		channels[i] = message.Channel
+	}
+	if !helperEqual(channels, []string{"dev", "ops"}) {
+		t.Errorf("invalid messages: expected one on dev and ops but got %+v", messages)
+	}
+
+	// the failures to read the secret are retried
+	atomic.StoreInt32(&unavailable, 2)
+	if _, err := client.Resource(NodeIPPublicationResource).Namespace("default").Create(ctx, helperPublication(t, "retried", 1, `{
+		"dnsName": "app.example.com",
+		"secretRef": {"name": "credentials"},
+		"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["${webhook-url}"]}}]
+	}`), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	helperPublicationStatus(t, client, "retried", helperPublished(PublishedReason, "1.2.3.4"))
+}
+
+// helperSubscribers waits for the number of notifications dispatched by
+// set to be expected.
+func helperSubscribers(t *testing.T, set *NotifierSet, expected int) {
+	count := 0
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		set.l.Lock()
+		count = len(set.subscribers)
+		set.l.Unlock()
+		if count == expected {
+			return
+		}
+	}
+	t.Errorf("invalid node subscribers: expected %d but got %d", expected, count)
+}
+
+func TestPublicationControllerRestarts(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	ingress := buildNode().
+		Label("role", "ingress").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.4")
+	worker := buildNode().
+		Label("role", "worker").
+		Condition(v1.NodeReady, v1.ConditionTrue).
+		Address(v1.NodeExternalIP, "1.2.3.5")
+	set := newNotifierSetFromClient(fakekube.NewSimpleClientset(ingress.Build("node1"), worker.Build("node2")), time.Second)
+	spec := `{
+		"nodeSelector": "role=%s",
+		"dnsName": "app.example.com",
+		"broadcasters": [{"type": "slack", "slack": {"webhookURLs": ["` + server.WebhookURL("ops") + `"]}}]
+	}`
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), helperPublication(t, "app", 1, strings.Replace(spec, "%s", "ingress", 1)))
+	controller, err := NewPublicationController(client, set, PublicationLogger(log.New(ioutil.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go controller.Run(ctx)
+	helperPublicationStatus(t, client, "app", helperPublished(PublishedReason, "1.2.3.4"))
+	helperSubscribers(t, set, 1)
+
+	publications := client.Resource(NodeIPPublicationResource).Namespace("default")
+	roles := []string{"worker", "ingress", "worker", "ingress"}
+	ips := map[string]string{"ingress": "1.2.3.4", "worker": "1.2.3.5"}
+	for i, role := range roles {
+		generation := int64(i + 2)
+		if _, err := publications.Update(ctx, helperPublication(t, "app", generation, strings.Replace(spec, "%s", role, 1)), metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		helperPublicationStatus(t, client, "app", func(status NodeIPPublicationStatus) bool {
+			return status.ObservedGeneration == generation && helperPublished(PublishedReason, ips[role])(status)
+		})
+	}
+	// the stopped publications no longer receive the node events
+	helperSubscribers(t, set, 1)
+
+	if err := publications.Delete(ctx, "app", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	helperSubscribers(t, set, 0)
+}
+
+func TestParsePublicationSpec(t *testing.T) {
+	var raw interface{}
+	json.Unmarshal([]byte(`{"dnsName": "app.example.com", "broadcaster": []}`), &raw)
+	if _, err := parsePublicationSpec(raw); err == nil {
+		t.Error("unknown field accepted: expected an error but got <nil>")
+	}
+	json.Unmarshal([]byte(`{"dnsName": "app.example.com", "addressTypes": ["InternalIP"], "broadcasters": [{"type": "webhook", "webhook": {"urls": ["https://example.com"], "timeout": "5s"}}]}`), &raw)
+	spec, err := parsePublicationSpec(raw)
+	if err != nil {
+		t.Fatalf("spec rejected: expected <nil> but got %v", err)
+	}
+	if timeout := spec.Broadcasters[0].Webhook.Timeout.Duration; timeout != 5*time.Second {
+		t.Errorf("invalid timeout: expected 5s but got %s", timeout)
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	for _, test := range []struct {
+		spec  string
+		valid bool
+	}{
+		{`{"secretRef": {"name": "credentials"}, "broadcasters": [{"type": "cloudflare", "cloudflare": {"apiToken": "${token}"}}]}`, true},
+		{`{"broadcasters": [{"type": "cloudflare", "cloudflare": {"apiToken": "abc"}}]}`, false},
+		{`{"broadcasters": [{"type": "cloudflare", "cloudflare": {"apiToken": "${token}"}}]}`, false},
+		{`{"secretRef": {"name": "credentials"}, "broadcasters": [{"type": "cloudflare", "cloudflare": {"apiToken": "abc${token}"}}]}`, false},
+		{`{"broadcasters": [{"type": "route53", "route53": {"zoneID": "Z123"}}]}`, false},
+		{`{"secretRef": {"name": "credentials"}, "broadcasters": [{"type": "route53", "route53": {"accessKeyID": "${key-id}", "secretAccessKey": "${key}"}}]}`, true},
+		{`{"broadcasters": [{"type": "rfc2136", "rfc2136": {"server": "ns1.example.com:53", "zone": "example.com"}}]}`, false},
+		{`{"secretRef": {"name": "credentials"}, "broadcasters": [{"type": "rfc2136", "rfc2136": {"tsigKey": "ip8s.", "tsigSecret": "${tsig}"}}]}`, true},
+		{`{"broadcasters": [{"type": "email", "email": {"server": "smtp.example.com:587"}}]}`, false},
+		{`{"secretRef": {"name": "credentials"}, "broadcasters": [{"type": "email", "email": {"auth": "plain"}}]}`, false},
+		{`{"secretRef": {"name": "credentials"}, "broadcasters": [{"type": "email", "email": {"auth": "plain", "username": "ip8s", "password": "${password}"}}]}`, true},
+		{`{"broadcasters": [{"type": "webhook", "webhook": {"urls": ["https://example.com"], "secret": "abc"}}]}`, false},
+		{`{"broadcasters": [{"type": "webhook", "webhook": {"urls": ["https://example.com"]}}]}`, true},
+	} {
+		var raw interface{}
+		if err := json.Unmarshal([]byte(test.spec), &raw); err != nil {
+			t.Fatal(err)
+		}
+		spec, err := parsePublicationSpec(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateCredentials(spec); (err == nil) != test.valid {
+			t.Errorf("invalid validation of %s: expected valid %v but got %v", test.spec, test.valid, err)
+		}
+	}
+}
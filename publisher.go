@@ -3,10 +3,19 @@ package ip8s
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
+	"unicode/utf8"
 
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/nlopes/slack"
@@ -17,6 +26,21 @@ type Broadcaster interface {
 	Broadcast(ctx context.Context, ips []string) error
 }
 
+// ChangeBroadcaster is implemented by the broadcasters making use of the
+// details of a change (added and removed IPs, nodes, ...).
+type ChangeBroadcaster interface {
+	BroadcastChange(ctx context.Context, change Change) error
+}
+
+// BroadcastChange broadcasts the change with b when it is a
+// ChangeBroadcaster, only the new IPs otherwise.
+func BroadcastChange(ctx context.Context, b Broadcaster, change Change) error {
+	if broadcaster, ok := b.(ChangeBroadcaster); ok {
+		return broadcaster.BroadcastChange(ctx, change)
+	}
+	return b.Broadcast(ctx, change.IPs)
+}
+
 type multiError []error
 
 func (e multiError) Error() string {
@@ -27,101 +51,265 @@ func (e multiError) Error() string {
 	return strings.Join(msgs, "\n-----------------------\n")
 }
 
-type multiBroadcaster []Broadcaster
+// Is reports whether one of the errors matches target.
+func (e multiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
 
-func (b multiBroadcaster) Broadcast(ctx context.Context, ips []string) error {
-	w := sync.WaitGroup{}
-	w.Add(len(b))
-	errs := make([]error, 0)
-	l := sync.Mutex{}
-	for i := range b {
-		go func(i int) {
-			defer w.Done()
-			if b[i] == nil {
-				return
-			}
-			err := b[i].Broadcast(ctx, ips)
-			if err != nil {
-				l.Lock()
-				defer l.Unlock()
-				errs = append(errs, err)
-			}
-		}(i)
+// As finds the first of the errors matching target.
+func (e multiError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
 	}
-	w.Wait()
-	if len(errs) == 0 {
+	return false
+}
+
+// combineErrors returns nil, the only error or a multiError.
+func combineErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
 		return nil
+	case 1:
+		return errs[0]
+	default:
+		return multiError(errs)
+	}
+}
+
+type multiBroadcaster []NamedBroadcaster
+
+// NewMultiBroadcaster broadcasts to all the broadcasters, named after their
+// index in the delivery reports. The nil ones are skipped.
+func NewMultiBroadcaster(broadcasters ...Broadcaster) Broadcaster {
+	targets := make([]NamedBroadcaster, 0, len(broadcasters))
+	for i, broadcaster := range broadcasters {
+		targets = append(targets, NamedBroadcaster{Name: fmt.Sprintf("#%d", i), Broadcaster: broadcaster})
+	}
+	return NewNamedMultiBroadcaster(targets...)
+}
+
+// NewNamedMultiBroadcaster broadcasts to all the targets, which should have
+// unique names. The ones without broadcaster are skipped.
+func NewNamedMultiBroadcaster(targets ...NamedBroadcaster) Broadcaster {
+	b := make(multiBroadcaster, 0, len(targets))
+	for _, target := range targets {
+		if target.Broadcaster != nil {
+			b = append(b, target)
+		}
+	}
+	return b
+}
+
+func (b multiBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	return b.PlanChange(ctx, Change{IPs: ips})
+}
+
+func (b multiBroadcaster) PlanChange(ctx context.Context, change Change) (Plan, error) {
+	plan := Plan{}
+	for _, target := range b {
+		p, err := PlanBroadcastChange(ctx, target.Broadcaster, change)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, p...)
+	}
+	return plan, nil
+}
+
+func (b multiBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	return b.BroadcastChange(ctx, Change{IPs: ips})
+}
+
+func (b multiBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	return b.Deliver(ctx, change).Err()
+}
+
+func (b multiBroadcaster) caughtUp() Broadcaster {
+	targets := make(multiBroadcaster, 0, len(b))
+	for _, target := range b {
+		if !target.NoCatchUp {
+			targets = append(targets, target)
+		}
 	}
-	if len(errs) == 1 {
-		return errors.Wrap(errs[0], "one broadcast failed")
-	}
-	return errors.Wrap(multiError(errs), "multiple error occured during broadcasting")
-}
-
-// type emailBroadcaster struct {
-// 	auth    smtp.Auth
-// 	server  string
-// 	from    string
-// 	dest    []string
-// 	subject string
-// 	body    string
-// }
-//
-// var emailTmpl = `
-// From: {{ .from }}
-// To: {{ join ", " .dest }}
-// Subject: {{ .subject }}
-// MIME-Version: 1.0
-// Content-Type: text/html; charset=utf-8
-// Content-Transfer-Encoding: quoted-printable
-// Content-Disposition: inline
-//
-// `
-//
-// func (b emailBroadcaster) buildContent(ips []string) (string, error) {
-// 	builder := &strings.Builder{}
-// 	appendToBuilder := func(label, content string) {
-// 		builder.WriteString(label)
-// 		builder.WriteString(": ")
-// 		builder.WriteString(content)
-// 		builder.WriteString("\r\n")
-// 	}
-// 	appendToBuilder("From", b.from)
-// 	appendToBuilder("To", strings.Join(b.dest, ", "))
-// 	appendToBuilder("Subject", b.subject)
-// 	appendToBuilder("MIME-Version", "1.0")
-// 	appendToBuilder("Content-Type", "text/html; charset\"utf-8\"")
-// 	appendToBuilder("Content-Transfer-Encoding", "quoted-printable")
-// 	appendToBuilder("Content-Disposition", "inline")
-// 	builder.WriteString("\r\n")
-// 	msgBuilder := quotedprintable.NewWriter(builder)
-// 	msgBuilder.Write([]byte(fmt.Sprintf(b.body, ips)))
-// 	if err := msgBuilder.Close(); err != nil {
-// 		return "", errors.Wrap(err, "failed to quote the htlp content")
-// 	}
-// 	return builder.String(), nil
-// }
-//
-// func (b emailBroadcaster) Broadcast(ctx context.Context, ips []string) error {
-// 	msg, err := b.buildContent(ips)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	msg = "From: " + b.from + "\n" +
-// 		"To: " + strings.Join(b.dest, ",") + "\n" +
-// 		"Subject: " + b.subject + "\n" +
-// 		"\n" + msg
-// 	err = smtp.SendMail(b.server, b.auth, b.from, b.dest, []byte(msg))
-// 	if err != nil {
-// 		return errors.Wrap(err, "failed to send mail")
-// 	}
-// 	return nil
-// }
+	return targets
+}
+
+func (b multiBroadcaster) Deliver(ctx context.Context, change Change) DeliveryReport {
+	return Deliver(ctx, change, b...)
+}
+
+func (b multiBroadcaster) Redeliver(ctx context.Context, change Change, report DeliveryReport) DeliveryReport {
+	return report.Redeliver(ctx, change, b...)
+}
 
+// slackBroadcaster posts with the slack API when api is set, to the
+// incoming webhooks otherwise.
 type slackBroadcaster struct {
-	api     *slack.Client
-	roomID  string
-	dnsName string
+	api      *slack.Client
+	roomID   string
+	webhooks []string
+	client   *http.Client
+	dnsName  string
+	cluster  string
+	tmpl     *template.Template
+
+	thread bool
+	// l guards threadTS, the timestamp of the first message, and is held
+	// while posting it so that the other messages are replies to it.
+	l        sync.Mutex
+	threadTS string
+}
+
+type slackSettings struct {
+	clientOptions []slack.Option
+	httpClient    *http.Client
+	cluster       string
+	template      string
+	thread        bool
+}
+
+type SlackOption func(*slackSettings)
+
+// SlackClientOptions are passed to the underlying slack client (custom HTTP
+// client, API URL, debug, ...).
+func SlackClientOptions(opts ...slack.Option) SlackOption {
+	return func(s *slackSettings) {
+		s.clientOptions = append(s.clientOptions, opts...)
+	}
+}
+
+// SlackHTTPClient sets the HTTP client of the API calls or of the incoming
+// webhooks (default: 10s timeout for the webhooks).
+func SlackHTTPClient(client *http.Client) SlackOption {
+	return func(s *slackSettings) {
+		s.httpClient = client
+	}
+}
+
+// SlackThread posts all the updates as replies to the first message, which
+// requires the slack API: incoming webhooks do not return the timestamp of
+// the messages.
+func SlackThread() SlackOption {
+	return func(s *slackSettings) {
+		s.thread = true
+	}
+}
+
+// SlackCluster names the cluster in the messages.
+func SlackCluster(name string) SlackOption {
+	return func(s *slackSettings) {
+		s.cluster = name
+	}
+}
+
+// SlackTemplate replaces the default text/template of the messages. It is
+// executed with .DNSName, .Cluster, .IPs, .Added and .Removed and can use
+// the join function ({{ join ", " .IPs }}).
+func SlackTemplate(text string) SlackOption {
+	return func(s *slackSettings) {
+		s.template = text
+	}
+}
+
+func NewSlackBroadcaster(token, channel, dnsName string, opts ...SlackOption) (Broadcaster, error) {
+	if token == "" {
+		return nil, errors.New("missing slack token")
+	}
+	if channel == "" {
+		return nil, errors.New("missing slack channel")
+	}
+	b, settings, err := newSlackBroadcaster(dnsName, opts)
+	if err != nil {
+		return nil, err
+	}
+	if settings.httpClient != nil {
+		settings.clientOptions = append(settings.clientOptions, slack.OptionHTTPClient(settings.httpClient))
+	}
+	b.api = slack.New(token, settings.clientOptions...)
+	b.roomID = channel
+	return b, nil
+}
+
+// NewSlackWebhookBroadcaster posts to incoming webhooks, which need no slack
+// app with the chat:write scope but cannot thread the messages. Like the
+// webhook broadcaster, a failed URL fails the whole broadcast.
+func NewSlackWebhookBroadcaster(webhookURLs []string, dnsName string, opts ...SlackOption) (Broadcaster, error) {
+	if len(webhookURLs) == 0 {
+		return nil, errors.New("missing slack webhook url")
+	}
+	for i, u := range webhookURLs {
+		parsed, err := url.Parse(u)
+		if err != nil || !parsed.IsAbs() || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+			// the url holds a secret, it is not written in the errors
+			return nil, errors.Errorf("invalid slack webhook url #%d: expected an http(s) url", i)
+		}
+	}
+	b, settings, err := newSlackBroadcaster(dnsName, opts)
+	if err != nil {
+		return nil, err
+	}
+	if settings.thread {
+		return nil, errors.New("slack threads are not supported by incoming webhooks")
+	}
+	b.webhooks = webhookURLs
+	b.client = settings.httpClient
+	if b.client == nil {
+		b.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return b, nil
+}
+
+func newSlackBroadcaster(dnsName string, opts []SlackOption) (*slackBroadcaster, *slackSettings, error) {
+	if err := validateDNSName(dnsName); err != nil {
+		return nil, nil, err
+	}
+	settings := &slackSettings{template: slackTmpl}
+	for _, opt := range opts {
+		opt(settings)
+	}
+	tmpl, err := parseSlackTemplate(settings.template)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &slackBroadcaster{
+		dnsName: dnsName,
+		cluster: settings.cluster,
+		tmpl:    tmpl,
+		thread:  settings.thread,
+	}, settings, nil
+}
+
+func validateDNSName(name string) error {
+	if name == "" {
+		return errors.New("missing dns name")
+	}
+	if len(name) > 253 {
+		return errors.Errorf("invalid dns name %q: longer than 253 characters", name)
+	}
+	for i, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "*" && i == 0 {
+			continue
+		}
+		if label == "" || len(label) > 63 {
+			return errors.Errorf("invalid dns name %q: labels must be 1 to 63 characters long", name)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.Errorf("invalid dns name %q: labels cannot start or end with a hyphen", name)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return errors.Errorf("invalid dns name %q: unexpected character %q", name, r)
+			}
+		}
+	}
+	return nil
 }
 
 func join(sep string, a []string) string {
@@ -136,66 +324,415 @@ IPs for {{ .DNSName }} {{ with .IPs }}changed:
 {{ template "italic" . }}{{ else }}were deleted{{ end -}}
 `
 
-func execDefaultSlackTemplate(dns string, ips []string) (string, error) {
+// slackData is what the slack templates are executed with.
+type slackData struct {
+	DNSName string
+	Cluster string
+	IPs     []string
+	Added   []string
+	Removed []string
+}
+
+func parseSlackTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = slackTmpl
+	}
 	tmpl, err := template.New("slack_tmpl").
 		Funcs(map[string]interface{}{"join": join}).
-		Parse(slackTmpl)
+		Parse(text)
+	return tmpl, errors.Wrap(err, "invalid slack template")
+}
+
+func execDefaultSlackTemplate(dns string, ips []string) (string, error) {
+	tmpl, err := parseSlackTemplate(slackTmpl)
 	if err != nil {
 		return "", err
 	}
-	return execTemplate(tmpl, dns, ips)
+	return execTemplate(tmpl, slackData{DNSName: dns, IPs: ips})
 }
 
-func execTemplate(tmpl *template.Template, dns string, ips []string) (string, error) {
+func execTemplate(tmpl *template.Template, data slackData) (string, error) {
 	b := &bytes.Buffer{}
-	err := tmpl.Execute(b, map[string]interface{}{
-		"DNSName": dns,
-		"IPs":     ips,
-	})
+	err := tmpl.Execute(b, data)
 	if err != nil {
 		return "", err
 	}
 	return b.String(), nil
 }
 
-func (b slackBroadcaster) newMessage(ips []string) slack.MsgOption {
-	msg := fmt.Sprintf("IPs for %s ", b.dnsName)
-	if len(ips) == 0 {
-		msg += "were deleted"
-	} else {
-		ipsText := strings.Join(ips, "\t")
-		msg += fmt.Sprintf("changed:\n_%s_", ipsText)
-	}
-	return slack.MsgOptionBlocks(
-		slack.NewSectionBlock(
-			slack.NewTextBlockObject(
-				slack.MarkdownType,
-				msg,
-				false,
-				false,
-			),
-			nil,
-			nil,
-		),
-	)
-}
-
-func (b slackBroadcaster) Broadcast(ctx context.Context, ips []string) error {
-	_, _, err := b.api.PostMessageContext(ctx, b.roomID, b.newMessage(ips))
+func (b *slackBroadcaster) data(change Change) slackData {
+	return slackData{
+		DNSName: b.dnsName,
+		Cluster: b.cluster,
+		IPs:     change.IPs,
+		Added:   change.Added,
+		Removed: change.Removed,
+	}
+}
+
+func (b *slackBroadcaster) messageText(change Change) (string, error) {
+	text, err := execTemplate(b.tmpl, b.data(change))
+	if err != nil {
+		return "", Permanent(errors.Wrap(err, "failed to render the slack message"))
+	}
+	return text, nil
+}
+
+// slackFieldLength is the maximum length of the text of a field.
+const slackFieldLength = 2000
+
+// slackSectionLength is the maximum length of the text of a section.
+const slackSectionLength = 3000
+
+// truncateSection cuts the rendered text of a section to its maximum
+// length, at a character boundary, marking the cut with an ellipsis.
+func truncateSection(text string) string {
+	if len(text) <= slackSectionLength {
+		return text
+	}
+	cut := slackSectionLength - len("…")
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "…"
+}
+
+// ipList formats IPs for the fields of a message, one per line, the last
+// ones being counted instead when they do not fit.
+func ipList(title string, ips []string) *slack.TextBlockObject {
+	text := fmt.Sprintf("*%s*", title)
+	for i, ip := range ips {
+		line, more := "\n"+ip, ""
+		if rest := len(ips) - i - 1; rest != 0 {
+			more = fmt.Sprintf("\n… and %d more", rest)
+		}
+		if len(text)+len(line)+len(more) > slackFieldLength {
+			text += fmt.Sprintf("\n… and %d more", len(ips)-i)
+			break
+		}
+		text += line
+	}
+	return slack.NewTextBlockObject(slack.MarkdownType, text, false, false)
+}
+
+// blocks lays out the rendered text, the added and removed IPs when known
+// and the cluster and count of IPs as context.
+func (b *slackBroadcaster) blocks(text string, change Change) []slack.Block {
+	blocks := []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, truncateSection(text), false, false), nil, nil),
+	}
+	var fields []*slack.TextBlockObject
+	if len(change.Added) != 0 {
+		fields = append(fields, ipList("Added", change.Added))
+	}
+	if len(change.Removed) != 0 {
+		fields = append(fields, ipList("Removed", change.Removed))
+	}
+	if len(fields) != 0 {
+		blocks = append(blocks, slack.NewSectionBlock(nil, fields, nil))
+	}
+	footer := fmt.Sprintf("%d IPs", len(change.IPs))
+	if b.cluster != "" {
+		footer = fmt.Sprintf("Cluster *%s* | %s", b.cluster, footer)
+	}
+	return append(blocks, slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, footer, false, false)))
+}
+
+// slackWebhookMessage is the payload of the incoming webhooks, the one of
+// the slack client lacks the blocks.
+type slackWebhookMessage struct {
+	// Text is the fallback of the notifications
+	Text   string        `json:"text"`
+	Blocks []slack.Block `json:"blocks"`
+}
+
+// slackWebhookError is an unexpected status of an incoming webhook, with
+// the error code slack answers in the body (e.g. "no_service").
+type slackWebhookError struct {
+	index  int
+	status int
+	code   string
+}
+
+func (e slackWebhookError) Error() string {
+	return fmt.Sprintf("slack webhook #%d answered with HTTP status %d: %s", e.index, e.status, e.code)
+}
+
+func (e slackWebhookError) HTTPStatusCode() int {
+	return e.status
+}
+
+func (b *slackBroadcaster) postWebhook(ctx context.Context, i int, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, b.webhooks[i], bytes.NewReader(body))
+	if err != nil {
+		return Permanent(errors.Errorf("invalid slack webhook url #%d", i))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		// the url errors would log the secret url
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return errors.Wrapf(err, "failed to call slack webhook #%d", i)
+	}
+	defer resp.Body.Close()
+	code, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	if resp.StatusCode != http.StatusOK {
+		return slackWebhookError{i, resp.StatusCode, strings.TrimSpace(string(code))}
+	}
+	return nil
+}
+
+func (b *slackBroadcaster) broadcastWebhooks(ctx context.Context, text string, change Change) error {
+	body, err := json.Marshal(slackWebhookMessage{text, b.blocks(text, change)})
+	if err != nil {
+		return Permanent(errors.Wrap(err, "failed to encode the slack message"))
+	}
+	var errs []error
+	for i := range b.webhooks {
+		if err := b.postWebhook(ctx, i, body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+func (b *slackBroadcaster) post(ctx context.Context, text string, change Change) error {
+	opts := []slack.MsgOption{slack.MsgOptionText(text, false), slack.MsgOptionBlocks(b.blocks(text, change)...)}
+	if !b.thread {
+		_, _, err := b.api.PostMessageContext(ctx, b.roomID, opts...)
+		return err
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.threadTS != "" {
+		opts = append(opts, slack.MsgOptionTS(b.threadTS))
+	}
+	_, ts, err := b.api.PostMessageContext(ctx, b.roomID, opts...)
+	if err == nil && b.threadTS == "" {
+		b.threadTS = ts
+	}
 	return err
 }
 
+func (b *slackBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	return b.BroadcastChange(ctx, Change{IPs: ips})
+}
+
+func (b *slackBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	text, err := b.messageText(change)
+	if err != nil {
+		return err
+	}
+	if b.api == nil {
+		return b.broadcastWebhooks(ctx, text, change)
+	}
+	return b.post(ctx, text, change)
+}
+
+func (b *slackBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	return b.PlanChange(ctx, Change{IPs: ips})
+}
+
+func (b *slackBroadcaster) PlanChange(ctx context.Context, change Change) (Plan, error) {
+	text, err := b.messageText(change)
+	if err != nil {
+		return nil, err
+	}
+	if b.api != nil {
+		return Plan{{Kind: SendAction, Target: "slack " + b.roomID, Value: text}}, nil
+	}
+	plan := make(Plan, len(b.webhooks))
+	for i := range b.webhooks {
+		plan[i] = Action{Kind: SendAction, Target: fmt.Sprintf("slack webhook #%d", i), Value: text}
+	}
+	return plan, nil
+}
+
 type cloudflareDNSBroadcaster struct {
-	api     *cloudflare.API
-	dnsName string
+	api      *cloudflare.API
+	dnsName  string
+	family   AddressFamily
+	zoneName string
+
+	// attributes left to zero are not managed: they get the cloudflare
+	// defaults on creation and are never updated.
+	ttl     int
+	proxied *bool
+	comment string
+	// tags is nil when not managed, an empty list clears the tags
+	tags *[]string
+
+	rollback bool
+
+	l      sync.Mutex
+	zoneID string
+}
+
+type CloudflareOption func(*cloudflareDNSBroadcaster)
+
+// CloudflareAddressFamily selects the reconciled records: A (IPv4, the
+// default), AAAA (IPv6) or both (AllFamilies). The records of the other
+// family are left as is.
+func CloudflareAddressFamily(family AddressFamily) CloudflareOption {
+	return func(b *cloudflareDNSBroadcaster) {
+		b.family = family
+	}
+}
+
+// CloudflareTTL sets the TTL of the records in seconds (1 means automatic).
+func CloudflareTTL(ttl int) CloudflareOption {
+	return func(b *cloudflareDNSBroadcaster) {
+		b.ttl = ttl
+	}
+}
+
+func CloudflareProxied(proxied bool) CloudflareOption {
+	return func(b *cloudflareDNSBroadcaster) {
+		b.proxied = &proxied
+	}
+}
+
+// CloudflareComment marks the records, e.g. "managed by ip8s".
+func CloudflareComment(comment string) CloudflareOption {
+	return func(b *cloudflareDNSBroadcaster) {
+		b.comment = comment
+	}
+}
+
+// CloudflareTags enforces the tags of the records, none clears them.
+func CloudflareTags(tags ...string) CloudflareOption {
+	return func(b *cloudflareDNSBroadcaster) {
+		sorted := append([]string{}, tags...)
+		sort.Strings(sorted)
+		b.tags = &sorted
+	}
+}
+
+// CloudflareRollback deletes the records created during a broadcast when
+// the desired state could not be reached, leaving the previous records in
+// place.
+func CloudflareRollback() CloudflareOption {
+	return func(b *cloudflareDNSBroadcaster) {
+		b.rollback = true
+	}
+}
+
+// CloudflareZoneID skips the zone lookup.
+func CloudflareZoneID(zoneID string) CloudflareOption {
+	return func(b *cloudflareDNSBroadcaster) {
+		b.zoneID = zoneID
+	}
+}
+
+// CloudflareZoneName looks the zone up by its name instead of guessing it
+// from the dns name.
+func CloudflareZoneName(zoneName string) CloudflareOption {
+	return func(b *cloudflareDNSBroadcaster) {
+		b.zoneName = zoneName
+	}
+}
+
+func NewCloudflareDNSBroadcaster(api *cloudflare.API, dnsName string, opts ...CloudflareOption) (Broadcaster, error) {
+	if api == nil {
+		return nil, errors.New("missing cloudflare client")
+	}
+	if err := validateDNSName(dnsName); err != nil {
+		return nil, err
+	}
+	b := &cloudflareDNSBroadcaster{
+		api:     api,
+		dnsName: dnsName,
+		family:  IPv4,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	switch b.family {
+	case AllFamilies, IPv4, IPv6:
+	default:
+		return nil, errors.Errorf("unknown address family %d", b.family)
+	}
+	if b.ttl != 0 && b.ttl != 1 && (b.ttl < 60 || b.ttl > 86400) {
+		return nil, errors.Errorf("invalid ttl %d: must be 1 (automatic) or between 60 and 86400", b.ttl)
+	}
+	if err := validateZoneName(b.dnsName, b.zoneName); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func validateZoneName(dnsName, zoneName string) error {
+	if zoneName == "" {
+		return nil
+	}
+	name := strings.TrimSuffix(dnsName, ".")
+	zone := strings.TrimSuffix(zoneName, ".")
+	if name != zone && !strings.HasSuffix(name, "."+zone) {
+		return errors.Errorf("dns name %s is not part of the zone %s", dnsName, zoneName)
+	}
+	return nil
+}
+
+// zoneCandidates lists the zones that may own the dns name, longest first,
+// or only zoneName when it is set.
+func zoneCandidates(dnsName, zoneName string) []string {
+	if zoneName != "" {
+		return []string{strings.TrimSuffix(zoneName, ".")}
+	}
+	labels := strings.Split(strings.TrimSuffix(dnsName, "."), ".")
+	var candidates []string
+	for i := 0; i < len(labels)-1; i++ {
+		if labels[i] == "*" {
+			continue
+		}
+		candidates = append(candidates, strings.Join(labels[i:], "."))
+	}
+	return candidates
+}
+
+func (b *cloudflareDNSBroadcaster) findZone(ctx context.Context, name string) (string, bool, error) {
+	res, err := b.api.ListZonesContext(ctx, cloudflare.WithZoneFilter(name))
+	if err != nil {
+		return "", false, errors.Wrapf(err, "failed to look the zone %s up", name)
+	}
+	for _, zone := range res.Result {
+		if zone.Name == name && (b.api.AccountID == "" || zone.Account.ID == b.api.AccountID) {
+			return zone.ID, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// zone returns the ID of the zone owning the dns name, looking it up the
+// first time only.
+func (b *cloudflareDNSBroadcaster) zone(ctx context.Context) (string, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.zoneID != "" {
+		return b.zoneID, nil
+	}
+	candidates := zoneCandidates(b.dnsName, b.zoneName)
+	for _, candidate := range candidates {
+		id, found, err := b.findZone(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			b.zoneID = id
+			return id, nil
+		}
+	}
+	return "", errors.Errorf("no cloudflare zone matches dns=%s (tried %s)", b.dnsName, strings.Join(candidates, ", "))
 }
 
-func (b cloudflareDNSBroadcaster) splitIPs(ips []string, records []cloudflare.DNSRecord) (
-	map[string]struct{}, map[string]cloudflare.DNSRecord, map[string]cloudflare.DNSRecord,
+func (b *cloudflareDNSBroadcaster) splitIPs(ips []string, records []cloudflareRecord) (
+	map[string]struct{}, map[string]cloudflareRecord, map[string]cloudflareRecord,
 ) {
 	newIPs := map[string]struct{}{}
-	commonIPs := map[string]cloudflare.DNSRecord{}
-	oldIPs := map[string]cloudflare.DNSRecord{}
+	commonIPs := map[string]cloudflareRecord{}
+	oldIPs := map[string]cloudflareRecord{}
 	for _, ip := range ips {
 		newIPs[ip] = struct{}{}
 	}
@@ -211,40 +748,250 @@ func (b cloudflareDNSBroadcaster) splitIPs(ips []string, records []cloudflare.DN
 	return newIPs, commonIPs, oldIPs
 }
 
-func (b cloudflareDNSBroadcaster) newRecord(ip string) cloudflare.DNSRecord {
-	return cloudflare.DNSRecord{
-		Type:    "A",
+type cloudflareRecordSet struct {
+	typ string
+	ips []string
+}
+
+// recordSets splits the IPs into the A and AAAA record sets to reconcile.
+func (b *cloudflareDNSBroadcaster) recordSets(ips []string) ([]cloudflareRecordSet, error) {
+	v4, v6, err := SplitFamilies(ips)
+	if err != nil {
+		return nil, Permanent(errors.Wrap(err, "unable to publish dns records"))
+	}
+	var sets []cloudflareRecordSet
+	if b.family != IPv6 {
+		sets = append(sets, cloudflareRecordSet{"A", v4})
+	}
+	if b.family != IPv4 {
+		sets = append(sets, cloudflareRecordSet{"AAAA", v6})
+	}
+	return sets, nil
+}
+
+func (b *cloudflareDNSBroadcaster) newRecord(typ, ip string) cloudflareRecord {
+	record := cloudflareRecord{
+		Type:    typ,
 		Name:    b.dnsName,
 		Content: ip,
+		TTL:     b.ttl,
+		Comment: b.comment,
+		Tags:    b.tags,
 	}
+	if b.proxied != nil {
+		record.Proxied = b.proxied
+	}
+	return record
 }
 
-func (b cloudflareDNSBroadcaster) Broadcast(ctx context.Context, ips []string) error {
-	zoneID, err := b.api.ZoneIDByName(b.dnsName)
+// outdated tells whether the managed attributes of an existing record
+// differ from the desired ones.
+func (b *cloudflareDNSBroadcaster) outdated(record cloudflareRecord) bool {
+	if b.ttl != 0 && record.TTL != b.ttl {
+		return true
+	}
+	if b.proxied != nil && (record.Proxied == nil || *record.Proxied != *b.proxied) {
+		return true
+	}
+	if b.comment != "" && record.Comment != b.comment {
+		return true
+	}
+	if b.tags != nil {
+		var tags []string
+		if record.Tags != nil {
+			tags = append(tags, *record.Tags...)
+		}
+		sort.Strings(tags)
+		return diff(tags, *b.tags)
+	}
+	return false
+}
+
+func (b *cloudflareDNSBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	zoneID, changes, err := b.changes(ctx, ips)
 	if err != nil {
-		return errors.Wrapf(err, "unable to determine the zone for dns=%s", b.dnsName)
+		return err
+	}
+	var errs []error
+	for _, c := range changes {
+		errs = append(errs, b.reconcile(zoneID, c)...)
 	}
-	records, err := b.api.DNSRecords(zoneID, cloudflare.DNSRecord{Type: "A", Name: b.dnsName})
+	return combineErrors(errs)
+}
+
+func (b *cloudflareDNSBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	_, changes, err := b.changes(ctx, ips)
 	if err != nil {
-		return errors.Wrapf(err, "failed to fetch A-records for zoneID:%s,dns:%s", zoneID, b.dnsName)
+		return nil, err
 	}
-	newIPs, commonIPs, oldIPs := b.splitIPs(ips, records)
-	for _, record := range oldIPs {
-		id := record.ID
-		if err := b.api.DeleteDNSRecord(zoneID, id); err != nil {
-			return errors.Wrapf(err, "failed to delete a record id:%s", id)
+	plan := Plan{}
+	for _, c := range changes {
+		target := c.typ + " " + b.dnsName
+		for _, ip := range c.creates {
+			plan = append(plan, Action{Kind: CreateAction, Target: target, Value: ip})
+		}
+		for _, record := range c.updates {
+			plan = append(plan, Action{Kind: UpdateAction, Target: target, Value: record.Content})
+		}
+		for _, record := range c.deletes {
+			plan = append(plan, Action{Kind: DeleteAction, Target: target, Value: record.Content})
 		}
 	}
-	for ip, record := range commonIPs {
-		id := record.ID
-		if err := b.api.UpdateDNSRecord(zoneID, id, b.newRecord(ip)); err != nil {
-			return errors.Wrapf(err, "failed to update a record id:%s", id)
+	return plan, nil
+}
+
+func sortedIPs(ips map[string]struct{}) []string {
+	var res []string
+	for ip := range ips {
+		res = append(res, ip)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func sortedRecordIPs(records map[string]cloudflareRecord) []string {
+	var res []string
+	for ip := range records {
+		res = append(res, ip)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// cloudflareChanges are the operations bringing the records of a type in
+// line with the IPs.
+type cloudflareChanges struct {
+	typ     string
+	ips     []string
+	creates []string
+	updates []cloudflareRecord
+	deletes []cloudflareRecord
+	kept    int
+}
+
+func (b *cloudflareDNSBroadcaster) changes(ctx context.Context, ips []string) (string, []cloudflareChanges, error) {
+	sets, err := b.recordSets(ips)
+	if err != nil {
+		return "", nil, err
+	}
+	zoneID, err := b.zone(ctx)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "unable to determine the zone for dns=%s", b.dnsName)
+	}
+	var changes []cloudflareChanges
+	for _, set := range sets {
+		records, err := b.listRecords(zoneID, set.typ)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "failed to fetch %s-records for zoneID:%s,dns:%s", set.typ, zoneID, b.dnsName)
+		}
+		newIPs, commonIPs, oldIPs := b.splitIPs(set.ips, records)
+		c := cloudflareChanges{typ: set.typ, ips: set.ips, creates: sortedIPs(newIPs)}
+		for _, ip := range sortedRecordIPs(commonIPs) {
+			if b.outdated(commonIPs[ip]) {
+				c.updates = append(c.updates, commonIPs[ip])
+			} else {
+				c.kept++
+			}
+		}
+		for _, ip := range sortedRecordIPs(oldIPs) {
+			c.deletes = append(c.deletes, oldIPs[ip])
+		}
+		changes = append(changes, c)
+	}
+	return zoneID, changes, nil
+}
+
+// reconcile creates the missing records before updating and deleting the
+// others so that the name always resolves. It goes on after a failure and
+// returns all the errors.
+func (b *cloudflareDNSBroadcaster) reconcile(zoneID string, c cloudflareChanges) []error {
+	var errs []error
+	var created []cloudflareRecord
+	for _, ip := range c.creates {
+		record, err := b.createRecord(zoneID, b.newRecord(c.typ, ip))
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to create a record ip:%s", ip))
+			continue
 		}
+		created = append(created, record)
 	}
-	for ip := range newIPs {
-		if _, err := b.api.CreateDNSRecord(zoneID, b.newRecord(ip)); err != nil {
-			return errors.Wrapf(err, "failed to create a record ip:%s", ip)
+	for _, record := range c.updates {
+		if err := b.updateRecord(zoneID, record.ID, b.newRecord(c.typ, record.Content)); err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to update a record id:%s", record.ID))
 		}
 	}
-	return nil
+	if len(errs) != 0 && b.rollback {
+		for _, record := range created {
+			if err := b.api.DeleteDNSRecord(zoneID, record.ID); err != nil {
+				errs = append(errs, errors.Wrapf(err, "failed to roll back the record id:%s", record.ID))
+			}
+		}
+		return errs
+	}
+	if len(c.ips) != 0 && len(created)+len(c.updates)+c.kept == 0 && len(c.deletes) != 0 {
+		return append(errs, errors.Errorf("kept the stale %s-records of dns:%s as none of the new ones could be created", c.typ, b.dnsName))
+	}
+	for _, record := range c.deletes {
+		if err := b.api.DeleteDNSRecord(zoneID, record.ID); err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to delete a record id:%s", record.ID))
+		}
+	}
+	return errs
+}
+
+// cloudflareRecord is a dns record with the attributes the cloudflare
+// client does not know about (comment, tags). Proxied and Tags are pointers
+// so that they can be left out of updates, an empty list of tags is sent.
+type cloudflareRecord struct {
+	ID      string    `json:"id,omitempty"`
+	ZoneID  string    `json:"zone_id,omitempty"`
+	Type    string    `json:"type,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Content string    `json:"content,omitempty"`
+	TTL     int       `json:"ttl,omitempty"`
+	Proxied *bool     `json:"proxied,omitempty"`
+	Comment string    `json:"comment,omitempty"`
+	Tags    *[]string `json:"tags,omitempty"`
+}
+
+const cloudflarePageSize = 100
+
+func (b *cloudflareDNSBroadcaster) listRecords(zoneID, typ string) ([]cloudflareRecord, error) {
+	var records []cloudflareRecord
+	query := url.Values{}
+	query.Set("name", b.dnsName)
+	query.Set("type", typ)
+	query.Set("per_page", strconv.Itoa(cloudflarePageSize))
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		res, err := b.api.Raw(http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var pageRecords []cloudflareRecord
+		if err := json.Unmarshal(res, &pageRecords); err != nil {
+			return nil, errors.Wrap(err, "failed to decode the records")
+		}
+		records = append(records, pageRecords...)
+		if len(pageRecords) < cloudflarePageSize {
+			return records, nil
+		}
+	}
+}
+
+func (b *cloudflareDNSBroadcaster) createRecord(zoneID string, record cloudflareRecord) (cloudflareRecord, error) {
+	res, err := b.api.Raw(http.MethodPost, "/zones/"+zoneID+"/dns_records", record)
+	if err != nil {
+		return cloudflareRecord{}, err
+	}
+	created := cloudflareRecord{}
+	if err := json.Unmarshal(res, &created); err != nil {
+		return cloudflareRecord{}, errors.Wrap(err, "failed to decode the created record")
+	}
+	return created, nil
+}
+
+func (b *cloudflareDNSBroadcaster) updateRecord(zoneID, id string, record cloudflareRecord) error {
+	_, err := b.api.Raw(http.MethodPatch, "/zones/"+zoneID+"/dns_records/"+id, record)
+	return err
 }
@@ -1,7 +1,16 @@
 package ip8s
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/nlopes/slack"
 )
 
 type defaultSlackTemplateTestCase struct {
@@ -39,3 +48,685 @@ func TestDefaultSlackTemplate(t *testing.T) {
 		})
 	}
 }
+
+type validateDNSNameTestCase struct {
+	name  string
+	valid bool
+}
+
+func TestValidateDNSName(t *testing.T) {
+	testCases := map[string]validateDNSNameTestCase{
+		"Empty":           {name: "", valid: false},
+		"Apex":            {name: "example.com", valid: true},
+		"Subdomain":       {name: "app.example.com", valid: true},
+		"FullyQualified":  {name: "app.example.com.", valid: true},
+		"Wildcard":        {name: "*.example.com", valid: true},
+		"InnerWildcard":   {name: "app.*.example.com", valid: false},
+		"EmptyLabel":      {name: "app..example.com", valid: false},
+		"LeadingHyphen":   {name: "-app.example.com", valid: false},
+		"InvalidChar":     {name: "app!.example.com", valid: false},
+		"TooLongLabel":    {name: strings.Repeat("a", 64) + ".com", valid: false},
+		"TooLongName":     {name: strings.Repeat("a.", 127) + "com", valid: false},
+		"UnderscoreLabel": {name: "_acme.example.com", valid: true},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := validateDNSName(testCase.name)
+			if testCase.valid && err != nil {
+				t.Errorf("name rejected: expected <nil> but got %v", err)
+			} else if !testCase.valid && err == nil {
+				t.Error("name accepted: expected an error but got <nil>")
+			}
+		})
+	}
+}
+
+func TestNewSlackBroadcaster(t *testing.T) {
+	if _, err := NewSlackBroadcaster("", "C123", "example.com"); err == nil {
+		t.Error("missing token accepted")
+	}
+	if _, err := NewSlackBroadcaster("xoxb", "", "example.com"); err == nil {
+		t.Error("missing channel accepted")
+	}
+	if _, err := NewSlackBroadcaster("xoxb", "C123", "exa mple.com"); err == nil {
+		t.Error("invalid dns name accepted")
+	}
+	if _, err := NewSlackBroadcaster("xoxb", "C123", "example.com", SlackTemplate("{{ .IPs ")); err == nil {
+		t.Error("invalid template accepted")
+	}
+	if _, err := NewSlackBroadcaster("xoxb", "C123", "example.com", SlackClientOptions(slack.OptionDebug(false))); err != nil {
+		t.Errorf("valid broadcaster rejected: expected <nil> but got %v", err)
+	}
+}
+
+// helperSlackBlocks summarizes the blocks of a message as "type: text"
+// strings, the fields being joined with " | ".
+func helperSlackBlocks(blocks []map[string]interface{}) []string {
+	text := func(object interface{}) string {
+		return object.(map[string]interface{})["text"].(string)
+	}
+	res := make([]string, len(blocks))
+	for i, block := range blocks {
+		var texts []string
+		switch {
+		case block["text"] != nil:
+			texts = append(texts, text(block["text"]))
+		case block["fields"] != nil:
+			for _, field := range block["fields"].([]interface{}) {
+				texts = append(texts, text(field))
+			}
+		case block["elements"] != nil:
+			for _, element := range block["elements"].([]interface{}) {
+				texts = append(texts, text(element))
+			}
+		}
+		res[i] = block["type"].(string) + ": " + strings.Join(texts, " | ")
+	}
+	return res
+}
+
+type slackBroadcasterTestCase struct {
+	opts   []SlackOption
+	change Change
+	text   string
+	blocks []string
+}
+
+func TestSlackBroadcaster(t *testing.T) {
+	testCases := map[string]slackBroadcasterTestCase{
+		"Default": {
+			change: newChange([]string{"1.2.3.4", "1.2.3.5"}, []string{"1.2.3.5", "1.2.3.6"}, nil),
+			text:   "IPs for example.com changed:\n_1.2.3.5\t1.2.3.6_",
+			blocks: []string{
+				"section: IPs for example.com changed:\n_1.2.3.5\t1.2.3.6_",
+				"section: *Added*\n1.2.3.6 | *Removed*\n1.2.3.4",
+				"context: 2 IPs",
+			},
+		},
+		"Deleted": {
+			change: newChange([]string{"1.2.3.4"}, []string{}, nil),
+			text:   "IPs for example.com were deleted",
+			blocks: []string{
+				"section: IPs for example.com were deleted",
+				"section: *Removed*\n1.2.3.4",
+				"context: 0 IPs",
+			},
+		},
+		"Unknown": {
+			change: Change{IPs: []string{"1.2.3.4"}},
+			text:   "IPs for example.com changed:\n_1.2.3.4_",
+			blocks: []string{
+				"section: IPs for example.com changed:\n_1.2.3.4_",
+				"context: 1 IPs",
+			},
+		},
+		"Template": {
+			opts: []SlackOption{
+				SlackCluster("prod"),
+				SlackTemplate(`{{ .Cluster }}/{{ .DNSName }}: +{{ join "," .Added }} -{{ join "," .Removed }}`),
+			},
+			change: newChange([]string{"1.2.3.4"}, []string{"1.2.3.5", "1.2.3.6"}, nil),
+			text:   "prod/example.com: +1.2.3.5,1.2.3.6 -1.2.3.4",
+			blocks: []string{
+				"section: prod/example.com: +1.2.3.5,1.2.3.6 -1.2.3.4",
+				"section: *Added*\n1.2.3.5\n1.2.3.6 | *Removed*\n1.2.3.4",
+				"context: Cluster *prod* | 2 IPs",
+			},
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := helperSlack(t)
+			defer server.Close()
+			b, err := NewSlackBroadcaster("xoxb", "C123", "example.com", append(testCase.opts, server.Option())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := BroadcastChange(context.Background(), b, testCase.change); err != nil {
+				t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+			}
+			messages := server.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("invalid messages: expected 1 but got %v", len(messages))
+			}
+			if messages[0].Channel != "C123" || messages[0].Text != testCase.text {
+				t.Errorf("invalid message: expected %q in C123 but got %q in %s", testCase.text, messages[0].Text, messages[0].Channel)
+			}
+			if blocks := helperSlackBlocks(messages[0].Blocks); !reflect.DeepEqual(blocks, testCase.blocks) {
+				t.Errorf("invalid blocks: expected %q but got %q", testCase.blocks, blocks)
+			}
+		})
+	}
+}
+
+func TestSlackBroadcasterTemplateError(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	b, err := NewSlackBroadcaster("xoxb", "C123", "example.com", SlackTemplate("{{ .Zone }}"), server.Option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err == nil || IsRetryable(err) {
+		t.Errorf("broadcast succeeded: expected a permanent error but got %v", err)
+	}
+	if messages := server.Messages(); len(messages) != 0 {
+		t.Errorf("message posted: expected none but got %v", messages)
+	}
+}
+
+func TestSlackIPList(t *testing.T) {
+	ips := make([]string, 200)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("2001:db8::%x", i)
+	}
+	text := ipList("Added", ips).Text
+	if len(text) > slackFieldLength {
+		t.Errorf("field too long: expected at most %d characters but got %d", slackFieldLength, len(text))
+	}
+	lines := strings.Split(text, "\n")
+	shown := len(lines) - 2
+	if expected := fmt.Sprintf("… and %d more", len(ips)-shown); lines[len(lines)-1] != expected {
+		t.Errorf("invalid last line: expected '%s' but got '%s'", expected, lines[len(lines)-1])
+	}
+	if text := ipList("Removed", ips[:2]).Text; text != "*Removed*\n2001:db8::0\n2001:db8::1" {
+		t.Errorf("invalid short list: expected all the IPs but got '%s'", text)
+	}
+}
+
+func TestSlackBlocksLongText(t *testing.T) {
+	b := &slackBroadcaster{}
+	section := b.blocks(strings.Repeat("é", slackSectionLength), Change{})[0].(*slack.SectionBlock)
+	if text := section.Text.Text; len(text) > slackSectionLength || !utf8.ValidString(text) || !strings.HasSuffix(text, "é…") {
+		t.Errorf("invalid section: expected at most %d characters cut after an é but got %d", slackSectionLength, len(text))
+	}
+	if text := b.blocks("short", Change{})[0].(*slack.SectionBlock).Text.Text; text != "short" {
+		t.Errorf("invalid short section: expected 'short' but got '%s'", text)
+	}
+}
+
+func TestNewSlackWebhookBroadcaster(t *testing.T) {
+	url := "https://hooks.slack.com/services/T000/B000/XXX"
+	if _, err := NewSlackWebhookBroadcaster(nil, "example.com"); err == nil {
+		t.Error("missing url accepted")
+	}
+	if _, err := NewSlackWebhookBroadcaster([]string{"hooks.slack.com/services/T000/B000/XXX"}, "example.com"); err == nil {
+		t.Error("relative url accepted")
+	} else if strings.Contains(err.Error(), "XXX") {
+		t.Errorf("secret url logged: expected no url but got %v", err)
+	}
+	if _, err := NewSlackWebhookBroadcaster([]string{url}, "example.com", SlackThread()); err == nil {
+		t.Error("thread accepted")
+	}
+	if _, err := NewSlackWebhookBroadcaster([]string{url}, "example.com", SlackCluster("prod")); err != nil {
+		t.Errorf("valid broadcaster rejected: expected <nil> but got %v", err)
+	}
+}
+
+func TestSlackWebhookBroadcaster(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	b, err := NewSlackWebhookBroadcaster([]string{server.WebhookURL("ops"), server.WebhookURL("dev")}, "example.com", SlackCluster("prod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := newChange([]string{"1.2.3.4"}, []string{"1.2.3.5"}, nil)
+	if err := BroadcastChange(context.Background(), b, change); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	messages := server.Messages()
+	if len(messages) != 2 || messages[0].Channel != "ops" || messages[1].Channel != "dev" {
+		t.Fatalf("invalid messages: expected to ops and dev but got %+v", messages)
+	}
+	expected := []string{
+		"section: IPs for example.com changed:\n_1.2.3.5_",
+		"section: *Added*\n1.2.3.5 | *Removed*\n1.2.3.4",
+		"context: Cluster *prod* | 1 IPs",
+	}
+	for _, message := range messages {
+		if message.Text != "IPs for example.com changed:\n_1.2.3.5_" {
+			t.Errorf("invalid text: expected the default template but got %q", message.Text)
+		}
+		if blocks := helperSlackBlocks(message.Blocks); !reflect.DeepEqual(blocks, expected) {
+			t.Errorf("invalid blocks: expected %q but got %q", expected, blocks)
+		}
+	}
+	plan, err := PlanBroadcast(context.Background(), b, []string{"1.2.3.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 2 || plan[1].Target != "slack webhook #1" || strings.Contains(plan.String(), server.WebhookURL("")) {
+		t.Errorf("invalid plan: expected a message per webhook but got\n%s", plan)
+	}
+}
+
+type slackWebhookFailureTestCase struct {
+	status    int
+	code      string
+	retryable bool
+}
+
+func TestSlackWebhookBroadcasterFailures(t *testing.T) {
+	testCases := map[string]slackWebhookFailureTestCase{
+		"NoService":   {status: http.StatusNotFound, code: "no_service", retryable: false},
+		"RateLimited": {status: http.StatusTooManyRequests, code: "rate_limited", retryable: true},
+		"Unavailable": {status: http.StatusInternalServerError, code: "internal_error", retryable: true},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := helperSlack(t)
+			defer server.Close()
+			server.FailWebhooks(testCase.status, testCase.code)
+			b, err := NewSlackWebhookBroadcaster([]string{server.WebhookURL("ops")}, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Broadcast(context.Background(), []string{"1.2.3.4"})
+			if err == nil {
+				t.Fatal("broadcast succeeded: expected an error but got <nil>")
+			}
+			if IsRetryable(err) != testCase.retryable {
+				t.Errorf("invalid classification: expected retryable %v but got %v", testCase.retryable, err)
+			}
+			if !strings.Contains(err.Error(), testCase.code) || strings.Contains(err.Error(), "/services/") {
+				t.Errorf("invalid error: expected %s without the url but got %v", testCase.code, err)
+			}
+		})
+	}
+}
+
+func TestSlackBroadcasterThread(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	b, err := NewSlackBroadcaster("xoxb", "C123", "example.com", SlackThread(), server.Option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ips := range [][]string{{"1.2.3.4"}, {"1.2.3.5"}, {}} {
+		if err := b.Broadcast(context.Background(), ips); err != nil {
+			t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+		}
+	}
+	messages := server.Messages()
+	threads := make([]string, len(messages))
+	for i, message := range messages {
+		threads[i] = message.ThreadTS
+	}
+	if expected := []string{"", "1.000100", "1.000100"}; !reflect.DeepEqual(threads, expected) {
+		t.Errorf("invalid threads: expected %q but got %q", expected, threads)
+	}
+}
+
+func TestNewCloudflareDNSBroadcaster(t *testing.T) {
+	api, err := cloudflare.NewWithAPIToken("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCloudflareDNSBroadcaster(nil, "example.com"); err == nil {
+		t.Error("missing client accepted")
+	}
+	if _, err := NewCloudflareDNSBroadcaster(api, ""); err == nil {
+		t.Error("missing dns name accepted")
+	}
+	if _, err := NewCloudflareDNSBroadcaster(api, "app.example.com"); err != nil {
+		t.Errorf("valid broadcaster rejected: expected <nil> but got %v", err)
+	}
+}
+
+type cloudflareBroadcastTestCase struct {
+	initial [][2]string
+	opts    []CloudflareOption
+	ips     []string
+	result  []string
+	err     bool
+}
+
+func TestCloudflareDNSBroadcaster(t *testing.T) {
+	testCases := map[string]cloudflareBroadcastTestCase{
+		"Create": {
+			ips:    []string{"1.2.3.4", "1.2.3.5"},
+			result: []string{"A 1.2.3.4", "A 1.2.3.5"},
+		},
+		"Replace": {
+			initial: [][2]string{{"A", "1.2.3.4"}, {"A", "1.2.3.6"}},
+			ips:     []string{"1.2.3.4", "1.2.3.5"},
+			result:  []string{"A 1.2.3.4", "A 1.2.3.5"},
+		},
+		"DeleteAll": {
+			initial: [][2]string{{"A", "1.2.3.4"}, {"AAAA", "2001:db8::1"}},
+			opts:    []CloudflareOption{CloudflareAddressFamily(AllFamilies)},
+			ips:     nil,
+			result:  []string{},
+		},
+		"DualStack": {
+			initial: [][2]string{{"A", "1.2.3.4"}, {"AAAA", "2001:db8::2"}},
+			opts:    []CloudflareOption{CloudflareAddressFamily(AllFamilies)},
+			ips:     []string{"1.2.3.4", "2001:db8::1"},
+			result:  []string{"A 1.2.3.4", "AAAA 2001:db8::1"},
+		},
+		// the AAAA records managed by hand survive the default
+		"DefaultIPv4": {
+			initial: [][2]string{{"A", "1.2.3.5"}, {"AAAA", "2001:db8::2"}},
+			ips:     []string{"1.2.3.4"},
+			result:  []string{"A 1.2.3.4", "AAAA 2001:db8::2"},
+		},
+		"OnlyIPv4": {
+			initial: [][2]string{{"AAAA", "2001:db8::2"}},
+			opts:    []CloudflareOption{CloudflareAddressFamily(IPv4)},
+			ips:     []string{"1.2.3.4", "2001:db8::1"},
+			result:  []string{"A 1.2.3.4", "AAAA 2001:db8::2"},
+		},
+		"OnlyIPv6": {
+			initial: [][2]string{{"A", "1.2.3.5"}},
+			opts:    []CloudflareOption{CloudflareAddressFamily(IPv6)},
+			ips:     []string{"1.2.3.4", "2001:db8::1"},
+			result:  []string{"A 1.2.3.5", "AAAA 2001:db8::1"},
+		},
+		"Hostname": {
+			initial: [][2]string{{"A", "1.2.3.5"}},
+			ips:     []string{"1.2.3.4", "node1.example.com"},
+			result:  []string{"A 1.2.3.5"},
+			err:     true,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake, api := helperCloudflare(t, "example.com")
+			defer fake.Close()
+			for _, record := range testCase.initial {
+				fake.AddRecord(record[0], "example.com", record[1])
+			}
+			b, err := NewCloudflareDNSBroadcaster(api, "example.com", testCase.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Broadcast(context.Background(), testCase.ips)
+			if testCase.err && err == nil {
+				t.Error("broadcast succeeded: expected an error but got <nil>")
+			} else if !testCase.err && err != nil {
+				t.Errorf("broadcast failed: expected <nil> but got %v", err)
+			}
+			if res := fake.Contents("example.com"); !helperEqual(res, testCase.result) {
+				t.Errorf("invalid records: expected %v but got %v", testCase.result, res)
+			}
+		})
+	}
+}
+
+func helperCountRequests(requests []string, prefix string) int {
+	count := 0
+	for _, request := range requests {
+		if strings.HasPrefix(request, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestCloudflareDNSBroadcasterZone(t *testing.T) {
+	fake, api := helperCloudflare(t, "example.com", "other.example.com")
+	defer fake.Close()
+	b, err := NewCloudflareDNSBroadcaster(api, "app.eu.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+			t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+		}
+	}
+	requests := fake.Requests()
+	expected := []string{"GET zones app.eu.example.com", "GET zones eu.example.com", "GET zones example.com"}
+	if !helperEqual(requests[:3], expected) {
+		t.Errorf("invalid zone lookup: expected %v but got %v", expected, requests[:3])
+	}
+	if count := helperCountRequests(requests, "GET zones"); count != 3 {
+		t.Errorf("zone not cached: expected 3 lookups but got %v", count)
+	}
+	records := fake.Records("app.eu.example.com")
+	if len(records) != 1 || records[0].ZoneID != "zone-example.com" {
+		t.Errorf("record created in the wrong zone: %v", records)
+	}
+}
+
+func TestCloudflareDNSBroadcasterExplicitZone(t *testing.T) {
+	fake, api := helperCloudflare(t, "example.com", "app.example.com")
+	defer fake.Close()
+	if _, err := NewCloudflareDNSBroadcaster(api, "app.example.com", CloudflareZoneName("example.org")); err == nil {
+		t.Error("zone not matching the dns name accepted")
+	}
+	b, err := NewCloudflareDNSBroadcaster(api, "app.example.com", CloudflareZoneName("example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if records := fake.Records("app.example.com"); len(records) != 1 || records[0].ZoneID != "zone-example.com" {
+		t.Errorf("record created in the wrong zone: %v", records)
+	}
+
+	b, err = NewCloudflareDNSBroadcaster(api, "www.example.com", CloudflareZoneID("zone-example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if count := helperCountRequests(fake.Requests(), "GET zones"); count != 1 {
+		t.Errorf("zone looked up despite its ID: expected 1 lookup but got %v", count)
+	}
+}
+
+func TestCloudflareDNSBroadcasterUnknownZone(t *testing.T) {
+	fake, api := helperCloudflare(t, "example.com")
+	defer fake.Close()
+	b, err := NewCloudflareDNSBroadcaster(api, "app.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Broadcast(context.Background(), []string{"1.2.3.4"})
+	if err == nil || !strings.Contains(err.Error(), "no cloudflare zone matches dns=app.example.org") {
+		t.Errorf("invalid error: expected a missing zone error but got %v", err)
+	}
+}
+
+func TestCloudflareDNSBroadcasterAttributes(t *testing.T) {
+	fake, api := helperCloudflare(t, "example.com")
+	defer fake.Close()
+	b, err := NewCloudflareDNSBroadcaster(api, "example.com",
+		CloudflareTTL(300),
+		CloudflareProxied(true),
+		CloudflareComment("managed by ip8s"),
+		CloudflareTags("team:infra", "env:prod"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	records := fake.Records("example.com")
+	if len(records) != 1 {
+		t.Fatalf("invalid records: expected 1 record but got %v", records)
+	}
+	record := records[0]
+	if record.TTL != 300 || record.Proxied == nil || !*record.Proxied || record.Comment != "managed by ip8s" ||
+		record.Tags == nil || !helperEqual(*record.Tags, []string{"env:prod", "team:infra"}) {
+		t.Errorf("invalid record attributes: %+v", record)
+	}
+
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if count := helperCountRequests(fake.Requests(), "PATCH"); count != 0 {
+		t.Errorf("up-to-date record updated: expected 0 update but got %v", count)
+	}
+
+	fake.Update(record.ID, func(r *cloudflareRecord) { r.TTL = 120 })
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if ttl := fake.Records("example.com")[0].TTL; ttl != 300 {
+		t.Errorf("ttl not restored: expected 300 but got %v", ttl)
+	}
+}
+
+func TestCloudflareDNSBroadcasterUnmanagedAttributes(t *testing.T) {
+	fake, api := helperCloudflare(t, "example.com")
+	defer fake.Close()
+	id := fake.AddRecord("A", "example.com", "1.2.3.4")
+	fake.Update(id, func(r *cloudflareRecord) {
+		proxied := true
+		r.TTL = 120
+		r.Proxied = &proxied
+	})
+	b, err := NewCloudflareDNSBroadcaster(api, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if count := helperCountRequests(fake.Requests(), "PATCH"); count != 0 {
+		t.Errorf("record updated: expected 0 update but got %v", count)
+	}
+	record := fake.Records("example.com")[0]
+	if record.TTL != 120 || !*record.Proxied {
+		t.Errorf("manual changes reset: %+v", record)
+	}
+	if _, err := NewCloudflareDNSBroadcaster(api, "example.com", CloudflareTTL(30)); err == nil {
+		t.Error("invalid ttl accepted")
+	}
+}
+
+func TestCloudflareDNSBroadcasterClearTags(t *testing.T) {
+	fake, api := helperCloudflare(t, "example.com")
+	defer fake.Close()
+	id := fake.AddRecord("A", "example.com", "1.2.3.4")
+	fake.Update(id, func(r *cloudflareRecord) {
+		r.Tags = &[]string{"team:infra"}
+	})
+	b, err := NewCloudflareDNSBroadcaster(api, "example.com", CloudflareTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if tags := fake.Records("example.com")[0].Tags; tags == nil || len(*tags) != 0 {
+		t.Errorf("tags not cleared: expected [] but got %v", tags)
+	}
+}
+
+func TestCloudflareDNSBroadcasterOrder(t *testing.T) {
+	fake, api := helperCloudflare(t, "example.com")
+	defer fake.Close()
+	fake.AddRecord("A", "example.com", "1.2.3.4")
+	b, err := NewCloudflareDNSBroadcaster(api, "example.com", CloudflareAddressFamily(IPv4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.5"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	expected := []string{"GET zones example.com", "GET A example.com", "POST A 1.2.3.5", "DELETE A 1.2.3.4"}
+	if requests := fake.Requests(); !helperEqual(requests, expected) {
+		t.Errorf("invalid requests: expected %v but got %v", expected, requests)
+	}
+}
+
+type cloudflareFailureTestCase struct {
+	initial  []string
+	failures []string
+	rollback bool
+	ips      []string
+	result   []string
+}
+
+func TestCloudflareDNSBroadcasterFailures(t *testing.T) {
+	testCases := map[string]cloudflareFailureTestCase{
+		"ContinueAfterCreate": {
+			initial:  []string{"1.2.3.4"},
+			failures: []string{"POST 1.2.3.5"},
+			ips:      []string{"1.2.3.5", "1.2.3.6"},
+			result:   []string{"A 1.2.3.6"},
+		},
+		"ContinueAfterDelete": {
+			initial:  []string{"1.2.3.4", "1.2.3.5"},
+			failures: []string{"DELETE 1.2.3.4"},
+			ips:      []string{"1.2.3.6"},
+			result:   []string{"A 1.2.3.4", "A 1.2.3.6"},
+		},
+		"KeepStaleRecords": {
+			initial:  []string{"1.2.3.4"},
+			failures: []string{"POST 1.2.3.5", "POST 1.2.3.6"},
+			ips:      []string{"1.2.3.5", "1.2.3.6"},
+			result:   []string{"A 1.2.3.4"},
+		},
+		"Rollback": {
+			initial:  []string{"1.2.3.4"},
+			failures: []string{"POST 1.2.3.5"},
+			rollback: true,
+			ips:      []string{"1.2.3.5", "1.2.3.6"},
+			result:   []string{"A 1.2.3.4"},
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake, api := helperCloudflare(t, "example.com")
+			defer fake.Close()
+			for _, ip := range testCase.initial {
+				fake.AddRecord("A", "example.com", ip)
+			}
+			for _, failure := range testCase.failures {
+				fake.Fail(failure, http.StatusBadRequest)
+			}
+			opts := []CloudflareOption{CloudflareAddressFamily(IPv4)}
+			if testCase.rollback {
+				opts = append(opts, CloudflareRollback())
+			}
+			b, err := NewCloudflareDNSBroadcaster(api, "example.com", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Broadcast(context.Background(), testCase.ips); err == nil {
+				t.Error("broadcast succeeded: expected an error but got <nil>")
+			}
+			if res := fake.Contents("example.com"); !helperEqual(res, testCase.result) {
+				t.Errorf("invalid records: expected %v but got %v", testCase.result, res)
+			}
+		})
+	}
+}
+
+type changeRecordingBroadcaster struct {
+	recordingBroadcaster
+	changes []Change
+}
+
+func (b *changeRecordingBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	b.changes = append(b.changes, change)
+	return b.err
+}
+
+func TestBroadcastChange(t *testing.T) {
+	change := newChange([]string{"1.2.3.4"}, []string{"1.2.3.5"}, map[string]NodeInfo{"1.2.3.5": {Name: "node2"}})
+	plain := &recordingBroadcaster{}
+	detailed := &changeRecordingBroadcaster{}
+	retried, err := NewRetryBroadcaster(detailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := BroadcastChange(context.Background(), NewMultiBroadcaster(plain, retried), change); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if len(plain.broadcasts) != 1 || !helperEqual(plain.broadcasts[0], []string{"1.2.3.5"}) {
+		t.Errorf("invalid broadcasts: expected [[1.2.3.5]] but got %v", plain.broadcasts)
+	}
+	if len(detailed.broadcasts) != 0 || len(detailed.changes) != 1 || !reflect.DeepEqual(detailed.changes[0], change) {
+		t.Errorf("invalid changes: expected [%+v] but got %+v", change, detailed.changes)
+	}
+	if !helperEqual(change.Added, []string{"1.2.3.5"}) || !helperEqual(change.Removed, []string{"1.2.3.4"}) {
+		t.Errorf("invalid difference: expected +[1.2.3.5] -[1.2.3.4] but got +%v -%v", change.Added, change.Removed)
+	}
+}
@@ -0,0 +1,204 @@
+package ip8s
+
+import (
+	"context"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// Permanent marks an error as not worth retrying.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+var httpStatusPattern = regexp.MustCompile(`HTTP status (\d{3})`)
+
+func retryableStatus(code int) bool {
+	return code == 408 || code == 429 || code >= 500
+}
+
+// IsRetryable is the default classifier of the RetryBroadcaster. Errors are
+// considered transient unless they are marked Permanent, come from a
+// cancelled context or carry a 4xx HTTP status (except 408 and 429). A
+// multiError is retryable as soon as one of its errors is.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var multi multiError
+	if errors.As(err, &multi) {
+		for _, e := range multi {
+			if IsRetryable(e) {
+				return true
+			}
+		}
+		return false
+	}
+	if errors.As(err, &permanentError{}) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var retryable interface{ Retryable() bool }
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+	var withStatus interface{ HTTPStatusCode() int }
+	if errors.As(err, &withStatus) {
+		return retryableStatus(withStatus.HTTPStatusCode())
+	}
+	// the cloudflare client only reports the status in its messages
+	if match := httpStatusPattern.FindStringSubmatch(err.Error()); match != nil {
+		code, _ := strconv.Atoi(match[1])
+		return retryableStatus(code)
+	}
+	return true
+}
+
+type retryBroadcaster struct {
+	broadcaster    Broadcaster
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	retryable      func(error) bool
+
+	l    sync.Mutex
+	rand *rand.Rand
+}
+
+type RetryOption func(*retryBroadcaster)
+
+// RetryMaxAttempts bounds the number of broadcasts, including the first one
+// (default: 5).
+func RetryMaxAttempts(attempts int) RetryOption {
+	return func(b *retryBroadcaster) {
+		b.maxAttempts = attempts
+	}
+}
+
+// RetryBackoff sets the delay before the first retry, doubled after each
+// attempt up to max (default: 1s and 30s).
+func RetryBackoff(initial, max time.Duration) RetryOption {
+	return func(b *retryBroadcaster) {
+		b.initialBackoff = initial
+		b.maxBackoff = max
+	}
+}
+
+// RetryClassifier replaces IsRetryable to decide which errors are retried.
+func RetryClassifier(retryable func(error) bool) RetryOption {
+	return func(b *retryBroadcaster) {
+		b.retryable = retryable
+	}
+}
+
+// NewRetryBroadcaster retries the failed broadcasts of b. It should wrap
+// each broadcaster rather than a multi broadcaster, which would broadcast
+// again to the broadcasters that succeeded.
+func NewRetryBroadcaster(b Broadcaster, opts ...RetryOption) (Broadcaster, error) {
+	r := &retryBroadcaster{
+		broadcaster:    b,
+		maxAttempts:    5,
+		initialBackoff: time.Second,
+		maxBackoff:     30 * time.Second,
+		retryable:      IsRetryable,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.broadcaster == nil {
+		return nil, errors.New("missing broadcaster to retry")
+	}
+	if r.maxAttempts < 1 {
+		return nil, errors.Errorf("invalid max attempts %d", r.maxAttempts)
+	}
+	if r.initialBackoff < 0 || r.maxBackoff < r.initialBackoff {
+		return nil, errors.Errorf("invalid backoff from %s to %s", r.initialBackoff, r.maxBackoff)
+	}
+	if r.retryable == nil {
+		return nil, errors.New("missing retry classifier")
+	}
+	return r, nil
+}
+
+// backoff returns the delay before the given retry, with a random jitter
+// of up to half the delay.
+func (b *retryBroadcaster) backoff(retry int, err error) time.Duration {
+	delay := b.initialBackoff
+	for i := 1; i < retry && delay < b.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > b.maxBackoff {
+		delay = b.maxBackoff
+	}
+	if delay > 0 {
+		b.l.Lock()
+		delay -= time.Duration(b.rand.Int63n(int64(delay)/2 + 1))
+		b.l.Unlock()
+	}
+	var rateLimited *slack.RateLimitedError
+	if errors.As(err, &rateLimited) && rateLimited.RetryAfter > delay {
+		delay = rateLimited.RetryAfter
+	}
+	return delay
+}
+
+func (b *retryBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	return b.retry(ctx, func() error {
+		return b.broadcaster.Broadcast(ctx, ips)
+	})
+}
+
+func (b *retryBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	return b.retry(ctx, func() error {
+		return BroadcastChange(ctx, b.broadcaster, change)
+	})
+}
+
+func (b *retryBroadcaster) retry(ctx context.Context, broadcast func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = broadcast()
+		if err == nil {
+			return nil
+		}
+		if !b.retryable(err) {
+			return err
+		}
+		if attempt >= b.maxAttempts {
+			return errors.Wrapf(err, "giving up after %d attempts", attempt)
+		}
+		timer := time.NewTimer(b.backoff(attempt, err))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(err, "retry cancelled after %d attempts", attempt)
+		}
+	}
+}
+
+func (b *retryBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	return PlanBroadcast(ctx, b.broadcaster, ips)
+}
+
+func (b *retryBroadcaster) PlanChange(ctx context.Context, change Change) (Plan, error) {
+	return PlanBroadcastChange(ctx, b.broadcaster, change)
+}
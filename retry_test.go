@@ -0,0 +1,125 @@
+package ip8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+type isRetryableTestCase struct {
+	err    error
+	result bool
+}
+
+func TestIsRetryable(t *testing.T) {
+	testCases := map[string]isRetryableTestCase{
+		"Nil":                 {err: nil, result: false},
+		"Unknown":             {err: errors.New("connection reset by peer"), result: true},
+		"Permanent":           {err: errors.Wrap(Permanent(errors.New("not an IP")), "failed"), result: false},
+		"Cancelled":           {err: errors.Wrap(context.Canceled, "failed"), result: false},
+		"CloudflareRateLimit": {err: errors.Wrap(errors.New("HTTP status 429: content \"\""), "error from makeRequest"), result: true},
+		"CloudflareForbidden": {err: errors.New("HTTP status 403: insufficient permissions"), result: false},
+		"CloudflareFailure":   {err: errors.New("HTTP status 503: service failure"), result: true},
+		"SlackRateLimit":      {err: &slack.RateLimitedError{RetryAfter: time.Second}, result: true},
+		"MultiPermanent":      {err: multiError{Permanent(errors.New("a")), errors.New("HTTP status 401: invalid credentials")}, result: false},
+		"MultiRetryable":      {err: errors.Wrap(multiError{Permanent(errors.New("a")), errors.New("timeout")}, "failed"), result: true},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if res := IsRetryable(testCase.err); res != testCase.result {
+				t.Errorf("invalid classification: expected %v but got %v", testCase.result, res)
+			}
+		})
+	}
+}
+
+type flakyBroadcaster struct {
+	errs     []error
+	attempts int
+}
+
+func (b *flakyBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	b.attempts++
+	if b.attempts > len(b.errs) {
+		return nil
+	}
+	return b.errs[b.attempts-1]
+}
+
+type retryTestCase struct {
+	errs     []error
+	attempts int
+	err      bool
+}
+
+func TestRetryBroadcaster(t *testing.T) {
+	transient := errors.New("HTTP status 502: service failure")
+	testCases := map[string]retryTestCase{
+		"Success":       {errs: nil, attempts: 1, err: false},
+		"Recovered":     {errs: []error{transient, transient}, attempts: 3, err: false},
+		"GiveUp":        {errs: []error{transient, transient, transient, transient}, attempts: 3, err: true},
+		"NotRetryable":  {errs: []error{transient, errors.New("HTTP status 403: forbidden"), transient}, attempts: 2, err: true},
+		"PermanentOnly": {errs: []error{Permanent(transient)}, attempts: 1, err: true},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			flaky := &flakyBroadcaster{errs: testCase.errs}
+			b, err := NewRetryBroadcaster(flaky, RetryMaxAttempts(3), RetryBackoff(time.Millisecond, 4*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Broadcast(context.Background(), []string{"1.2.3.4"})
+			if testCase.err && err == nil {
+				t.Error("broadcast succeeded: expected an error but got <nil>")
+			} else if !testCase.err && err != nil {
+				t.Errorf("broadcast failed: expected <nil> but got %v", err)
+			}
+			if flaky.attempts != testCase.attempts {
+				t.Errorf("invalid attempts: expected %v but got %v", testCase.attempts, flaky.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryBroadcasterCancel(t *testing.T) {
+	flaky := &flakyBroadcaster{errs: []error{errors.New("timeout"), errors.New("timeout")}}
+	b, err := NewRetryBroadcaster(flaky, RetryBackoff(time.Hour, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := b.Broadcast(ctx, nil); err == nil {
+		t.Error("broadcast succeeded: expected an error but got <nil>")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancellation ignored: waited %s", elapsed)
+	}
+	if flaky.attempts != 1 {
+		t.Errorf("invalid attempts: expected 1 but got %v", flaky.attempts)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	b, err := NewRetryBroadcaster(&flakyBroadcaster{}, RetryBackoff(time.Second, 5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.(*retryBroadcaster)
+	bounds := [][2]time.Duration{{500 * time.Millisecond, time.Second}, {time.Second, 2 * time.Second}, {2 * time.Second, 4 * time.Second}, {2500 * time.Millisecond, 5 * time.Second}}
+	for i, bound := range bounds {
+		if delay := r.backoff(i+1, errors.New("timeout")); delay < bound[0] || delay > bound[1] {
+			t.Errorf("invalid backoff for retry %v: expected between %s and %s but got %s", i+1, bound[0], bound[1], delay)
+		}
+	}
+	if delay := r.backoff(1, &slack.RateLimitedError{RetryAfter: time.Minute}); delay != time.Minute {
+		t.Errorf("retry-after ignored: expected 1m but got %s", delay)
+	}
+	if _, err := NewRetryBroadcaster(&flakyBroadcaster{}, RetryMaxAttempts(0)); err == nil {
+		t.Error("invalid max attempts accepted")
+	}
+}
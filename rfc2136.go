@@ -0,0 +1,314 @@
+package ip8s
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// RFC2136UpdateMode is the way the records are updated.
+type RFC2136UpdateMode int
+
+const (
+	// ReplaceRRsets deletes the whole RRsets and adds all the records back.
+	ReplaceRRsets RFC2136UpdateMode = iota
+	// MinimalUpdate only deletes the stale records and adds the missing
+	// ones, after querying the server for the current records.
+	MinimalUpdate
+)
+
+type rfc2136Broadcaster struct {
+	server  string
+	zone    string
+	dnsName string
+	family  AddressFamily
+	ttl     uint32
+	mode    RFC2136UpdateMode
+
+	prerequisites bool
+	keyName       string
+	secret        string
+
+	client *dns.Client
+}
+
+type RFC2136Option func(*rfc2136Broadcaster)
+
+// RFC2136AddressFamily selects the reconciled records: A (IPv4, the
+// default), AAAA (IPv6) or both (AllFamilies). The records of the other
+// family are left as is.
+func RFC2136AddressFamily(family AddressFamily) RFC2136Option {
+	return func(b *rfc2136Broadcaster) {
+		b.family = family
+	}
+}
+
+// RFC2136TTL sets the TTL of the added records in seconds (default: 300).
+func RFC2136TTL(ttl uint32) RFC2136Option {
+	return func(b *rfc2136Broadcaster) {
+		b.ttl = ttl
+	}
+}
+
+func RFC2136Mode(mode RFC2136UpdateMode) RFC2136Option {
+	return func(b *rfc2136Broadcaster) {
+		b.mode = mode
+	}
+}
+
+// RFC2136Prerequisites makes the server reject the update when the records
+// changed since they were queried, e.g. by another writer.
+func RFC2136Prerequisites() RFC2136Option {
+	return func(b *rfc2136Broadcaster) {
+		b.prerequisites = true
+	}
+}
+
+// RFC2136TSIG signs the updates with the base64 secret of the key, using
+// hmac-sha256.
+func RFC2136TSIG(keyName, secret string) RFC2136Option {
+	return func(b *rfc2136Broadcaster) {
+		b.keyName = dns.Fqdn(strings.ToLower(keyName))
+		b.secret = secret
+	}
+}
+
+// RFC2136TCP sends the messages over TCP instead of UDP.
+func RFC2136TCP() RFC2136Option {
+	return func(b *rfc2136Broadcaster) {
+		b.client.Net = "tcp"
+	}
+}
+
+// RFC2136Timeout bounds each exchange with the server (default: 5s).
+func RFC2136Timeout(timeout time.Duration) RFC2136Option {
+	return func(b *rfc2136Broadcaster) {
+		b.client.Timeout = timeout
+	}
+}
+
+// NewRFC2136Broadcaster sends DNS UPDATE messages for the records of dnsName
+// in zone to the primary server (host:port).
+func NewRFC2136Broadcaster(server, zone, dnsName string, opts ...RFC2136Option) (Broadcaster, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, errors.Wrapf(err, "invalid dns server %q", server)
+	}
+	if err := validateDNSName(zone); err != nil {
+		return nil, errors.Wrap(err, "invalid zone")
+	}
+	if err := validateDNSName(dnsName); err != nil {
+		return nil, err
+	}
+	if err := validateZoneName(dnsName, zone); err != nil {
+		return nil, err
+	}
+	b := &rfc2136Broadcaster{
+		server:  server,
+		zone:    dns.Fqdn(strings.ToLower(zone)),
+		dnsName: dns.Fqdn(strings.ToLower(dnsName)),
+		family:  IPv4,
+		ttl:     300,
+		client:  &dns.Client{Timeout: 5 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	switch b.family {
+	case AllFamilies, IPv4, IPv6:
+	default:
+		return nil, errors.Errorf("unknown address family %d", b.family)
+	}
+	switch b.mode {
+	case ReplaceRRsets, MinimalUpdate:
+	default:
+		return nil, errors.Errorf("unknown update mode %d", b.mode)
+	}
+	if b.client.Timeout <= 0 {
+		return nil, errors.Errorf("invalid timeout %s", b.client.Timeout)
+	}
+	if b.keyName != "" {
+		if _, err := base64.StdEncoding.DecodeString(b.secret); err != nil || b.secret == "" {
+			return nil, errors.Errorf("invalid tsig secret of %s: expected base64", b.keyName)
+		}
+		b.client.TsigSecret = map[string]string{b.keyName: b.secret}
+	}
+	return b, nil
+}
+
+// rfc2136Error is an unsuccessful response code. Failed prerequisites and
+// server failures are retryable, the other codes reject the update itself.
+type rfc2136Error struct {
+	rcode int
+}
+
+func (e rfc2136Error) Error() string {
+	return "dns server answered " + dns.RcodeToString[e.rcode]
+}
+
+func (e rfc2136Error) Retryable() bool {
+	switch e.rcode {
+	case dns.RcodeServerFailure, dns.RcodeNXRrset, dns.RcodeYXRrset, dns.RcodeYXDomain, dns.RcodeNameError:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *rfc2136Broadcaster) header(typ uint16, class uint16, ttl uint32) dns.RR_Header {
+	return dns.RR_Header{Name: b.dnsName, Rrtype: typ, Class: class, Ttl: ttl}
+}
+
+func (b *rfc2136Broadcaster) record(typ uint16, ip string) dns.RR {
+	if typ == dns.TypeA {
+		return &dns.A{Hdr: b.header(typ, dns.ClassINET, b.ttl), A: net.ParseIP(ip)}
+	}
+	return &dns.AAAA{Hdr: b.header(typ, dns.ClassINET, b.ttl), AAAA: net.ParseIP(ip)}
+}
+
+func (b *rfc2136Broadcaster) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if b.keyName != "" {
+		m.SetTsig(b.keyName, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	r, _, err := b.client.ExchangeContext(ctx, m, b.server)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to reach %s", b.server)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, errors.Wrapf(rfc2136Error{r.Rcode}, "%s", b.server)
+	}
+	return r, nil
+}
+
+// current queries the server for the records of the given type.
+func (b *rfc2136Broadcaster) current(ctx context.Context, typ uint16) ([]string, error) {
+	m := &dns.Msg{}
+	m.SetQuestion(b.dnsName, typ)
+	m.RecursionDesired = false
+	r, err := b.exchange(ctx, m)
+	var rcode rfc2136Error
+	if errors.As(err, &rcode) && rcode.rcode == dns.RcodeNameError {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query the %s records", dns.TypeToString[typ])
+	}
+	var ips []string
+	for _, rr := range r.Answer {
+		switch record := rr.(type) {
+		case *dns.A:
+			ips = append(ips, normalizeAddress(record.A.String()))
+		case *dns.AAAA:
+			ips = append(ips, normalizeAddress(record.AAAA.String()))
+		}
+	}
+	return ips, nil
+}
+
+// update builds the UPDATE message, nil when there is nothing to do.
+func (b *rfc2136Broadcaster) update(ctx context.Context, ips []string) (*dns.Msg, error) {
+	v4, v6, err := SplitFamilies(ips)
+	if err != nil {
+		return nil, Permanent(errors.Wrap(err, "unable to publish dns records"))
+	}
+	desired := map[uint16][]string{}
+	if b.family != IPv6 {
+		desired[dns.TypeA] = v4
+	}
+	if b.family != IPv4 {
+		desired[dns.TypeAAAA] = v6
+	}
+	m := &dns.Msg{}
+	m.SetUpdate(b.zone)
+	changed := false
+	for _, typ := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		ips, managed := desired[typ]
+		if !managed {
+			continue
+		}
+		var current []string
+		if b.mode == MinimalUpdate || b.prerequisites {
+			if current, err = b.current(ctx, typ); err != nil {
+				return nil, err
+			}
+		}
+		if b.prerequisites {
+			if len(current) == 0 {
+				m.RRsetNotUsed([]dns.RR{&dns.ANY{Hdr: b.header(typ, dns.ClassINET, 0)}})
+			} else {
+				rrs := make([]dns.RR, len(current))
+				for i, ip := range current {
+					rrs[i] = b.record(typ, ip)
+					rrs[i].Header().Ttl = 0
+				}
+				m.Used(rrs)
+			}
+		}
+		if b.mode == ReplaceRRsets {
+			m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: b.header(typ, dns.ClassINET, 0)}})
+			for _, ip := range ips {
+				m.Insert([]dns.RR{b.record(typ, ip)})
+			}
+			changed = true
+			continue
+		}
+		for _, ip := range difference(current, ips) {
+			m.Remove([]dns.RR{b.record(typ, ip)})
+			changed = true
+		}
+		for _, ip := range difference(ips, current) {
+			m.Insert([]dns.RR{b.record(typ, ip)})
+			changed = true
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return m, nil
+}
+
+func (b *rfc2136Broadcaster) Broadcast(ctx context.Context, ips []string) error {
+	m, err := b.update(ctx, ips)
+	if err != nil || m == nil {
+		return err
+	}
+	_, err = b.exchange(ctx, m)
+	return errors.Wrapf(err, "failed to update %s", b.dnsName)
+}
+
+func (b *rfc2136Broadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	m, err := b.update(ctx, ips)
+	if err != nil || m == nil {
+		return Plan{}, err
+	}
+	plan := Plan{}
+	target := func(rr dns.RR) string {
+		return dns.TypeToString[rr.Header().Rrtype] + " " + strings.TrimSuffix(b.dnsName, ".")
+	}
+	for _, rr := range m.Ns {
+		switch rr.Header().Class {
+		case dns.ClassANY:
+			plan = append(plan, Action{Kind: DeleteAction, Target: target(rr), Value: "*"})
+		case dns.ClassNONE:
+			plan = append(plan, Action{Kind: DeleteAction, Target: target(rr), Value: rrValue(rr)})
+		default:
+			plan = append(plan, Action{Kind: CreateAction, Target: target(rr), Value: rrValue(rr)})
+		}
+	}
+	return plan, nil
+}
+
+func rrValue(rr dns.RR) string {
+	switch record := rr.(type) {
+	case *dns.A:
+		return record.A.String()
+	case *dns.AAAA:
+		return record.AAAA.String()
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,257 @@
+package ip8s
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+const testTSIGSecret = "c2VjcmV0LXNoYXJlZC13aXRoLXRoZS1kbnMtc2VydmVy"
+
+type newRFC2136BroadcasterTestCase struct {
+	server  string
+	zone    string
+	dnsName string
+	opts    []RFC2136Option
+	valid   bool
+}
+
+func TestNewRFC2136Broadcaster(t *testing.T) {
+	testCases := map[string]newRFC2136BroadcasterTestCase{
+		"Valid": {
+			server:  "ns1.example.com:53",
+			zone:    "example.com",
+			dnsName: "app.example.com",
+			opts:    []RFC2136Option{RFC2136TSIG("ip8s", testTSIGSecret)},
+			valid:   true,
+		},
+		"MissingPort": {
+			server:  "ns1.example.com",
+			zone:    "example.com",
+			dnsName: "app.example.com",
+			valid:   false,
+		},
+		"ForeignZone": {
+			server:  "ns1.example.com:53",
+			zone:    "example.org",
+			dnsName: "app.example.com",
+			valid:   false,
+		},
+		"InvalidSecret": {
+			server:  "ns1.example.com:53",
+			zone:    "example.com",
+			dnsName: "app.example.com",
+			opts:    []RFC2136Option{RFC2136TSIG("ip8s", "not base64!")},
+			valid:   false,
+		},
+		"UnknownMode": {
+			server:  "ns1.example.com:53",
+			zone:    "example.com",
+			dnsName: "app.example.com",
+			opts:    []RFC2136Option{RFC2136Mode(42)},
+			valid:   false,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewRFC2136Broadcaster(testCase.server, testCase.zone, testCase.dnsName, testCase.opts...)
+			if testCase.valid && err != nil {
+				t.Errorf("broadcaster rejected: expected <nil> but got %v", err)
+			} else if !testCase.valid && err == nil {
+				t.Error("broadcaster accepted: expected an error but got <nil>")
+			}
+		})
+	}
+}
+
+type rfc2136BroadcasterTestCase struct {
+	existing map[string][]string
+	ips      []string
+	opts     []RFC2136Option
+	expected []string
+	updates  int
+}
+
+func TestRFC2136Broadcaster(t *testing.T) {
+	testCases := map[string]rfc2136BroadcasterTestCase{
+		"Replace": {
+			existing: map[string][]string{"A": {"1.1.1.1", "1.2.3.4"}, "AAAA": {"2001:db8::1"}},
+			ips:      []string{"1.2.3.4", "5.6.7.8"},
+			opts:     []RFC2136Option{RFC2136AddressFamily(AllFamilies)},
+			expected: []string{"A 1.2.3.4", "A 5.6.7.8"},
+			updates:  1,
+		},
+		// the AAAA records managed by hand survive the default
+		"DefaultIPv4": {
+			existing: map[string][]string{"A": {"1.1.1.1"}, "AAAA": {"2001:db8::1"}},
+			ips:      []string{"1.2.3.4"},
+			expected: []string{"A 1.2.3.4", "AAAA 2001:db8::1"},
+			updates:  1,
+		},
+		"ReplaceUnchanged": {
+			existing: map[string][]string{"A": {"1.2.3.4"}},
+			ips:      []string{"1.2.3.4"},
+			expected: []string{"A 1.2.3.4"},
+			updates:  1,
+		},
+		"Minimal": {
+			existing: map[string][]string{"A": {"1.1.1.1", "1.2.3.4"}, "AAAA": {"2001:db8::1"}},
+			ips:      []string{"1.2.3.4", "2001:db8::1", "5.6.7.8"},
+			opts:     []RFC2136Option{RFC2136Mode(MinimalUpdate)},
+			expected: []string{"A 1.2.3.4", "A 5.6.7.8", "AAAA 2001:db8::1"},
+			updates:  1,
+		},
+		"MinimalUnchanged": {
+			existing: map[string][]string{"A": {"1.2.3.4"}},
+			ips:      []string{"1.2.3.4"},
+			opts:     []RFC2136Option{RFC2136Mode(MinimalUpdate)},
+			expected: []string{"A 1.2.3.4"},
+			updates:  0,
+		},
+		"MinimalCreate": {
+			ips:      []string{"1.2.3.4", "2001:db8::1"},
+			opts:     []RFC2136Option{RFC2136AddressFamily(AllFamilies), RFC2136Mode(MinimalUpdate), RFC2136Prerequisites()},
+			expected: []string{"A 1.2.3.4", "AAAA 2001:db8::1"},
+			updates:  1,
+		},
+		"Prerequisites": {
+			existing: map[string][]string{"A": {"1.1.1.1"}},
+			ips:      []string{"1.2.3.4"},
+			opts:     []RFC2136Option{RFC2136Prerequisites()},
+			expected: []string{"A 1.2.3.4"},
+			updates:  1,
+		},
+		"AddressFamily": {
+			existing: map[string][]string{"A": {"1.1.1.1"}, "AAAA": {"2001:db8::1"}},
+			ips:      []string{"1.2.3.4"},
+			opts:     []RFC2136Option{RFC2136AddressFamily(IPv4), RFC2136Mode(MinimalUpdate)},
+			expected: []string{"A 1.2.3.4", "AAAA 2001:db8::1"},
+			updates:  1,
+		},
+		"TCP": {
+			ips:      []string{"1.2.3.4"},
+			opts:     []RFC2136Option{RFC2136TCP()},
+			expected: []string{"A 1.2.3.4"},
+			updates:  1,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			network := "udp"
+			if name == "TCP" {
+				network = "tcp"
+			}
+			server := helperDNS(t, network, "example.com", "ip8s", testTSIGSecret)
+			defer server.Close()
+			for typ, ips := range testCase.existing {
+				server.Set("app.example.com", typ, ips...)
+			}
+			opts := append([]RFC2136Option{RFC2136TSIG("ip8s", testTSIGSecret)}, testCase.opts...)
+			b, err := NewRFC2136Broadcaster(server.Addr(), "example.com", "app.example.com", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Broadcast(context.Background(), testCase.ips); err != nil {
+				t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+			}
+			if actual := server.Records("app.example.com"); !reflect.DeepEqual(actual, testCase.expected) {
+				t.Errorf("invalid records: expected %v but got %v", testCase.expected, actual)
+			}
+			if updates := server.Updates(); updates != testCase.updates {
+				t.Errorf("invalid updates: expected %d but got %d", testCase.updates, updates)
+			}
+		})
+	}
+}
+
+func TestRFC2136BroadcasterTSIG(t *testing.T) {
+	server := helperDNS(t, "udp", "example.com", "ip8s", testTSIGSecret)
+	defer server.Close()
+	for name, opts := range map[string][]RFC2136Option{
+		"Unsigned":    nil,
+		"WrongSecret": {RFC2136TSIG("ip8s", "b3RoZXItc2VjcmV0")},
+		"WrongKey":    {RFC2136TSIG("other", testTSIGSecret)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, err := NewRFC2136Broadcaster(server.Addr(), "example.com", "app.example.com", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Broadcast(context.Background(), []string{"1.2.3.4"})
+			if err == nil || IsRetryable(err) {
+				t.Errorf("update accepted: expected a permanent error but got %v", err)
+			}
+			if records := server.Records("app.example.com"); len(records) != 0 {
+				t.Errorf("records updated: expected none but got %v", records)
+			}
+		})
+	}
+}
+
+func TestRFC2136BroadcasterPrerequisites(t *testing.T) {
+	server := helperDNS(t, "udp", "example.com", "ip8s", testTSIGSecret)
+	defer server.Close()
+	server.Set("app.example.com", "A", "1.1.1.1")
+	b, err := NewRFC2136Broadcaster(server.Addr(), "example.com", "app.example.com",
+		RFC2136TSIG("ip8s", testTSIGSecret),
+		RFC2136Mode(MinimalUpdate),
+		RFC2136Prerequisites(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another writer changes the records between the query and the update
+	server.Race(func() { server.Set("app.example.com", "A", "9.9.9.9") })
+	err = b.Broadcast(context.Background(), []string{"1.2.3.4"})
+	if err == nil || !IsRetryable(err) {
+		t.Errorf("update accepted: expected a retryable error but got %v", err)
+	}
+	if records := server.Records("app.example.com"); !reflect.DeepEqual(records, []string{"A 9.9.9.9"}) {
+		t.Errorf("concurrent change overwritten: expected [A 9.9.9.9] but got %v", records)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if records := server.Records("app.example.com"); !reflect.DeepEqual(records, []string{"A 1.2.3.4"}) {
+		t.Errorf("invalid records: expected [A 1.2.3.4] but got %v", records)
+	}
+}
+
+func TestRFC2136BroadcasterNotZone(t *testing.T) {
+	server := helperDNS(t, "udp", "other.example.com", "ip8s", testTSIGSecret)
+	defer server.Close()
+	b, err := NewRFC2136Broadcaster(server.Addr(), "example.com", "app.example.com", RFC2136TSIG("ip8s", testTSIGSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err == nil || IsRetryable(err) {
+		t.Errorf("update accepted: expected a permanent error but got %v", err)
+	}
+}
+
+func TestRFC2136Plan(t *testing.T) {
+	server := helperDNS(t, "udp", "example.com", "", "")
+	defer server.Close()
+	server.Set("app.example.com", "A", "1.1.1.1", "1.2.3.4")
+	b, err := NewRFC2136Broadcaster(server.Addr(), "example.com", "app.example.com",
+		RFC2136Mode(MinimalUpdate),
+		RFC2136AddressFamily(IPv4),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanBroadcast(context.Background(), b, []string{"1.2.3.4", "5.6.7.8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Plan{
+		{Kind: DeleteAction, Target: "A app.example.com", Value: "1.1.1.1"},
+		{Kind: CreateAction, Target: "A app.example.com", Value: "5.6.7.8"},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("invalid plan: expected\n%s\nbut got\n%s", expected, plan)
+	}
+	if updates := server.Updates(); updates != 0 {
+		t.Errorf("plan applied: expected no update but got %d", updates)
+	}
+}
@@ -0,0 +1,393 @@
+package ip8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/pkg/errors"
+)
+
+// Route53RoutingPolicy is the routing policy of the published record sets.
+type Route53RoutingPolicy int
+
+const (
+	// SimpleRouting owns the whole record set of the dns name.
+	SimpleRouting Route53RoutingPolicy = iota
+	// WeightedRouting owns a weighted record set, e.g. one per cluster.
+	WeightedRouting
+	// MultiValueRouting owns a multivalue answer record set.
+	MultiValueRouting
+)
+
+type route53Broadcaster struct {
+	api      route53iface.Route53API
+	dnsName  string
+	family   AddressFamily
+	zoneName string
+	ttl      int64
+
+	routing       Route53RoutingPolicy
+	setIdentifier string
+	weight        int64
+
+	wait      bool
+	waitDelay time.Duration
+
+	l      sync.Mutex
+	zoneID string
+}
+
+type Route53Option func(*route53Broadcaster)
+
+// Route53AddressFamily selects the reconciled record sets: A (IPv4, the
+// default), AAAA (IPv6) or both (AllFamilies). The record sets of the other
+// family are left as is.
+func Route53AddressFamily(family AddressFamily) Route53Option {
+	return func(b *route53Broadcaster) {
+		b.family = family
+	}
+}
+
+// Route53TTL sets the TTL of the record sets in seconds (default: 300).
+func Route53TTL(ttl int64) Route53Option {
+	return func(b *route53Broadcaster) {
+		b.ttl = ttl
+	}
+}
+
+// Route53ZoneID skips the hosted zone lookup.
+func Route53ZoneID(zoneID string) Route53Option {
+	return func(b *route53Broadcaster) {
+		b.zoneID = strings.TrimPrefix(zoneID, "/hostedzone/")
+	}
+}
+
+// Route53ZoneName looks the hosted zone up by its name instead of guessing
+// it from the dns name.
+func Route53ZoneName(zoneName string) Route53Option {
+	return func(b *route53Broadcaster) {
+		b.zoneName = zoneName
+	}
+}
+
+// Route53Weighted publishes a weighted record set identified by
+// setIdentifier, with a weight between 0 and 255.
+func Route53Weighted(setIdentifier string, weight int64) Route53Option {
+	return func(b *route53Broadcaster) {
+		b.routing = WeightedRouting
+		b.setIdentifier = setIdentifier
+		b.weight = weight
+	}
+}
+
+// Route53MultiValue publishes a multivalue answer record set identified by
+// setIdentifier.
+func Route53MultiValue(setIdentifier string) Route53Option {
+	return func(b *route53Broadcaster) {
+		b.routing = MultiValueRouting
+		b.setIdentifier = setIdentifier
+	}
+}
+
+// Route53WaitForSync waits for the changes to be propagated to all the
+// Route53 DNS servers (INSYNC) before returning.
+func Route53WaitForSync() Route53Option {
+	return func(b *route53Broadcaster) {
+		b.wait = true
+	}
+}
+
+func NewRoute53Broadcaster(api route53iface.Route53API, dnsName string, opts ...Route53Option) (Broadcaster, error) {
+	if api == nil {
+		return nil, errors.New("missing route53 client")
+	}
+	if err := validateDNSName(dnsName); err != nil {
+		return nil, err
+	}
+	b := &route53Broadcaster{
+		api:       api,
+		dnsName:   dnsName,
+		family:    IPv4,
+		ttl:       300,
+		waitDelay: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	switch b.family {
+	case AllFamilies, IPv4, IPv6:
+	default:
+		return nil, errors.Errorf("unknown address family %d", b.family)
+	}
+	if b.ttl < 0 || b.ttl > 2147483647 {
+		return nil, errors.Errorf("invalid ttl %d", b.ttl)
+	}
+	switch b.routing {
+	case SimpleRouting:
+	case WeightedRouting, MultiValueRouting:
+		if b.setIdentifier == "" || len(b.setIdentifier) > 128 {
+			return nil, errors.Errorf("invalid set identifier %q: must be 1 to 128 characters long", b.setIdentifier)
+		}
+		if b.routing == WeightedRouting && (b.weight < 0 || b.weight > 255) {
+			return nil, errors.Errorf("invalid weight %d: must be between 0 and 255", b.weight)
+		}
+	default:
+		return nil, errors.Errorf("unknown routing policy %d", b.routing)
+	}
+	if err := validateZoneName(b.dnsName, b.zoneName); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// route53Error classifies the errors of the AWS SDK for the retry
+// broadcaster: throttling is retryable even if reported as a 400.
+type route53Error struct {
+	error
+}
+
+func (e route53Error) Unwrap() error {
+	return e.error
+}
+
+func (e route53Error) Retryable() bool {
+	var failure awserr.RequestFailure
+	if !errors.As(e.error, &failure) {
+		return true
+	}
+	switch failure.Code() {
+	case "Throttling", "PriorRequestNotComplete":
+		return true
+	}
+	return retryableStatus(failure.StatusCode())
+}
+
+func wrapRoute53Error(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return route53Error{errors.Wrapf(err, format, args...)}
+}
+
+// fqdn returns the name as reported by Route53: lower case, with a trailing
+// dot and the wildcard escaped.
+func fqdn(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+	if strings.HasPrefix(name, "*.") {
+		name = `\052` + name[1:]
+	}
+	return name
+}
+
+func (b *route53Broadcaster) findZone(ctx context.Context, name string) (string, bool, error) {
+	res, err := b.api.ListHostedZonesByNameWithContext(ctx, &route53.ListHostedZonesByNameInput{
+		DNSName:  aws.String(name),
+		MaxItems: aws.String("10"),
+	})
+	if err != nil {
+		return "", false, wrapRoute53Error(err, "failed to look the hosted zone %s up", name)
+	}
+	// a public zone may share its name with private ones, it is preferred
+	id := ""
+	for _, zone := range res.HostedZones {
+		if aws.StringValue(zone.Name) != fqdn(name) {
+			continue
+		}
+		if zone.Config == nil || !aws.BoolValue(zone.Config.PrivateZone) {
+			return strings.TrimPrefix(aws.StringValue(zone.Id), "/hostedzone/"), true, nil
+		}
+		if id == "" {
+			id = strings.TrimPrefix(aws.StringValue(zone.Id), "/hostedzone/")
+		}
+	}
+	return id, id != "", nil
+}
+
+// zone returns the ID of the hosted zone owning the dns name, looking it up
+// the first time only.
+func (b *route53Broadcaster) zone(ctx context.Context) (string, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.zoneID != "" {
+		return b.zoneID, nil
+	}
+	candidates := zoneCandidates(b.dnsName, b.zoneName)
+	for _, candidate := range candidates {
+		id, found, err := b.findZone(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			b.zoneID = id
+			return id, nil
+		}
+	}
+	return "", errors.Errorf("no route53 hosted zone matches dns=%s (tried %s)", b.dnsName, strings.Join(candidates, ", "))
+}
+
+// existing returns the record sets owned by the broadcaster by type.
+func (b *route53Broadcaster) existing(ctx context.Context, zoneID string) (map[string]*route53.ResourceRecordSet, error) {
+	sets := map[string]*route53.ResourceRecordSet{}
+	name := fqdn(b.dnsName)
+	err := b.api.ListResourceRecordSetsPagesWithContext(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(zoneID),
+		StartRecordName: aws.String(name),
+	}, func(page *route53.ListResourceRecordSetsOutput, last bool) bool {
+		for _, set := range page.ResourceRecordSets {
+			if strings.ToLower(aws.StringValue(set.Name)) != name {
+				// the record sets are sorted by name
+				return false
+			}
+			if aws.StringValue(set.SetIdentifier) == b.setIdentifier {
+				sets[aws.StringValue(set.Type)] = set
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, wrapRoute53Error(err, "failed to list the record sets of %s", b.dnsName)
+	}
+	return sets, nil
+}
+
+func (b *route53Broadcaster) recordSet(typ string, ips []string) *route53.ResourceRecordSet {
+	set := &route53.ResourceRecordSet{
+		Name: aws.String(fqdn(b.dnsName)),
+		Type: aws.String(typ),
+		TTL:  aws.Int64(b.ttl),
+	}
+	for _, ip := range ips {
+		set.ResourceRecords = append(set.ResourceRecords, &route53.ResourceRecord{Value: aws.String(ip)})
+	}
+	switch b.routing {
+	case WeightedRouting:
+		set.SetIdentifier = aws.String(b.setIdentifier)
+		set.Weight = aws.Int64(b.weight)
+	case MultiValueRouting:
+		set.SetIdentifier = aws.String(b.setIdentifier)
+		set.MultiValueAnswer = aws.Bool(true)
+	}
+	return set
+}
+
+func recordSetValues(set *route53.ResourceRecordSet) []string {
+	values := make([]string, len(set.ResourceRecords))
+	for i, record := range set.ResourceRecords {
+		values[i] = aws.StringValue(record.Value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+func outdatedRecordSet(existing, desired *route53.ResourceRecordSet) bool {
+	return aws.Int64Value(existing.TTL) != aws.Int64Value(desired.TTL) ||
+		aws.Int64Value(existing.Weight) != aws.Int64Value(desired.Weight) ||
+		aws.BoolValue(existing.MultiValueAnswer) != aws.BoolValue(desired.MultiValueAnswer) ||
+		diff(recordSetValues(existing), recordSetValues(desired))
+}
+
+// changes returns the UPSERT of the outdated record sets and the DELETE of
+// the record sets without IPs anymore, along with the existing record sets.
+func (b *route53Broadcaster) changes(ctx context.Context, ips []string) (
+	string, []*route53.Change, map[string]*route53.ResourceRecordSet, error,
+) {
+	v4, v6, err := SplitFamilies(ips)
+	if err != nil {
+		return "", nil, nil, Permanent(errors.Wrap(err, "unable to publish dns records"))
+	}
+	desired := map[string][]string{}
+	if b.family != IPv6 {
+		desired["A"] = v4
+	}
+	if b.family != IPv4 {
+		desired["AAAA"] = v6
+	}
+	zoneID, err := b.zone(ctx)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	existing, err := b.existing(ctx, zoneID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var changes []*route53.Change
+	for _, typ := range []string{"A", "AAAA"} {
+		ips, managed := desired[typ]
+		if !managed {
+			continue
+		}
+		set := existing[typ]
+		if len(ips) == 0 {
+			if set != nil {
+				changes = append(changes, &route53.Change{Action: aws.String(route53.ChangeActionDelete), ResourceRecordSet: set})
+			}
+			continue
+		}
+		upsert := b.recordSet(typ, ips)
+		if set == nil || outdatedRecordSet(set, upsert) {
+			changes = append(changes, &route53.Change{Action: aws.String(route53.ChangeActionUpsert), ResourceRecordSet: upsert})
+		}
+	}
+	return zoneID, changes, existing, nil
+}
+
+func (b *route53Broadcaster) Broadcast(ctx context.Context, ips []string) error {
+	zoneID, changes, _, err := b.changes(ctx, ips)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	res, err := b.api.ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("ip8s"),
+			Changes: changes,
+		},
+	})
+	if err != nil {
+		return wrapRoute53Error(err, "failed to change the record sets of %s", b.dnsName)
+	}
+	if !b.wait {
+		return nil
+	}
+	err = b.api.WaitUntilResourceRecordSetsChangedWithContext(ctx,
+		&route53.GetChangeInput{Id: res.ChangeInfo.Id},
+		request.WithWaiterDelay(request.ConstantWaiterDelay(b.waitDelay)),
+	)
+	return wrapRoute53Error(err, "failed to wait for the change %s", aws.StringValue(res.ChangeInfo.Id))
+}
+
+func (b *route53Broadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	_, changes, existing, err := b.changes(ctx, ips)
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{}
+	for _, change := range changes {
+		set := change.ResourceRecordSet
+		action := Action{
+			Kind:   UpdateAction,
+			Target: fmt.Sprintf("%s %s", aws.StringValue(set.Type), b.dnsName),
+			Value:  strings.Join(recordSetValues(set), " "),
+		}
+		if b.setIdentifier != "" {
+			action.Target += " (" + b.setIdentifier + ")"
+		}
+		switch {
+		case aws.StringValue(change.Action) == route53.ChangeActionDelete:
+			action.Kind = DeleteAction
+		case existing[aws.StringValue(set.Type)] == nil:
+			action.Kind = CreateAction
+		}
+		plan = append(plan, action)
+	}
+	return plan, nil
+}
@@ -0,0 +1,369 @@
+package ip8s
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+type newRoute53BroadcasterTestCase struct {
+	dnsName string
+	opts    []Route53Option
+	valid   bool
+}
+
+func TestNewRoute53Broadcaster(t *testing.T) {
+	testCases := map[string]newRoute53BroadcasterTestCase{
+		"Simple": {
+			dnsName: "app.example.com",
+			valid:   true,
+		},
+		"Weighted": {
+			dnsName: "app.example.com",
+			opts:    []Route53Option{Route53Weighted("eu-west", 10)},
+			valid:   true,
+		},
+		"WeightedWithoutIdentifier": {
+			dnsName: "app.example.com",
+			opts:    []Route53Option{Route53Weighted("", 10)},
+			valid:   false,
+		},
+		"InvalidWeight": {
+			dnsName: "app.example.com",
+			opts:    []Route53Option{Route53Weighted("eu-west", 256)},
+			valid:   false,
+		},
+		"MultiValue": {
+			dnsName: "app.example.com",
+			opts:    []Route53Option{Route53MultiValue("eu-west")},
+			valid:   true,
+		},
+		"InvalidTTL": {
+			dnsName: "app.example.com",
+			opts:    []Route53Option{Route53TTL(-1)},
+			valid:   false,
+		},
+		"ForeignZone": {
+			dnsName: "app.example.com",
+			opts:    []Route53Option{Route53ZoneName("example.org")},
+			valid:   false,
+		},
+		"InvalidDNSName": {
+			dnsName: "app..example.com",
+			valid:   false,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewRoute53Broadcaster(&route53.Route53{}, testCase.dnsName, testCase.opts...)
+			if testCase.valid && err != nil {
+				t.Errorf("broadcaster rejected: expected <nil> but got %v", err)
+			} else if !testCase.valid && err == nil {
+				t.Error("broadcaster accepted: expected an error but got <nil>")
+			}
+		})
+	}
+}
+
+type route53BroadcasterTestCase struct {
+	existing []fakeRecordSet
+	ips      []string
+	opts     []Route53Option
+	expected []string
+	changes  int
+}
+
+func TestRoute53Broadcaster(t *testing.T) {
+	testCases := map[string]route53BroadcasterTestCase{
+		"Create": {
+			ips:      []string{"1.2.3.4", "2001:db8::1", "5.6.7.8"},
+			opts:     []Route53Option{Route53AddressFamily(AllFamilies)},
+			expected: []string{"A 1.2.3.4 5.6.7.8", "AAAA 2001:db8::1"},
+			changes:  1,
+		},
+		"Update": {
+			existing: []fakeRecordSet{
+				{Name: "app.example.com", Type: "A", TTL: 300, ResourceRecords: []fakeRecord{{"1.1.1.1"}, {"1.2.3.4"}}},
+			},
+			ips:      []string{"1.2.3.4", "5.6.7.8"},
+			expected: []string{"A 1.2.3.4 5.6.7.8"},
+			changes:  1,
+		},
+		"Unchanged": {
+			existing: []fakeRecordSet{
+				{Name: "app.example.com", Type: "A", TTL: 300, ResourceRecords: []fakeRecord{{"5.6.7.8"}, {"1.2.3.4"}}},
+			},
+			ips:      []string{"1.2.3.4", "5.6.7.8"},
+			expected: []string{"A 1.2.3.4 5.6.7.8"},
+			changes:  0,
+		},
+		"OutdatedTTL": {
+			existing: []fakeRecordSet{
+				{Name: "app.example.com", Type: "A", TTL: 3600, ResourceRecords: []fakeRecord{{"1.2.3.4"}}},
+			},
+			ips:      []string{"1.2.3.4"},
+			opts:     []Route53Option{Route53TTL(60)},
+			expected: []string{"A 1.2.3.4"},
+			changes:  1,
+		},
+		"Delete": {
+			existing: []fakeRecordSet{
+				{Name: "app.example.com", Type: "A", TTL: 300, ResourceRecords: []fakeRecord{{"1.2.3.4"}}},
+				{Name: "app.example.com", Type: "AAAA", TTL: 300, ResourceRecords: []fakeRecord{{"2001:db8::1"}}},
+			},
+			ips:      []string{"1.2.3.4"},
+			opts:     []Route53Option{Route53AddressFamily(AllFamilies)},
+			expected: []string{"A 1.2.3.4"},
+			changes:  1,
+		},
+		// the AAAA record sets managed by hand survive the default
+		"DefaultIPv4": {
+			existing: []fakeRecordSet{
+				{Name: "app.example.com", Type: "A", TTL: 300, ResourceRecords: []fakeRecord{{"1.1.1.1"}}},
+				{Name: "app.example.com", Type: "AAAA", TTL: 300, ResourceRecords: []fakeRecord{{"2001:db8::1"}}},
+			},
+			ips:      []string{"1.2.3.4"},
+			expected: []string{"A 1.2.3.4", "AAAA 2001:db8::1"},
+			changes:  1,
+		},
+		"AddressFamily": {
+			existing: []fakeRecordSet{
+				{Name: "app.example.com", Type: "AAAA", TTL: 300, ResourceRecords: []fakeRecord{{"2001:db8::1"}}},
+			},
+			ips:      []string{"1.2.3.4", "2001:db8::2"},
+			opts:     []Route53Option{Route53AddressFamily(IPv4)},
+			expected: []string{"A 1.2.3.4", "AAAA 2001:db8::1"},
+			changes:  1,
+		},
+		"OtherNames": {
+			existing: []fakeRecordSet{
+				{Name: "api.example.com", Type: "A", TTL: 300, ResourceRecords: []fakeRecord{{"9.9.9.9"}}},
+				{Name: "www.example.com", Type: "A", TTL: 300, ResourceRecords: []fakeRecord{{"9.9.9.9"}}},
+			},
+			ips:      []string{"1.2.3.4"},
+			expected: []string{"A 1.2.3.4"},
+			changes:  1,
+		},
+		"Wildcard": {
+			ips:      []string{"1.2.3.4"},
+			expected: []string{"A 1.2.3.4"},
+			changes:  1,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			f, api := helperRoute53(t, "example.com")
+			defer f.Close()
+			dnsName := "app.example.com"
+			if name == "Wildcard" {
+				dnsName = "*.example.com"
+			}
+			for _, set := range testCase.existing {
+				f.AddRecordSet("Z1", set)
+			}
+			b, err := NewRoute53Broadcaster(api, dnsName, testCase.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Broadcast(context.Background(), testCase.ips); err != nil {
+				t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+			}
+			if actual := f.RecordSets("Z1", dnsName); !reflect.DeepEqual(actual, testCase.expected) {
+				t.Errorf("invalid record sets: expected %v but got %v", testCase.expected, actual)
+			}
+			if changes := helperCountRequests(f.Requests(), "POST rrset"); changes != testCase.changes {
+				t.Errorf("invalid changes: expected %d but got %d", testCase.changes, changes)
+			}
+			for _, set := range testCase.existing {
+				if set.Name != dnsName {
+					if actual, _ := f.RecordSet("Z1", set.Name, set.Type, ""); actual.String() != set.String() {
+						t.Errorf("foreign record set changed: expected %s but got %s", set, actual)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRoute53BroadcasterRouting(t *testing.T) {
+	f, api := helperRoute53(t, "example.com")
+	defer f.Close()
+	weight := int64(20)
+	other := fakeRecordSet{Name: "app.example.com", Type: "A", SetIdentifier: "us-east", Weight: &weight, TTL: 300, ResourceRecords: []fakeRecord{{"9.9.9.9"}}}
+	f.AddRecordSet("Z1", other)
+
+	weighted, err := NewRoute53Broadcaster(api, "app.example.com", Route53Weighted("eu-west", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := weighted.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	set, exists := f.RecordSet("Z1", "app.example.com", "A", "eu-west")
+	if !exists || set.String() != "A 1.2.3.4" || set.Weight == nil || *set.Weight != 10 {
+		t.Errorf("invalid weighted record set: expected 'A 1.2.3.4' weighing 10 but got %+v", set)
+	}
+	other.Name = "app.example.com."
+	if set, _ := f.RecordSet("Z1", "app.example.com", "A", "us-east"); !reflect.DeepEqual(set, other) {
+		t.Errorf("record set of another cluster changed: expected %+v but got %+v", other, set)
+	}
+
+	multi, err := NewRoute53Broadcaster(api, "multi.example.com", Route53MultiValue("eu-west"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := multi.Broadcast(context.Background(), []string{"1.2.3.4", "5.6.7.8"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	set, exists = f.RecordSet("Z1", "multi.example.com", "A", "eu-west")
+	if !exists || set.String() != "A 1.2.3.4 5.6.7.8" || set.MultiValueAnswer == nil || !*set.MultiValueAnswer {
+		t.Errorf("invalid multivalue record set: expected 'A 1.2.3.4 5.6.7.8' with a multivalue answer but got %+v", set)
+	}
+}
+
+func TestRoute53BroadcasterZone(t *testing.T) {
+	f, api := helperRoute53(t, "example.com", "dev.example.com")
+	defer f.Close()
+	private := f.AddZone("staging.example.com", true)
+	public := f.AddZone("staging.example.com", false)
+
+	b, err := NewRoute53Broadcaster(api, "app.dev.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if sets := f.RecordSets("Z2", "app.dev.example.com"); !reflect.DeepEqual(sets, []string{"A 1.2.3.4"}) {
+		t.Errorf("invalid zone: expected 'A 1.2.3.4' in dev.example.com but got %v", sets)
+	}
+	b.Broadcast(context.Background(), []string{"1.2.3.4"})
+	// app.dev.example.com then dev.example.com
+	if lookups := helperCountRequests(f.Requests(), "GET hostedzonesbyname"); lookups != 2 {
+		t.Errorf("zone not cached: expected 2 lookups but got %d", lookups)
+	}
+
+	b, err = NewRoute53Broadcaster(api, "app.staging.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if sets := f.RecordSets(public, "app.staging.example.com"); len(sets) != 1 {
+		t.Errorf("public zone not preferred: expected a record set but got %v", sets)
+	}
+	if sets := f.RecordSets(private, "app.staging.example.com"); len(sets) != 0 {
+		t.Errorf("private zone changed: expected no record set but got %v", sets)
+	}
+
+	b, err = NewRoute53Broadcaster(api, "app.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err == nil || !strings.Contains(err.Error(), "no route53 hosted zone") {
+		t.Errorf("unknown zone: expected a lookup error but got %v", err)
+	}
+}
+
+func TestRoute53BroadcasterWaitForSync(t *testing.T) {
+	f, api := helperRoute53(t, "example.com")
+	defer f.Close()
+	b, err := NewRoute53Broadcaster(api, "app.example.com", Route53WaitForSync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.(*route53Broadcaster).waitDelay = time.Millisecond
+	if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if polls := helperCountRequests(f.Requests(), "GET change"); polls != 2 {
+		t.Errorf("change not awaited: expected 2 polls but got %d", polls)
+	}
+}
+
+type route53FailureTestCase struct {
+	request   string
+	code      string
+	retryable bool
+}
+
+func TestRoute53BroadcasterFailures(t *testing.T) {
+	testCases := map[string]route53FailureTestCase{
+		"Throttling": {
+			request:   "POST rrset",
+			code:      "Throttling",
+			retryable: true,
+		},
+		"PriorRequestNotComplete": {
+			request:   "POST rrset",
+			code:      "PriorRequestNotComplete",
+			retryable: true,
+		},
+		"InvalidChangeBatch": {
+			request:   "POST rrset",
+			code:      "InvalidChangeBatch",
+			retryable: false,
+		},
+		"InternalError": {
+			request:   "GET rrset",
+			code:      "InternalError",
+			retryable: true,
+		},
+		"AccessDenied": {
+			request:   "GET hostedzonesbyname",
+			code:      "AccessDenied",
+			retryable: false,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			f, api := helperRoute53(t, "example.com")
+			defer f.Close()
+			f.Fail(testCase.request, testCase.code)
+			b, err := NewRoute53Broadcaster(api, "app.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Broadcast(context.Background(), []string{"1.2.3.4"})
+			if err == nil {
+				t.Fatal("broadcast succeeded: expected an error but got <nil>")
+			}
+			if IsRetryable(err) != testCase.retryable {
+				t.Errorf("invalid classification of %v: expected %v but got %v", err, testCase.retryable, !testCase.retryable)
+			}
+		})
+	}
+}
+
+func TestRoute53Plan(t *testing.T) {
+	f, api := helperRoute53(t, "example.com")
+	defer f.Close()
+	f.AddRecordSet("Z1", fakeRecordSet{Name: "app.example.com", Type: "A", TTL: 300, ResourceRecords: []fakeRecord{{"1.1.1.1"}}})
+	f.AddRecordSet("Z1", fakeRecordSet{Name: "app.example.com", Type: "AAAA", TTL: 300, ResourceRecords: []fakeRecord{{"2001:db8::1"}}})
+	b, err := NewRoute53Broadcaster(api, "app.example.com", Route53AddressFamily(AllFamilies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanBroadcast(context.Background(), b, []string{"1.2.3.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Plan{
+		{Kind: UpdateAction, Target: "A app.example.com", Value: "1.2.3.4"},
+		{Kind: DeleteAction, Target: "AAAA app.example.com", Value: "2001:db8::1"},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("invalid plan: expected\n%s\nbut got\n%s", expected, plan)
+	}
+	if changes := helperCountRequests(f.Requests(), "POST rrset"); changes != 0 {
+		t.Errorf("plan applied: expected no change but got %d", changes)
+	}
+	if set, _ := f.RecordSet("Z1", "app.example.com", "A", ""); set.String() != "A 1.1.1.1" {
+		t.Errorf("record set changed: expected 'A 1.1.1.1' but got '%s'", set)
+	}
+}
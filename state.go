@@ -0,0 +1,317 @@
+package ip8s
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// StateStore persists the last IPs successfully broadcast by each
+// broadcaster, under the name of the broadcaster.
+type StateStore interface {
+	// Load returns false when nothing was saved under key yet.
+	Load(ctx context.Context, key string) ([]string, bool, error)
+	Save(ctx context.Context, key string, ips []string) error
+}
+
+// stateDocument is the JSON document of the file and ConfigMap stores.
+type stateDocument map[string][]string
+
+func decodeState(data []byte) (stateDocument, error) {
+	state := stateDocument{}
+	if len(data) == 0 {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrap(err, "invalid state")
+	}
+	return state, nil
+}
+
+func (s stateDocument) load(key string) ([]string, bool) {
+	ips, saved := s[key]
+	if saved && ips == nil {
+		ips = []string{}
+	}
+	return ips, saved
+}
+
+func (s stateDocument) save(key string, ips []string) {
+	sorted := append([]string{}, ips...)
+	sort.Strings(sorted)
+	s[key] = sorted
+}
+
+type memoryStateStore struct {
+	l     sync.Mutex
+	state stateDocument
+}
+
+// NewMemoryStateStore keeps the state for the lifetime of the process only.
+func NewMemoryStateStore() StateStore {
+	return &memoryStateStore{state: stateDocument{}}
+}
+
+func (s *memoryStateStore) Load(ctx context.Context, key string) ([]string, bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	ips, saved := s.state.load(key)
+	return append([]string(nil), ips...), saved, nil
+}
+
+func (s *memoryStateStore) Save(ctx context.Context, key string, ips []string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.state.save(key, ips)
+	return nil
+}
+
+type fileStateStore struct {
+	l    sync.Mutex
+	path string
+}
+
+// NewFileStateStore keeps the state as a JSON document in the file at path,
+// created on the first save. The file should be on a persistent volume.
+func NewFileStateStore(path string) (StateStore, error) {
+	if path == "" {
+		return nil, errors.New("missing state file path")
+	}
+	return &fileStateStore{path: path}, nil
+}
+
+func (s *fileStateStore) read() (stateDocument, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return stateDocument{}, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the state file %s", s.path)
+	}
+	return decodeState(data)
+}
+
+func (s *fileStateStore) Load(ctx context.Context, key string) ([]string, bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	state, err := s.read()
+	if err != nil {
+		return nil, false, err
+	}
+	ips, saved := state.load(key)
+	return ips, saved, nil
+}
+
+// Save replaces the file with a temporary one so that it is never left
+// half written.
+func (s *fileStateStore) Save(ctx context.Context, key string, ips []string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	state, err := s.read()
+	if err != nil {
+		return err
+	}
+	state.save(key, ips)
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the state")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".")
+	if err != nil {
+		return errors.Wrap(err, "failed to create the state file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write the state file %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write the state file %s", tmp.Name())
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), s.path), "failed to replace the state file %s", s.path)
+}
+
+// ConfigMapStateKey is the key of the JSON document in the ConfigMap.
+const ConfigMapStateKey = "state.json"
+
+type configMapStateStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapStateStore keeps the state in the namespace/name ConfigMap,
+// created on the first save. It can be shared by the replicas of a leader
+// election.
+func NewConfigMapStateStore(client kubernetes.Interface, namespace, name string) (StateStore, error) {
+	if namespace == "" || name == "" {
+		return nil, errors.New("missing namespace or name of the state ConfigMap")
+	}
+	return &configMapStateStore{client: client, namespace: namespace, name: name}, nil
+}
+
+func (s *configMapStateStore) Load(ctx context.Context, key string) ([]string, bool, error) {
+	configMap, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to get the state ConfigMap %s/%s", s.namespace, s.name)
+	}
+	state, err := decodeState([]byte(configMap.Data[ConfigMapStateKey]))
+	if err != nil {
+		return nil, false, err
+	}
+	ips, saved := state.load(key)
+	return ips, saved, nil
+}
+
+// Save updates the ConfigMap again when another replica updated it
+// concurrently.
+func (s *configMapStateStore) Save(ctx context.Context, key string, ips []string) error {
+	conflicting := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	err := retry.OnError(retry.DefaultRetry, conflicting, func() error {
+		configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+		configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+		exists := err == nil
+		if apierrors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.name}}
+		} else if err != nil {
+			return err
+		}
+		state, err := decodeState([]byte(configMap.Data[ConfigMapStateKey]))
+		if err != nil {
+			return err
+		}
+		state.save(key, ips)
+		data, err := json.Marshal(state)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode the state")
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[ConfigMapStateKey] = string(data)
+		if exists {
+			_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		} else {
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		}
+		return err
+	})
+	return errors.Wrapf(err, "failed to save the state ConfigMap %s/%s", s.namespace, s.name)
+}
+
+type statefulBroadcaster struct {
+	broadcaster Broadcaster
+	key         string
+	store       StateStore
+	logger      *log.Logger
+
+	// l serializes the broadcasts between their load and save
+	l sync.Mutex
+	// unsaved are the IPs broadcast but not saved, if any, they replace the
+	// saved ones until they are
+	unsaved []string
+}
+
+type StatefulOption func(*statefulBroadcaster)
+
+// StatefulLogger logs the failures to load and save the state (default:
+// stderr).
+func StatefulLogger(logger *log.Logger) StatefulOption {
+	return func(b *statefulBroadcaster) {
+		b.logger = logger
+	}
+}
+
+// NewStatefulBroadcaster skips the broadcasts of the IPs last broadcast by
+// b, as saved in store under key, and makes the added and removed IPs
+// relative to them. It should wrap the retry broadcaster to only save the
+// IPs once broadcast.
+func NewStatefulBroadcaster(b Broadcaster, key string, store StateStore, opts ...StatefulOption) Broadcaster {
+	broadcaster := &statefulBroadcaster{
+		broadcaster: b,
+		key:         key,
+		store:       store,
+		logger:      log.New(os.Stderr, "", log.LstdFlags),
+	}
+	for _, opt := range opts {
+		opt(broadcaster)
+	}
+	return broadcaster
+}
+
+// unchanged returns the change relative to the saved IPs, and whether they
+// are the same IPs. The IPs are considered not saved when the state cannot
+// be loaded, rather than never broadcasting them.
+func (b *statefulBroadcaster) unchanged(ctx context.Context, change Change) (Change, bool) {
+	if b.unsaved != nil {
+		change = newChange(b.unsaved, change.IPs, change.Nodes)
+		return change, len(change.Added) == 0 && len(change.Removed) == 0
+	}
+	previous, saved, err := b.store.Load(ctx, b.key)
+	if err != nil {
+		b.logger.Printf("failed to load the state of %s, broadcasting all the changes: %v", b.key, err)
+		return change, false
+	}
+	if !saved {
+		return change, false
+	}
+	change = newChange(previous, change.IPs, change.Nodes)
+	return change, len(change.Added) == 0 && len(change.Removed) == 0
+}
+
+func (b *statefulBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	return b.BroadcastChange(ctx, Change{IPs: ips})
+}
+
+// BroadcastChange succeeds once the change is broadcast: the failure to
+// save the IPs is logged, and they are kept in memory to be saved with the
+// next broadcast, rather than broadcasting them again.
+func (b *statefulBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	change, unchanged := b.unchanged(ctx, change)
+	if !unchanged {
+		if err := BroadcastChange(ctx, b.broadcaster, change); err != nil {
+			return err
+		}
+	} else if b.unsaved == nil {
+		return nil
+	}
+	b.unsaved = nil
+	if err := b.store.Save(ctx, b.key, change.IPs); err != nil {
+		b.logger.Printf("failed to save the state of %s, keeping it in memory: %v", b.key, err)
+		b.unsaved = append([]string{}, change.IPs...)
+	}
+	return nil
+}
+
+// Plan is empty when the IPs were already broadcast.
+func (b *statefulBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	return b.PlanChange(ctx, Change{IPs: ips})
+}
+
+// PlanChange plans the change relative to the saved IPs.
+func (b *statefulBroadcaster) PlanChange(ctx context.Context, change Change) (Plan, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	change, unchanged := b.unchanged(ctx, change)
+	if unchanged {
+		return Plan{}, nil
+	}
+	return PlanBroadcastChange(ctx, b.broadcaster, change)
+}
@@ -0,0 +1,229 @@
+package ip8s
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStateStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ip8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := fakekube.NewSimpleClientset()
+	stores := map[string]func() (StateStore, error){
+		"Memory": func() func() (StateStore, error) {
+			store := NewMemoryStateStore()
+			return func() (StateStore, error) { return store, nil }
+		}(),
+		"File": func() (StateStore, error) {
+			return NewFileStateStore(filepath.Join(dir, "state.json"))
+		},
+		"ConfigMap": func() (StateStore, error) {
+			return NewConfigMapStateStore(client, "ip8s", "ip8s-state")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store, err := newStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ips, saved, err := store.Load(ctx, "slack#0"); err != nil || saved {
+				t.Errorf("invalid initial state: expected nothing saved but got %v, %v, %v", ips, saved, err)
+			}
+			if err := store.Save(ctx, "slack#0", []string{"1.2.3.5", "1.2.3.4"}); err != nil {
+				t.Fatalf("save failed: expected <nil> but got %v", err)
+			}
+			if err := store.Save(ctx, "webhook#1", []string{}); err != nil {
+				t.Fatalf("save failed: expected <nil> but got %v", err)
+			}
+
+			// the state outlives the store, as on a restart
+			if store, err = newStore(); err != nil {
+				t.Fatal(err)
+			}
+			if ips, saved, err := store.Load(ctx, "slack#0"); err != nil || !saved || !helperEqual(ips, []string{"1.2.3.4", "1.2.3.5"}) {
+				t.Errorf("invalid state: expected [1.2.3.4 1.2.3.5] but got %v, %v, %v", ips, saved, err)
+			}
+			if ips, saved, err := store.Load(ctx, "webhook#1"); err != nil || !saved || len(ips) != 0 {
+				t.Errorf("invalid empty state: expected [] saved but got %v, %v, %v", ips, saved, err)
+			}
+		})
+	}
+}
+
+func TestFileStateStoreInvalid(t *testing.T) {
+	file, err := ioutil.TempFile("", "ip8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("not json")
+	file.Close()
+	store, err := NewFileStateStore(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Load(context.Background(), "slack#0"); err == nil {
+		t.Error("invalid state loaded: expected an error but got <nil>")
+	}
+	if err := store.Save(context.Background(), "slack#0", []string{"1.2.3.4"}); err == nil {
+		t.Error("invalid state overwritten: expected an error but got <nil>")
+	}
+}
+
+func TestStatefulBroadcaster(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStateStore()
+	recorder := &changeRecordingBroadcaster{}
+	b := NewStatefulBroadcaster(recorder, "slack#0", store)
+	if err := BroadcastChange(ctx, b, newChange(nil, []string{"1.2.3.4"}, nil)); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if err := BroadcastChange(ctx, b, newChange([]string{"1.2.3.4"}, []string{"1.2.3.4"}, nil)); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if len(recorder.changes) != 1 {
+		t.Fatalf("unchanged IPs broadcast: expected 1 change but got %+v", recorder.changes)
+	}
+
+	// a restart emits the initial set again, only broadcast when it changed
+	b = NewStatefulBroadcaster(recorder, "slack#0", store)
+	if err := BroadcastChange(ctx, b, newChange(nil, []string{"1.2.3.4"}, nil)); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if plan, err := PlanBroadcast(ctx, b, []string{"1.2.3.4"}); err != nil || len(plan) != 0 {
+		t.Errorf("invalid plan: expected nothing but got %v, %v", plan, err)
+	}
+	if err := BroadcastChange(ctx, b, newChange(nil, []string{"1.2.3.5"}, nil)); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if len(recorder.changes) != 2 {
+		t.Fatalf("invalid broadcasts: expected 2 changes but got %+v", recorder.changes)
+	}
+	if change := recorder.changes[1]; !helperEqual(change.Added, []string{"1.2.3.5"}) || !helperEqual(change.Removed, []string{"1.2.3.4"}) {
+		t.Errorf("invalid change: expected 1.2.3.5 added and 1.2.3.4 removed but got %+v", change)
+	}
+
+	// the failed broadcasts are not saved
+	recorder.err = errors.New("no_service")
+	if err := BroadcastChange(ctx, b, newChange(nil, []string{"1.2.3.6"}, nil)); err == nil {
+		t.Fatal("broadcast succeeded: expected an error but got <nil>")
+	}
+	if ips, _, _ := store.Load(ctx, "slack#0"); !helperEqual(ips, []string{"1.2.3.5"}) {
+		t.Errorf("invalid state: expected [1.2.3.5] but got %v", ips)
+	}
+}
+
+// failingStateStore fails to load the state.
+type failingStateStore struct {
+	StateStore
+}
+
+func (s failingStateStore) Load(ctx context.Context, key string) ([]string, bool, error) {
+	return nil, false, errors.New("forbidden")
+}
+
+func TestStatefulBroadcasterLoadFailure(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStateStore()
+	recorder := &changeRecordingBroadcaster{}
+	b := NewStatefulBroadcaster(recorder, "slack#0", failingStateStore{store}, StatefulLogger(log.New(ioutil.Discard, "", 0)))
+	change := newChange([]string{"1.2.3.4"}, []string{"1.2.3.4", "1.2.3.5"}, nil)
+	if plan, err := PlanBroadcastChange(ctx, b, change); err != nil || len(plan) != 1 {
+		t.Errorf("invalid plan: expected the change but got %v, %v", plan, err)
+	}
+	if err := BroadcastChange(ctx, b, change); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if len(recorder.changes) != 1 || !helperEqual(recorder.changes[0].Added, []string{"1.2.3.5"}) {
+		t.Errorf("change not broadcast: expected 1.2.3.5 added but got %+v", recorder.changes)
+	}
+	if ips, _, _ := store.Load(ctx, "slack#0"); !helperEqual(ips, []string{"1.2.3.4", "1.2.3.5"}) {
+		t.Errorf("invalid state: expected [1.2.3.4 1.2.3.5] but got %v", ips)
+	}
+}
+
+// unsavableStateStore fails to save the state while failing is set.
+type unsavableStateStore struct {
+	StateStore
+	failing bool
+}
+
+func (s *unsavableStateStore) Save(ctx context.Context, key string, ips []string) error {
+	if s.failing {
+		return errors.New("forbidden")
+	}
+	return s.StateStore.Save(ctx, key, ips)
+}
+
+func TestStatefulBroadcasterSaveFailure(t *testing.T) {
+	ctx := context.Background()
+	store := &unsavableStateStore{NewMemoryStateStore(), true}
+	recorder := &changeRecordingBroadcaster{}
+	b := NewStatefulBroadcaster(recorder, "slack#0", store, StatefulLogger(log.New(ioutil.Discard, "", 0)))
+	// the broadcast succeeded, its delivery must not be retried
+	if err := b.Broadcast(ctx, []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if err := b.Broadcast(ctx, []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if len(recorder.changes) != 1 {
+		t.Errorf("IPs broadcast again: expected 1 change but got %+v", recorder.changes)
+	}
+
+	// the IPs kept in memory are saved with the next broadcast
+	store.failing = false
+	if err := b.Broadcast(ctx, []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if ips, saved, _ := store.Load(ctx, "slack#0"); !saved || !helperEqual(ips, []string{"1.2.3.4"}) {
+		t.Errorf("invalid state: expected [1.2.3.4] but got %v", ips)
+	}
+	if err := b.Broadcast(ctx, []string{"1.2.3.4", "1.2.3.5"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	if len(recorder.changes) != 2 || !helperEqual(recorder.changes[1].Added, []string{"1.2.3.5"}) {
+		t.Errorf("invalid changes: expected 1.2.3.5 added but got %+v", recorder.changes)
+	}
+}
+
+func TestConfigState(t *testing.T) {
+	server := helperSlack(t)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "ip8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &Config{
+		State: &StateConfig{Type: "file", File: &FileStateConfig{Path: filepath.Join(dir, "state.json")}},
+		Broadcasters: []BroadcasterConfig{
+			{Type: "slack", Slack: &SlackConfig{WebhookURLs: []string{server.WebhookURL("ops")}, DNSName: "example.com"}},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		// a new broadcaster for each restart
+		b, err := config.Broadcaster()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Broadcast(context.Background(), []string{"1.2.3.4"}); err != nil {
+			t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+		}
+	}
+	if messages := server.Messages(); len(messages) != 1 {
+		t.Errorf("IPs broadcast again after a restart: expected 1 message but got %d", len(messages))
+	}
+}
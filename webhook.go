@@ -0,0 +1,309 @@
+package ip8s
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WebhookPayloadVersion is bumped on every incompatible change of
+// WebhookPayload.
+const WebhookPayloadVersion = 1
+
+// WebhookPayload is the JSON document posted by the webhook broadcaster.
+// Added and Removed are relative to the previous IPs of the change, all the
+// IPs are added without them.
+type WebhookPayload struct {
+	Version int      `json:"version"`
+	DNSName string   `json:"dnsName"`
+	IPs     []string `json:"ips"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Nodes maps the IPs to the nodes reporting them, when known.
+	Nodes     map[string]WebhookNode `json:"nodes,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// WebhookNode describes the node reporting an IP.
+type WebhookNode struct {
+	Name   string            `json:"name"`
+	Zone   string            `json:"zone,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+const defaultWebhookSignatureHeader = "X-Ip8s-Signature"
+
+type webhookBroadcaster struct {
+	client          *http.Client
+	urls            []string
+	dnsName         string
+	headers         http.Header
+	secret          []byte
+	signatureHeader string
+	timeout         time.Duration
+	statuses        []int
+	now             func() time.Time
+
+	// hosts name the urls in the errors and plans, the urls often hold
+	// secrets
+	hosts []string
+}
+
+type WebhookOption func(*webhookBroadcaster)
+
+// WebhookHeader adds a header to every request (e.g. an Authorization).
+func WebhookHeader(name, value string) WebhookOption {
+	return func(b *webhookBroadcaster) {
+		b.headers.Add(name, value)
+	}
+}
+
+// WebhookSecret signs the payloads with HMAC-SHA256, the signature is sent
+// as "sha256=<hex>" in the X-Ip8s-Signature header.
+func WebhookSecret(secret string) WebhookOption {
+	return func(b *webhookBroadcaster) {
+		b.secret = []byte(secret)
+	}
+}
+
+// WebhookSignatureHeader renames the header of the signature.
+func WebhookSignatureHeader(name string) WebhookOption {
+	return func(b *webhookBroadcaster) {
+		b.signatureHeader = name
+	}
+}
+
+// WebhookTimeout bounds each request (default: 10s).
+func WebhookTimeout(timeout time.Duration) WebhookOption {
+	return func(b *webhookBroadcaster) {
+		b.timeout = timeout
+	}
+}
+
+// WebhookExpectedStatus lists the accepted response statuses (default: any
+// 2xx).
+func WebhookExpectedStatus(statuses ...int) WebhookOption {
+	return func(b *webhookBroadcaster) {
+		b.statuses = append([]int(nil), statuses...)
+	}
+}
+
+func WebhookHTTPClient(client *http.Client) WebhookOption {
+	return func(b *webhookBroadcaster) {
+		b.client = client
+	}
+}
+
+// NewWebhookBroadcaster posts a WebhookPayload to each URL. A failed URL
+// fails the whole broadcast, a broadcaster per URL lets a delivery only
+// broadcast again to the failed ones.
+func NewWebhookBroadcaster(urls []string, dnsName string, opts ...WebhookOption) (Broadcaster, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("missing webhook urls")
+	}
+	hosts := make([]string, len(urls))
+	for i, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, errors.Errorf("invalid webhook url #%d", i)
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, errors.Errorf("invalid webhook url #%d: expected an absolute http(s) url", i)
+		}
+		hosts[i] = parsed.Host
+	}
+	if err := validateDNSName(dnsName); err != nil {
+		return nil, err
+	}
+	b := &webhookBroadcaster{
+		client:          http.DefaultClient,
+		urls:            append([]string(nil), urls...),
+		hosts:           hosts,
+		dnsName:         dnsName,
+		headers:         http.Header{},
+		signatureHeader: defaultWebhookSignatureHeader,
+		timeout:         10 * time.Second,
+		now:             time.Now,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.client == nil {
+		return nil, errors.New("missing http client")
+	}
+	if b.timeout <= 0 {
+		return nil, errors.Errorf("invalid webhook timeout %s", b.timeout)
+	}
+	if b.signatureHeader == "" {
+		return nil, errors.New("missing signature header")
+	}
+	for _, status := range b.statuses {
+		if status < 100 || status > 599 {
+			return nil, errors.Errorf("invalid expected status %d", status)
+		}
+	}
+	return b, nil
+}
+
+// difference returns the IPs of one missing from two.
+func difference(one, two []string) []string {
+	known := make(map[string]bool, len(two))
+	for _, ip := range two {
+		known[ip] = true
+	}
+	missing := []string{}
+	for _, ip := range one {
+		if !known[ip] {
+			missing = append(missing, ip)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// sortedCopy returns a sorted copy of ips, never nil so that it is encoded
+// as a JSON array.
+func sortedCopy(ips []string) []string {
+	sorted := append([]string{}, ips...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func (b *webhookBroadcaster) payload(change Change) WebhookPayload {
+	payload := WebhookPayload{
+		Version:   WebhookPayloadVersion,
+		DNSName:   b.dnsName,
+		IPs:       sortedCopy(change.IPs),
+		Added:     sortedCopy(change.Added),
+		Removed:   sortedCopy(change.Removed),
+		Timestamp: b.now().UTC(),
+	}
+	for _, ip := range payload.IPs {
+		node, exists := change.Nodes[ip]
+		if !exists {
+			continue
+		}
+		if payload.Nodes == nil {
+			payload.Nodes = map[string]WebhookNode{}
+		}
+		payload.Nodes[ip] = WebhookNode{Name: node.Name, Zone: node.Zone, Labels: node.Labels}
+	}
+	return payload
+}
+
+// WebhookSignature returns the signature of a payload for the given
+// secret, as sent in the signature header.
+func WebhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookStatusError struct {
+	host   string
+	status int
+}
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook %s answered with HTTP status %d", e.host, e.status)
+}
+
+func (e webhookStatusError) HTTPStatusCode() int {
+	return e.status
+}
+
+func (b *webhookBroadcaster) expected(status int) bool {
+	if len(b.statuses) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, s := range b.statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *webhookBroadcaster) post(parent context.Context, i int, body []byte) error {
+	ctx, cancel := context.WithTimeout(parent, b.timeout)
+	defer cancel()
+	host := b.hosts[i]
+	req, err := http.NewRequest(http.MethodPost, b.urls[i], bytes.NewReader(body))
+	if err != nil {
+		return Permanent(errors.Errorf("invalid webhook request to %s", host))
+	}
+	req = req.WithContext(ctx)
+	for name, values := range b.headers {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.secret != nil {
+		req.Header.Set(b.signatureHeader, WebhookSignature(b.secret, body))
+	}
+	resp, err := b.client.Do(req)
+	if err != nil && parent.Err() == nil && ctx.Err() != nil {
+		// unlike a cancellation of the broadcast, a timeout is worth retrying
+		return errors.Errorf("webhook %s timed out after %s", host, b.timeout)
+	} else if err != nil {
+		// the url errors would log the secret url
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return errors.Wrapf(err, "failed to call webhook %s", host)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if !b.expected(resp.StatusCode) {
+		return webhookStatusError{host, resp.StatusCode}
+	}
+	return nil
+}
+
+func (b *webhookBroadcaster) Broadcast(ctx context.Context, ips []string) error {
+	return b.BroadcastChange(ctx, newChange(nil, ips, nil))
+}
+
+func (b *webhookBroadcaster) BroadcastChange(ctx context.Context, change Change) error {
+	body, err := json.Marshal(b.payload(change))
+	if err != nil {
+		return Permanent(errors.Wrap(err, "failed to encode the webhook payload"))
+	}
+	var errs []error
+	for i := range b.urls {
+		if err := b.post(ctx, i, body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return combineErrors(errs)
+	}
+	return nil
+}
+
+func (b *webhookBroadcaster) Plan(ctx context.Context, ips []string) (Plan, error) {
+	return b.PlanChange(ctx, newChange(nil, ips, nil))
+}
+
+func (b *webhookBroadcaster) PlanChange(ctx context.Context, change Change) (Plan, error) {
+	body, err := json.Marshal(b.payload(change))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode the webhook payload")
+	}
+	plan := make(Plan, len(b.urls))
+	for i, host := range b.hosts {
+		plan[i] = Action{Kind: SendAction, Target: "webhook " + host, Value: string(body)}
+	}
+	return plan, nil
+}
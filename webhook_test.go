@@ -0,0 +1,247 @@
+package ip8s
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	header  http.Header
+	body    []byte
+	payload WebhookPayload
+}
+
+// helperWebhook records the requests and answers with the given status.
+func helperWebhook(status int, delay time.Duration) (*httptest.Server, func() []webhookRequest) {
+	var l sync.Mutex
+	var requests []webhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		request := webhookRequest{header: r.Header, body: body}
+		json.Unmarshal(body, &request.payload)
+		l.Lock()
+		requests = append(requests, request)
+		l.Unlock()
+		time.Sleep(delay)
+		w.WriteHeader(status)
+	}))
+	return server, func() []webhookRequest {
+		l.Lock()
+		defer l.Unlock()
+		return append([]webhookRequest(nil), requests...)
+	}
+}
+
+type newWebhookBroadcasterTestCase struct {
+	urls  []string
+	opts  []WebhookOption
+	valid bool
+}
+
+func TestNewWebhookBroadcaster(t *testing.T) {
+	testCases := map[string]newWebhookBroadcasterTestCase{
+		"Valid": {
+			urls:  []string{"https://allowlist.example.com/hook", "http://cmdb:8080/ips"},
+			valid: true,
+		},
+		"MissingURLs": {
+			valid: false,
+		},
+		"RelativeURL": {
+			urls:  []string{"/hook"},
+			valid: false,
+		},
+		"UnknownScheme": {
+			urls:  []string{"ftp://example.com/hook"},
+			valid: false,
+		},
+		"InvalidTimeout": {
+			urls:  []string{"https://example.com/hook"},
+			opts:  []WebhookOption{WebhookTimeout(0)},
+			valid: false,
+		},
+		"InvalidStatus": {
+			urls:  []string{"https://example.com/hook"},
+			opts:  []WebhookOption{WebhookExpectedStatus(200, 1000)},
+			valid: false,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewWebhookBroadcaster(testCase.urls, "example.com", testCase.opts...)
+			if testCase.valid && err != nil {
+				t.Errorf("broadcaster rejected: expected <nil> but got %v", err)
+			} else if !testCase.valid && err == nil {
+				t.Error("broadcaster accepted: expected an error but got <nil>")
+			}
+		})
+	}
+}
+
+func TestWebhookBroadcaster(t *testing.T) {
+	one, oneRequests := helperWebhook(http.StatusOK, 0)
+	defer one.Close()
+	two, twoRequests := helperWebhook(http.StatusNoContent, 0)
+	defer two.Close()
+	now := time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
+	b, err := NewWebhookBroadcaster([]string{one.URL, two.URL}, "example.com",
+		WebhookHeader("Authorization", "Bearer token"),
+		WebhookSecret("s3cr3t"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.(*webhookBroadcaster).now = func() time.Time { return now }
+
+	if err := b.Broadcast(context.Background(), []string{"5.6.7.8", "1.2.3.4"}); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	nodes := map[string]NodeInfo{
+		"1.2.3.4": {Name: "node1", Zone: "eu-west-1a", Labels: map[string]string{"role": "ingress"}},
+		"9.9.9.9": {Name: "node3"},
+	}
+	change := newChange([]string{"1.2.3.4", "5.6.7.8"}, []string{"9.9.9.9", "1.2.3.4"}, nodes)
+	if err := BroadcastChange(context.Background(), b, change); err != nil {
+		t.Fatalf("broadcast failed: expected <nil> but got %v", err)
+	}
+	expected := []WebhookPayload{
+		{
+			Version:   1,
+			DNSName:   "example.com",
+			IPs:       []string{"1.2.3.4", "5.6.7.8"},
+			Added:     []string{"1.2.3.4", "5.6.7.8"},
+			Removed:   []string{},
+			Timestamp: now,
+		},
+		{
+			Version: 1,
+			DNSName: "example.com",
+			IPs:     []string{"1.2.3.4", "9.9.9.9"},
+			Added:   []string{"9.9.9.9"},
+			Removed: []string{"5.6.7.8"},
+			Nodes: map[string]WebhookNode{
+				"1.2.3.4": {Name: "node1", Zone: "eu-west-1a", Labels: map[string]string{"role": "ingress"}},
+				"9.9.9.9": {Name: "node3"},
+			},
+			Timestamp: now,
+		},
+	}
+	for name, requests := range map[string][]webhookRequest{"one": oneRequests(), "two": twoRequests()} {
+		if len(requests) != 2 {
+			t.Fatalf("invalid requests to %s: expected 2 but got %d", name, len(requests))
+		}
+		for i, request := range requests {
+			if !reflect.DeepEqual(request.payload, expected[i]) {
+				t.Errorf("invalid payload #%d to %s: expected %+v but got %+v", i, name, expected[i], request.payload)
+			}
+			if auth := request.header.Get("Authorization"); auth != "Bearer token" {
+				t.Errorf("invalid header: expected 'Bearer token' but got '%s'", auth)
+			}
+			if contentType := request.header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("invalid content type: expected 'application/json' but got '%s'", contentType)
+			}
+			signature := WebhookSignature([]byte("s3cr3t"), request.body)
+			if actual := request.header.Get("X-Ip8s-Signature"); actual != signature {
+				t.Errorf("invalid signature: expected '%s' but got '%s'", signature, actual)
+			}
+		}
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// echo -n '{"version":1}' | openssl dgst -sha256 -hmac key
+	expected := "sha256=13aadcd2d4df5c7527b811b8ecbe551596908f9609939aa1123c35f116ffb733"
+	if actual := WebhookSignature([]byte("key"), []byte(`{"version":1}`)); actual != expected {
+		t.Errorf("invalid signature: expected '%s' but got '%s'", expected, actual)
+	}
+}
+
+type webhookFailureTestCase struct {
+	status    int
+	delay     time.Duration
+	opts      []WebhookOption
+	success   bool
+	retryable bool
+}
+
+func TestWebhookBroadcasterFailures(t *testing.T) {
+	testCases := map[string]webhookFailureTestCase{
+		"ServerError": {
+			status:    http.StatusServiceUnavailable,
+			success:   false,
+			retryable: true,
+		},
+		"BadRequest": {
+			status:    http.StatusBadRequest,
+			success:   false,
+			retryable: false,
+		},
+		"UnexpectedStatus": {
+			status:    http.StatusOK,
+			opts:      []WebhookOption{WebhookExpectedStatus(http.StatusAccepted)},
+			success:   false,
+			retryable: false,
+		},
+		"ExpectedStatus": {
+			status:  http.StatusAccepted,
+			opts:    []WebhookOption{WebhookExpectedStatus(http.StatusAccepted)},
+			success: true,
+		},
+		"Timeout": {
+			status:    http.StatusOK,
+			delay:     200 * time.Millisecond,
+			opts:      []WebhookOption{WebhookTimeout(20 * time.Millisecond)},
+			success:   false,
+			retryable: true,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server, requests := helperWebhook(testCase.status, testCase.delay)
+			defer server.Close()
+			b, err := NewWebhookBroadcaster([]string{server.URL + "/hook/s3cr3t"}, "example.com", testCase.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Broadcast(context.Background(), []string{"1.2.3.4"})
+			if testCase.success && err != nil {
+				t.Errorf("broadcast failed: expected <nil> but got %v", err)
+			} else if !testCase.success && err == nil {
+				t.Error("broadcast succeeded: expected an error but got <nil>")
+			} else if !testCase.success && IsRetryable(err) != testCase.retryable {
+				t.Errorf("invalid classification of %v: expected %v but got %v", err, testCase.retryable, !testCase.retryable)
+			}
+			if err != nil && strings.Contains(err.Error(), "s3cr3t") {
+				t.Errorf("url not redacted: expected the host only but got %v", err)
+			}
+			if all := requests(); len(all) != 1 {
+				t.Errorf("invalid requests: expected 1 but got %d", len(all))
+			}
+		})
+	}
+}
+
+func TestWebhookPlan(t *testing.T) {
+	b, err := NewWebhookBroadcaster([]string{"https://example.com/hook/s3cr3t?token=abc"}, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanBroadcast(context.Background(), b, []string{"1.2.3.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 1 || plan[0].Kind != SendAction || plan[0].Target != "webhook example.com" {
+		t.Errorf("invalid plan: expected a single send to the webhook but got %v", plan)
+	}
+	if strings.Contains(plan.String(), "s3cr3t") {
+		t.Errorf("url not redacted: expected the host only but got %v", plan)
+	}
+}